@@ -1,15 +1,110 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"net/http"
 	"os"
+	"pacing.go/dispatcher"
 	"pacing.go/pacing"
 	"pacing.go/shared"
+	"strconv"
+	"time"
 )
 
+// envHTTPAddress configures the address the bid endpoint is served on, ":8080" by default.
+const envHTTPAddress = "PACING_HTTP_ADDR"
+
+// envBidPrice configures the CPM the bidder bids with, e.g. "1.5".
+const envBidPrice = "PACING_BID_PRICE"
+
+// envStateFile configures the file the bidder persists its state to for a fast restart, e.g. "tmp/bidder.json".
+const envStateFile = "PACING_STATE_FILE"
+
+// envFallbackFraction enables the fallback pacing at given fraction of the plan when the controller is unreachable, e.g. "0.5".
+const envFallbackFraction = "PACING_FALLBACK_FRACTION"
+
+// envRebalanceInterval enables returning and topping up the allowances mid-round at given interval, e.g. "5s".
+const envRebalanceInterval = "PACING_REBALANCE_INTERVAL"
+
+// envAdminAddress configures the address the admin endpoint is served on, it is not served by default.
+// POST /drain drains the bidder and stops it, as SIGINT and SIGTERM do.
+const envAdminAddress = "PACING_ADMIN_ADDR"
+
+// drainTimeout bounds the wait for the in-flight reservations, they expire after the reservation TTL anyway.
+const drainTimeout = 2 * pacing.DefaultReservationTTL
+
 func main() {
-	bidder, err := pacing.NewBidder()
+	opts := []pacing.BidderOption{pacing.WithReceiverOptions(dispatcher.EnvOptions()...)}
+	if v := os.Getenv(envBidPrice); v != "" {
+		price, err := strconv.ParseFloat(v, 64)
+		shared.PanicIf(err)
+		opts = append(opts, pacing.WithBidPrice(price))
+	}
+	if v := os.Getenv(envStateFile); v != "" {
+		opts = append(opts, pacing.WithStateFile(v))
+	}
+	if v := os.Getenv(envFallbackFraction); v != "" {
+		fraction, err := strconv.ParseFloat(v, 64)
+		shared.PanicIf(err)
+		opts = append(opts, pacing.WithFallbackPacing(fraction))
+	}
+	if v := os.Getenv(envRebalanceInterval); v != "" {
+		interval, err := time.ParseDuration(v)
+		shared.PanicIf(err)
+		opts = append(opts, pacing.WithRebalancing(interval, 0, 0))
+	}
+	bidder, err := pacing.NewBidder(opts...)
 	shared.PanicIf(err)
 	shared.PanicIf(bidder.Run())
 	defer func() { shared.PanicIf(bidder.Shutdown()) }()
-	shared.WaitForSignal(func(sig os.Signal) {})
+	addr := os.Getenv(envHTTPAddress)
+	if addr == "" {
+		addr = ":8080"
+	}
+	srv := &http.Server{Addr: addr, Handler: bidder.Handler(), ReadHeaderTimeout: time.Second}
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			shared.PanicIf(err)
+		}
+	}()
+	drain := make(chan struct{}, 1)
+	if adminAddr := os.Getenv(envAdminAddress); adminAddr != "" {
+		admin := &http.Server{Addr: adminAddr, Handler: adminHandler(drain), ReadHeaderTimeout: time.Second}
+		go func() {
+			if err := admin.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				shared.PanicIf(err)
+			}
+		}()
+		defer func() { _ = admin.Close() }()
+	}
+	shared.WaitForSignalOr(drain, func(_ os.Signal) {
+		// The win and loss notices are served until the in-flight reservations are done
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := bidder.Drain(ctx); err != nil {
+			log.Warn().Err(err).Msg("(bidder) cannot drain gracefully")
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shared.PanicIf(srv.Shutdown(ctx))
+	})
+}
+
+// adminHandler serves the drain endpoint, the drain is requested on given channel.
+func adminHandler(drain chan<- struct{}) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		select {
+		case drain <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	return mux
 }
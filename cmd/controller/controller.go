@@ -1,15 +1,94 @@
 package main
 
 import (
+	"github.com/rs/zerolog/log"
 	"os"
+	"os/signal"
+	"pacing.go/dispatcher"
 	"pacing.go/pacing"
 	"pacing.go/shared"
+	"strconv"
+	"syscall"
+	"time"
 )
 
+// snapshotPath is the snapshot of line items the controller plans the spend of, SIGHUP reloads it.
+const snapshotPath = "tmp/snapshot.json"
+
+// envElectionBucket enables leader election among controller replicas using given JetStream bucket.
+const envElectionBucket = "PACING_ELECTION_BUCKET"
+
+// envShardID enables partitioning of line items among controllers, the value is the stable controller ID.
+const envShardID = "PACING_SHARD_ID"
+
+// envMinShare enables splitting line items among subsets of bidders, each getting at least given allowance.
+const envMinShare = "PACING_MIN_SHARE"
+
+// envJoinReserve configures the fraction of allowances kept for bidders joining in the middle of a round, "0" disables it.
+const envJoinReserve = "PACING_JOIN_RESERVE"
+
+// envDispatchOffset configures how long after the slot start the dispatch rounds take place, e.g. "5s".
+const envDispatchOffset = "PACING_DISPATCH_OFFSET"
+
+// envBroadcast enables publishing a single workload message for all bidders every round, when set to "true".
+const envBroadcast = "PACING_BROADCAST"
+
+// envDeltaWorkloads enables sending only the allowances changed since the previous round, when set to "true".
+const envDeltaWorkloads = "PACING_DELTA_WORKLOADS"
+
 func main() {
-	srv, err := pacing.NewController("tmp/snapshot.json")
+	opts := dispatcher.EnvOptions()
+	if bucket := os.Getenv(envElectionBucket); bucket != "" {
+		opts = append(opts, dispatcher.WithLeaderElection(dispatcher.WithElectionBucket(bucket)))
+	}
+	if id := os.Getenv(envShardID); id != "" {
+		opts = append(opts, dispatcher.WithSharding(dispatcher.WithID(id)))
+	}
+	if v := os.Getenv(envJoinReserve); v != "" {
+		reserve, err := strconv.ParseFloat(v, 64)
+		shared.PanicIf(err)
+		opts = append(opts, dispatcher.WithJoinReserve(reserve))
+	}
+	if v := os.Getenv(envDispatchOffset); v != "" {
+		offset, err := time.ParseDuration(v)
+		shared.PanicIf(err)
+		opts = append(opts, dispatcher.WithDispatchOffset(offset))
+	}
+	if v := os.Getenv(envDeltaWorkloads); v != "" {
+		deltas, err := strconv.ParseBool(v)
+		shared.PanicIf(err)
+		if deltas {
+			opts = append(opts, dispatcher.WithDeltaWorkloads())
+		}
+	}
+	ctrlOpts := []pacing.ControllerOption{pacing.WithDispatcherOptions(opts...)}
+	if v := os.Getenv(envMinShare); v != "" {
+		minShare, err := strconv.ParseInt(v, 10, 64)
+		shared.PanicIf(err)
+		ctrlOpts = append(ctrlOpts, pacing.WithSubsetSize(pacing.MinShareSubsetSize(minShare)))
+	}
+	if v := os.Getenv(envBroadcast); v != "" {
+		broadcast, err := strconv.ParseBool(v)
+		shared.PanicIf(err)
+		if broadcast {
+			ctrlOpts = append(ctrlOpts, pacing.WithBroadcast())
+		}
+	}
+	srv, err := pacing.NewController(snapshotPath, ctrlOpts...)
 	shared.PanicIf(err)
 	shared.PanicIf(srv.Run())
 	defer srv.Shutdown()
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	go func() {
+		for range reload {
+			if err := srv.Reload(); err != nil {
+				log.Err(err).Msg("(controller) cannot reload snapshot")
+				continue
+			}
+			log.Info().Msg("(controller) snapshot reloaded")
+		}
+	}()
 	shared.WaitForSignal(func(sig os.Signal) {})
 }
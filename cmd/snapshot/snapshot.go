@@ -13,10 +13,19 @@ import (
 const lineItemsCount = 10
 const snapshotPath = "tmp/snapshot.json"
 
+var countries = []string{"DE", "FR", "PL", "US"}
+
 func randomRecord() *pacing.Record {
+	metadata, err := json.Marshal(pacing.LineItemMetadata{
+		BidPrice:  0.5 + float64(rand.Intn(10))/2,
+		Targeting: map[string][]string{"country": {countries[rand.Intn(len(countries))]}},
+		Priority:  rand.Intn(3),
+	})
+	shared.PanicIf(err)
 	return &pacing.Record{
 		LineItemID:  uuid.New(),
 		DailyBudget: rand.Int63n(100_000 * pacing.CurrencyUnit),
+		Metadata:    metadata,
 	}
 }
 
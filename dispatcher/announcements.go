@@ -1,9 +1,12 @@
 package dispatcher
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,10 +16,39 @@ const DefaultSubject = "announcements"
 // DefaultPeriod is the time period between consecutive announcements.
 const DefaultPeriod = 5 * time.Second
 
+// Announcement is the message published by Announcer and kept by Observer.
+// It identifies the consumer and describes its capabilities.
+type Announcement struct {
+	// ID is the stable identifier of the consumer, it does not change when the consumer reconnects.
+	ID string `json:"id"`
+	// Address is the NATS subject the consumer receives workloads on.
+	Address string `json:"address"`
+	// Version is the version of the consumer software.
+	Version string `json:"version,omitempty"`
+	// Labels are arbitrary key-values describing the consumer, e.g. region or exchange.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Capacity is the declared capacity of the consumer in queries per second.
+	Capacity int64 `json:"capacity,omitempty"`
+	// StartedAt is the time the consumer started announcing itself.
+	StartedAt time.Time `json:"started_at"`
+	// Load is the current load of the consumer in queries per second.
+	Load float64 `json:"load"`
+	// Draining is true when the consumer is about to leave, it gets no allowances anymore.
+	Draining bool `json:"draining,omitempty"`
+}
+
 // announcementsOptions represents configurable options for Announcer and Observer.
 type announcementsOptions struct {
-	subject string
-	period  time.Duration
+	subject  string
+	period   time.Duration
+	address  string
+	id       string
+	version  string
+	labels   map[string]string
+	capacity int64
+	load     func() float64
+	failures failurePolicy
+	onJoin   func(ann Announcement)
 }
 
 // AnnouncementsOption allows to define configurable options.
@@ -36,13 +68,73 @@ func WithPeriod(period time.Duration) AnnouncementsOption {
 	}
 }
 
-// Announcer represents the entity announcing consumer address.
+// WithAddress configures the address announced by Announcer, a new inbox is used if none provided.
+func WithAddress(address string) AnnouncementsOption {
+	return func(opts *announcementsOptions) {
+		opts.address = address
+	}
+}
+
+// WithID configures the stable consumer identifier announced by Announcer.
+func WithID(id string) AnnouncementsOption {
+	return func(opts *announcementsOptions) {
+		opts.id = id
+	}
+}
+
+// WithVersion configures the consumer version announced by Announcer.
+func WithVersion(version string) AnnouncementsOption {
+	return func(opts *announcementsOptions) {
+		opts.version = version
+	}
+}
+
+// WithLabels configures the consumer labels announced by Announcer.
+func WithLabels(labels map[string]string) AnnouncementsOption {
+	return func(opts *announcementsOptions) {
+		opts.labels = labels
+	}
+}
+
+// WithCapacity configures the declared consumer capacity (QPS) announced by Announcer.
+func WithCapacity(capacity int64) AnnouncementsOption {
+	return func(opts *announcementsOptions) {
+		opts.capacity = capacity
+	}
+}
+
+// WithLoad configures the function reporting current consumer load (QPS) announced by Announcer.
+func WithLoad(load func() float64) AnnouncementsOption {
+	return func(opts *announcementsOptions) {
+		opts.load = load
+	}
+}
+
+// WithJoinHandler configures the handler called by Observer when a new consumer joins.
+// A consumer joins when it is observed for the first time or again after it has expired.
+func WithJoinHandler(handler func(ann Announcement)) AnnouncementsOption {
+	return func(opts *announcementsOptions) {
+		opts.onJoin = handler
+	}
+}
+
+// withFailurePolicy configures how Announcer handles publish failures, by default they are only logged.
+func withFailurePolicy(policy failurePolicy) AnnouncementsOption {
+	return func(opts *announcementsOptions) {
+		opts.failures = policy
+	}
+}
+
+// Announcer represents the entity announcing consumer address and metadata.
 type Announcer struct {
-	nc      *nats.Conn
-	opts    *announcementsOptions
-	address string
-	msg     []byte
-	done    chan bool
+	nc        *nats.Conn
+	opts      *announcementsOptions
+	address   string
+	startedAt time.Time
+	budget    *errorBudget
+	publish   func(subject string, data []byte) error
+	draining  atomic.Bool
+	done      chan bool
 }
 
 // NewAnnouncer creates new Announcer instance.
@@ -63,15 +155,20 @@ func NewAnnouncer(nc *nats.Conn, opts ...AnnouncementsOption) (*Announcer, error
 	if options.period <= 0 {
 		options.period = DefaultPeriod
 	}
-	address := nats.NewInbox()
+	if options.address == "" {
+		options.address = nats.NewInbox()
+	}
+	if options.id == "" {
+		options.id = uuid.NewString()
+	}
 	a := &Announcer{
-		nc:      nc,
-		opts:    options,
-		address: address,
-		// The communication protocol is extremely simple.
-		// The announcer publishes its address as string.
-		msg:  []byte(address),
-		done: make(chan bool),
+		nc:        nc,
+		opts:      options,
+		address:   options.address,
+		startedAt: time.Now(),
+		budget:    newErrorBudget(options.failures),
+		publish:   nc.Publish,
+		done:      make(chan bool),
 	}
 	go a.loop()
 	return a, nil
@@ -82,6 +179,35 @@ func (a *Announcer) Address() string {
 	return a.address
 }
 
+// ID is the consumer identifier being announced.
+func (a *Announcer) ID() string {
+	return a.opts.id
+}
+
+// Announcement returns the current announcement message.
+func (a *Announcer) Announcement() Announcement {
+	var load float64
+	if a.opts.load != nil {
+		load = a.opts.load()
+	}
+	return Announcement{
+		ID:        a.opts.id,
+		Address:   a.address,
+		Version:   a.opts.version,
+		Labels:    a.opts.labels,
+		Capacity:  a.opts.capacity,
+		StartedAt: a.startedAt,
+		Load:      load,
+		Draining:  a.draining.Load(),
+	}
+}
+
+// Drain announces the consumer as draining right away, so observers drop it before the next announcement.
+func (a *Announcer) Drain() error {
+	a.draining.Store(true)
+	return a.announce()
+}
+
 // Stop gracefully stops internal routines and cleans up resources.
 func (a *Announcer) Stop() {
 	a.done <- true
@@ -89,37 +215,54 @@ func (a *Announcer) Stop() {
 
 // announce implements communication protocol and encoding.
 func (a *Announcer) announce() error {
-	return a.nc.Publish(a.opts.subject, a.msg)
+	msg, err := json.Marshal(a.Announcement())
+	if err != nil {
+		return fmt.Errorf("cannot encode announcement: %v", err)
+	}
+	return a.publish(a.opts.subject, msg)
+}
+
+// announceWithRetry announces, retrying on failure, and reports the failure to the error budget.
+// It returns false if the announcer has been stopped in the meantime.
+func (a *Announcer) announceWithRetry() bool {
+	err := retry(a.budget.policy, a.done, a.announce)
+	switch {
+	case err == errStopped:
+		return false
+	case err != nil:
+		a.budget.failure(fmt.Errorf("cannot publish announcement: %w", err))
+	default:
+		a.budget.success()
+	}
+	return true
 }
 
 // loop is announcing routine skeleton.
 func (a *Announcer) loop() {
-	var err error
 	// Run once immediately
-	err = a.announce()
-	if err != nil {
-		log.Err(err).Msg("error occurred when publishing announcement")
+	if !a.announceWithRetry() {
+		return
 	}
 	ticker := time.NewTicker(a.opts.period)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			err = a.announce()
-			if err != nil {
-				log.Err(err).Msg("error occurred when publishing announcement")
+			if !a.announceWithRetry() {
+				return
 			}
 		case <-a.done:
-			ticker.Stop()
 			return
 		}
 	}
 }
 
-// Observer represents the entity keeping track of announced consumers' addresses.
+// Observer represents the entity keeping track of announced consumers.
 type Observer struct {
 	nc        *nats.Conn
 	opts      *announcementsOptions
 	consumers *Consumers
+	drained   *Consumers
 	sub       *nats.Subscription
 }
 
@@ -145,20 +288,36 @@ func NewObserver(nc *nats.Conn, opts ...AnnouncementsOption) (*Observer, error)
 		nc:        nc,
 		opts:      options,
 		consumers: NewConsumers(WithTTL(options.period)),
+		drained:   NewConsumers(WithTTL(options.period)),
 	}
 	var err error
 	o.sub, err = o.nc.Subscribe(o.opts.subject, o.process)
 	if err != nil {
 		return nil, fmt.Errorf("cannot subscribe to announcements: %v", err)
 	}
+	// Ensure the subscription is registered by the server before any announcement is published.
+	if err = o.nc.Flush(); err != nil {
+		return nil, fmt.Errorf("cannot subscribe to announcements: %v", err)
+	}
 	return o, nil
 }
 
-// Consumers returns list of active consumers' addresses.
-func (o *Observer) Consumers() []string {
+// Consumers returns list of active consumers' announcements.
+func (o *Observer) Consumers() []Announcement {
 	return o.consumers.List()
 }
 
+// Announced tells whether the consumer with given ID and address is active or draining.
+// The draining consumers are not active anymore, but they may still give back their allowances.
+func (o *Observer) Announced(id string, address string) bool {
+	for _, ann := range append(o.consumers.List(), o.drained.List()...) {
+		if ann.Address == address && ann.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
 // Stop gracefully stops internal routines and cleans up resources.
 func (o *Observer) Stop() error {
 	if err := o.sub.Unsubscribe(); err != nil {
@@ -168,6 +327,35 @@ func (o *Observer) Stop() error {
 }
 
 // process implements communication protocol, encoding, and domain processing.
+// The draining consumers leave the set of active ones.
 func (o *Observer) process(msg *nats.Msg) {
-	o.consumers.Join(string(msg.Data))
+	ann, err := DecodeAnnouncement(msg.Data)
+	if err != nil {
+		log.Err(err).Msg("cannot decode announcement")
+		return
+	}
+	if ann.Draining {
+		o.consumers.Leave(ann.Address)
+		o.drained.Join(ann)
+		return
+	}
+	o.drained.Leave(ann.Address)
+	if o.consumers.Join(ann) && o.opts.onJoin != nil {
+		o.opts.onJoin(ann)
+	}
+}
+
+// DecodeAnnouncement decodes and validates the announcement message.
+func DecodeAnnouncement(data []byte) (Announcement, error) {
+	var ann Announcement
+	if err := json.Unmarshal(data, &ann); err != nil {
+		return Announcement{}, err
+	}
+	if ann.Address == "" {
+		return Announcement{}, fmt.Errorf("announcement has no address")
+	}
+	if ann.ID == "" {
+		ann.ID = ann.Address
+	}
+	return ann, nil
 }
@@ -1,6 +1,7 @@
 package dispatcher
 
 import (
+	"encoding/json"
 	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
 	"sort"
@@ -103,11 +104,11 @@ func TestNewAnnouncer(t *testing.T) {
 				assert.Equal(t, tt.want.subject, got.opts.subject)
 				assert.Equal(t, tt.want.period, got.opts.period)
 				assert.NotEmpty(t, got.address)
-				assert.NotEmpty(t, got.msg)
-				assert.Equal(t, got.address, string(got.msg))
+				assert.NotEmpty(t, got.opts.id)
 				assert.NotNil(t, got.done)
 				// Test methods.
 				assert.Equal(t, got.address, got.Address())
+				assert.Equal(t, got.opts.id, got.ID())
 				got.Stop()
 			}
 		})
@@ -122,7 +123,14 @@ func TestAnnounce(t *testing.T) {
 	testNC := MakeTestConnection(t)
 	defer testNC.Close()
 
-	a, err := NewAnnouncer(nc, WithPeriod(time.Hour))
+	a, err := NewAnnouncer(nc,
+		WithPeriod(time.Hour),
+		WithID("bidder-1"),
+		WithVersion("1.2.3"),
+		WithLabels(map[string]string{"region": "eu"}),
+		WithCapacity(1000),
+		WithLoad(func() float64 { return 250 }),
+	)
 	assert.NoError(t, err)
 	// Turn off automatic message sending
 	a.Stop()
@@ -134,10 +142,43 @@ func TestAnnounce(t *testing.T) {
 	_, _ = sub.NextMsg(2 * time.Millisecond)
 
 	err = a.announce()
-	msg, err := sub.NextMsg(2 * time.Millisecond)
 	assert.NoError(t, err)
-	// As for now the protocol is naively simple and the message does not change over time.
-	assert.Equal(t, a.msg, msg.Data)
+	msg, err := sub.NextMsg(100 * time.Millisecond)
+	assert.NoError(t, err)
+	var got Announcement
+	assert.NoError(t, json.Unmarshal(msg.Data, &got))
+	assert.Equal(t, "bidder-1", got.ID)
+	assert.Equal(t, a.Address(), got.Address)
+	assert.Equal(t, "1.2.3", got.Version)
+	assert.Equal(t, map[string]string{"region": "eu"}, got.Labels)
+	assert.Equal(t, int64(1000), got.Capacity)
+	assert.Equal(t, 250.0, got.Load)
+	assert.True(t, a.startedAt.Equal(got.StartedAt))
+}
+
+func TestDecodeAnnouncement(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    string
+		want    Announcement
+		wantErr bool
+	}{
+		{"full", `{"id":"alice","address":"inbox","capacity":10}`, Announcement{ID: "alice", Address: "inbox", Capacity: 10}, false},
+		{"missing id", `{"address":"inbox"}`, Announcement{ID: "inbox", Address: "inbox"}, false},
+		{"missing address", `{"id":"alice"}`, Announcement{}, true},
+		{"not json", `inbox`, Announcement{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeAnnouncement([]byte(tt.args))
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
 }
 
 func TestNewObserver(t *testing.T) {
@@ -207,14 +248,35 @@ func TestProcess(t *testing.T) {
 		assert.NoError(t, o.Stop())
 	}()
 
-	// As for now the protocol is naively simple and the message does not change over time.
-	err = testNC.Publish(o.opts.subject, []byte("test-address"))
+	err = testNC.Publish(o.opts.subject, EncodeTestAnnouncement(t, "test-address"))
 	assert.NoError(t, err)
 
-	// Delay
-	time.Sleep(2 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return len(o.Consumers()) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []Announcement{MakeTestAnnouncement("test-address")}, o.Consumers())
+}
+
+func TestProcessCallsJoinHandler(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+
+	joins := make(chan Announcement, 2)
+	o, err := NewObserver(nc, WithPeriod(time.Hour), WithJoinHandler(func(ann Announcement) {
+		joins <- ann
+	}))
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, o.Stop())
+	}()
 
-	assert.Equal(t, []string{"test-address"}, o.Consumers())
+	for _, address := range []string{"alice", "alice", "bob"} {
+		assert.NoError(t, nc.Publish(o.opts.subject, EncodeTestAnnouncement(t, address)))
+	}
+	assert.Equal(t, "alice", (<-joins).Address)
+	assert.Equal(t, "bob", (<-joins).Address)
 }
 
 func TestIntegrationBetweenAnnouncersAndObserver(t *testing.T) {
@@ -225,8 +287,15 @@ func TestIntegrationBetweenAnnouncersAndObserver(t *testing.T) {
 	srv := RunTestServer()
 	defer srv.Shutdown()
 
+	// consumers returns sorted addresses of consumers observed by alice.
+	consumers := func() []string {
+		got := Addresses(alice.Consumers())
+		sort.Strings(got)
+		return got
+	}
+
 	// The period in observer is set twice as large as in announcer to avoid expiration bouncing.
-	if alice, err = NewObserver(MakeTestConnection(t), WithPeriod(2*time.Millisecond)); err != nil {
+	if alice, err = NewObserver(MakeTestConnection(t), WithPeriod(20*time.Millisecond)); err != nil {
 		t.Fatalf("cannot create observer: %v", err)
 	}
 	defer func() {
@@ -235,9 +304,9 @@ func TestIntegrationBetweenAnnouncersAndObserver(t *testing.T) {
 		}
 	}()
 
-	assert.Equal(t, []string{}, alice.Consumers())
+	assert.Equal(t, []string{}, consumers())
 
-	if bob, err = NewAnnouncer(MakeTestConnection(t), WithPeriod(time.Millisecond)); err != nil {
+	if bob, err = NewAnnouncer(MakeTestConnection(t), WithPeriod(10*time.Millisecond)); err != nil {
 		t.Fatalf("cannot create announcer: %v", err)
 	}
 	bobRunning := true
@@ -248,12 +317,11 @@ func TestIntegrationBetweenAnnouncersAndObserver(t *testing.T) {
 		bob.Stop()
 	}()
 
-	// Delay
-	time.Sleep(time.Millisecond)
-
-	assert.Equal(t, []string{bob.Address()}, alice.Consumers())
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{bob.Address()}, consumers())
+	}, time.Second, time.Millisecond)
 
-	if charlie, err = NewAnnouncer(MakeTestConnection(t), WithPeriod(time.Millisecond)); err != nil {
+	if charlie, err = NewAnnouncer(MakeTestConnection(t), WithPeriod(10*time.Millisecond)); err != nil {
 		t.Fatalf("cannot create announcer: %v", err)
 	}
 	charlieRunning := true
@@ -264,29 +332,52 @@ func TestIntegrationBetweenAnnouncersAndObserver(t *testing.T) {
 		charlie.Stop()
 	}()
 
-	// Delay
-	time.Sleep(time.Millisecond)
-
 	want := []string{bob.Address(), charlie.Address()}
 	sort.Strings(want)
-	got := alice.Consumers()
-	sort.Strings(got)
-
-	assert.Equal(t, want, got)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(want, consumers())
+	}, time.Second, time.Millisecond)
 
 	charlie.Stop()
 	charlieRunning = false
 
-	// Delay + expiration period
-	time.Sleep(3 * time.Millisecond)
-
-	assert.Equal(t, []string{bob.Address()}, alice.Consumers())
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{bob.Address()}, consumers())
+	}, time.Second, time.Millisecond)
 
 	bob.Stop()
 	bobRunning = false
 
-	// Delay + expiration period
-	time.Sleep(3 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{}, consumers())
+	}, time.Second, time.Millisecond)
+}
+
+func TestProcessDropsDrainingConsumer(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	nc := MakeTestConnection(t)
+	defer nc.Close()
 
-	assert.Equal(t, []string{}, alice.Consumers())
+	o, err := NewObserver(nc, WithPeriod(time.Hour))
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, o.Stop())
+	}()
+	a, err := NewAnnouncer(nc, WithPeriod(time.Hour))
+	assert.NoError(t, err)
+	defer a.Stop()
+	assert.Eventually(t, func() bool {
+		return len(o.Consumers()) == 1
+	}, time.Second, time.Millisecond)
+
+	assert.NoError(t, a.Drain())
+	assert.True(t, a.Announcement().Draining)
+	assert.Eventually(t, func() bool {
+		return len(o.Consumers()) == 0
+	}, time.Second, time.Millisecond)
+
+	// The draining consumer is still known by its ID, unlike anyone else using its address.
+	assert.True(t, o.Announced(a.ID(), a.Address()))
+	assert.False(t, o.Announced("mallory", a.Address()))
 }
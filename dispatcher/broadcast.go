@@ -0,0 +1,117 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// DefaultBroadcastSubject is the NATS subject used for workloads published to all consumers at once.
+const DefaultBroadcastSubject = "workloads"
+
+// Shares are the allowances of line items together with the weights of consumers sharing them.
+// Every consumer computes its own allowances from the shares, see Share.
+type Shares struct {
+	// Allowances are the budgets of line items to split among all consumers.
+	Allowances Allowances `json:"allowances"`
+	// Weights are keyed by consumer address, consumers without positive weight get nothing.
+	Weights map[string]float64 `json:"weights"`
+}
+
+// SharesCallback computes the shares of active consumers for the broadcast mode.
+type SharesCallback func(consumers []Announcement) Shares
+
+// Share returns the allowances of the consumer with given address, it returns false if the consumer has no weight.
+// The consumers are lined up by address and every one of them gets the part of the allowance between
+// its cumulative weights, so the shares differ from the exact quota by less than a unit
+// and sum up exactly to the allowance, while every consumer computes only its own share.
+func (s Shares) Share(address string) (Allowances, bool) {
+	lo, hi, sum, ok := s.bounds(address)
+	if !ok {
+		return nil, false
+	}
+	res := Allowances{}
+	for id, total := range s.Allowances {
+		if share := cut(total, hi, sum) - cut(total, lo, sum); share > 0 {
+			res[id] = share
+		}
+	}
+	return res, true
+}
+
+// bounds returns the cumulative weights of consumers before and including given one, and the sum of all weights.
+func (s Shares) bounds(address string) (lo float64, hi float64, sum float64, ok bool) {
+	if s.Weights[address] <= 0 {
+		return 0, 0, 0, false
+	}
+	addresses := make([]string, 0, len(s.Weights))
+	for a, w := range s.Weights {
+		if w > 0 {
+			addresses = append(addresses, a)
+		}
+	}
+	sort.Strings(addresses)
+	for _, a := range addresses {
+		if a == address {
+			lo = sum
+		}
+		sum += s.Weights[a]
+		if a == address {
+			hi = sum
+		}
+	}
+	return lo, hi, sum, true
+}
+
+// cut returns the part of the total up to given cumulative weight.
+func cut(total int64, cumulative float64, sum float64) int64 {
+	if total <= 0 {
+		return 0
+	}
+	if cumulative >= sum {
+		return total
+	}
+	return int64(math.Floor(float64(total) * cumulative / sum))
+}
+
+// Broadcast is the message published by Dispatcher to all consumers at once in the broadcast mode.
+type Broadcast struct {
+	// Source identifies the dispatcher which sent the workload, it is empty when dispatchers are not sharded.
+	Source string `json:"source,omitempty"`
+	// Lease is the time until the allowances are valid.
+	Lease time.Time `json:"lease"`
+	// Round numbers the dispatch rounds of the source.
+	Round uint64 `json:"round,omitempty"`
+	// Reclaim is the subject the consumers send adjustments of their allowances to.
+	Reclaim string `json:"reclaim,omitempty"`
+	Shares
+}
+
+// Workload returns the workload of the consumer with given address, it returns false if the consumer has no weight.
+func (b Broadcast) Workload(address string) (Workload, bool) {
+	a, ok := b.Share(address)
+	if !ok {
+		return Workload{}, false
+	}
+	return Workload{Source: b.Source, Lease: b.Lease, Allowances: a, Round: b.Round, Reclaim: b.Reclaim}, true
+}
+
+// DecodeBroadcast decodes and validates the broadcast message.
+func DecodeBroadcast(data []byte) (Broadcast, error) {
+	var b Broadcast
+	if err := json.Unmarshal(data, &b); err != nil {
+		return Broadcast{}, err
+	}
+	if b.Lease.IsZero() {
+		return Broadcast{}, fmt.Errorf("broadcast has no lease")
+	}
+	if b.Allowances == nil {
+		b.Allowances = Allowances{}
+	}
+	if b.Weights == nil {
+		b.Weights = map[string]float64{}
+	}
+	return b, nil
+}
@@ -0,0 +1,197 @@
+package dispatcher
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSharesShare(t *testing.T) {
+	alice, bob := MakeTestLineItem("alice"), MakeTestLineItem("bob")
+	shares := Shares{
+		Allowances: Allowances{alice: 10, bob: 1},
+		Weights:    map[string]float64{"consumer-1": 1, "consumer-2": 1, "consumer-3": 2, "consumer-4": 0},
+	}
+	tests := []struct {
+		name    string
+		address string
+		want    Allowances
+		wantOk  bool
+	}{
+		{"first", "consumer-1", Allowances{alice: 2}, true},
+		{"second", "consumer-2", Allowances{alice: 3}, true},
+		{"last", "consumer-3", Allowances{alice: 5, bob: 1}, true},
+		{"zero weight", "consumer-4", nil, false},
+		{"unknown", "consumer-5", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := shares.Share(tt.address)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSharesSumUpToAllowance(t *testing.T) {
+	weights := map[string]float64{}
+	for i := 0; i < 7; i++ {
+		weights[fmt.Sprintf("consumer-%d", i)] = float64(i%3) + 0.3
+	}
+	var sum float64
+	for _, w := range weights {
+		sum += w
+	}
+	lineItem := MakeTestLineItem("line-item")
+	for _, total := range []int64{0, 1, 6, 7, 100, 1_000_003} {
+		shares := Shares{Allowances: Allowances{lineItem: total}, Weights: weights}
+		var got int64
+		for address, w := range weights {
+			a, ok := shares.Share(address)
+			assert.True(t, ok)
+			// Every share differs from the exact quota by less than a unit.
+			assert.InDelta(t, float64(total)*w/sum, float64(a[lineItem]), 1)
+			got += a[lineItem]
+		}
+		assert.Equal(t, total, got)
+	}
+}
+
+func TestDecodeBroadcast(t *testing.T) {
+	lease := time.Date(2023, 2, 17, 0, 0, 0, 0, time.UTC)
+	got, err := DecodeBroadcast([]byte(`{"lease":"2023-02-17T00:00:00Z","round":3}`))
+	assert.NoError(t, err)
+	assert.Equal(t, Broadcast{Lease: lease, Round: 3, Shares: Shares{Allowances: Allowances{}, Weights: map[string]float64{}}}, got)
+
+	_, err = DecodeBroadcast([]byte(`{"round":3}`))
+	assert.Error(t, err)
+	_, err = DecodeBroadcast([]byte(`invalid`))
+	assert.Error(t, err)
+}
+
+func TestBroadcastDispatch(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	lineItem := MakeTestLineItem("line-item")
+
+	_, err := NewBroadcastDispatcher(nil)
+	assert.Error(t, err)
+
+	// Every consumer weights as much as its announced capacity.
+	dispatcher, _ := NewBroadcastDispatcher(func(consumers []Announcement) Shares {
+		weights := make(map[string]float64, len(consumers))
+		for _, c := range consumers {
+			weights[c.Address] = float64(c.Capacity)
+		}
+		return Shares{Allowances: Allowances{lineItem: 10}, Weights: weights}
+	}, WithDispatchPeriod(time.Hour), WithJoinReserve(0), WithMissedRounds(SkipMissedRounds))
+	dispatcher.trigger = make(chan struct{})
+	assert.Nil(t, dispatcher.Run())
+	defer dispatcher.Shutdown()
+
+	ws := new(workloads)
+	r1, _ := NewReceiver(collect(ws), WithAnnouncerOptions(WithCapacity(1)))
+	assert.Nil(t, r1.Run())
+	defer func() { _ = r1.Shutdown() }()
+	r2, _ := NewReceiver(nop, WithAnnouncerOptions(WithCapacity(4)))
+	assert.Nil(t, r2.Run())
+	defer func() { _ = r2.Shutdown() }()
+
+	assert.Eventually(t, func() bool { return len(dispatcher.Consumers()) == 2 }, time.Second, Delay)
+	dispatcher.trigger <- struct{}{}
+	assert.Eventually(t, func() bool {
+		return r1.Available(lineItem)+r2.Available(lineItem) == 10
+	}, time.Second, Delay)
+	assert.InDelta(t, 2, r1.Available(lineItem), 1)
+	assert.InDelta(t, 8, r2.Available(lineItem), 1)
+
+	// The consume callback gets the receiver's own workload.
+	w, err := DecodeWorkload([]byte(ws.get(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, r1.Allowances(), w.Allowances)
+
+	// The allowances computed by receivers can be adjusted.
+	returned, err := r1.Return(lineItem, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), returned)
+	granted, err := r2.TopUp(lineItem, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), granted)
+	assert.Equal(t, int64(10), r1.Available(lineItem)+r2.Available(lineItem))
+}
+
+// makeBenchmarkDispatcher creates the dispatcher with given number of consumers, which does not publish anything.
+// The number of published bytes is reported per round.
+func makeBenchmarkDispatcher(consumers int, broadcast bool, lineItems int) (*Dispatcher, *int) {
+	allowances := make(Allowances, lineItems)
+	for i := 0; i < lineItems; i++ {
+		allowances[uuid.New()] = 1_000_000
+	}
+	scb := func(consumers []Announcement) Shares {
+		weights := make(map[string]float64, len(consumers))
+		for _, c := range consumers {
+			weights[c.Address] = 1
+		}
+		return Shares{Allowances: allowances, Weights: weights}
+	}
+	wcb := func(consumers []Announcement) map[string]Allowances {
+		shares := scb(consumers)
+		res := make(map[string]Allowances, len(consumers))
+		for _, c := range consumers {
+			res[c.Address], _ = shares.Share(c.Address)
+		}
+		return res
+	}
+	d := newDispatcher()
+	if broadcast {
+		d.scb = scb
+	} else {
+		d.wcb = wcb
+	}
+	d.observer = &Observer{consumers: NewConsumers(WithTTL(time.Hour))}
+	for i := 0; i < consumers; i++ {
+		d.observer.consumers.Join(MakeTestAnnouncement(fmt.Sprintf("_INBOX.consumer-%d", i)))
+	}
+	published := new(int)
+	d.publish = func(_ string, data []byte) error {
+		*published += len(data)
+		return nil
+	}
+	return d, published
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	for _, consumers := range []int{100, 1000} {
+		for _, broadcast := range []bool{false, true} {
+			mode := "unicast"
+			if broadcast {
+				mode = "broadcast"
+			}
+			b.Run(fmt.Sprintf("%s/consumers=%d", mode, consumers), func(b *testing.B) {
+				d, published := makeBenchmarkDispatcher(consumers, broadcast, 100)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					d.dispatch(time.Time{})
+				}
+				b.ReportMetric(float64(*published)/float64(b.N), "published-B/op")
+			})
+		}
+	}
+}
+
+func BenchmarkBroadcastWorkload(b *testing.B) {
+	for _, consumers := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("consumers=%d", consumers), func(b *testing.B) {
+			d, _ := makeBenchmarkDispatcher(consumers, true, 100)
+			broadcast := d.broadcast(d.scb(d.observer.Consumers()))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				broadcast.Workload("_INBOX.consumer-0")
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package dispatcher
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"os"
+)
+
+// WithTLSConfig configures the TLS configuration used to connect to the NATS server.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(opts *options) {
+		opts.natsOpts = append(opts.natsOpts, nats.Secure(cfg))
+	}
+}
+
+// WithRootCAs configures the CA certificates (PEM files) used to verify the NATS server.
+func WithRootCAs(files ...string) Option {
+	return func(opts *options) {
+		opts.natsOpts = append(opts.natsOpts, nats.RootCAs(files...))
+	}
+}
+
+// WithClientCert configures the client certificate and key (PEM files) used for mutual TLS.
+func WithClientCert(certFile, keyFile string) Option {
+	return func(opts *options) {
+		opts.natsOpts = append(opts.natsOpts, nats.ClientCert(certFile, keyFile))
+	}
+}
+
+// WithUserInfo configures the user and password used to authenticate to the NATS server.
+func WithUserInfo(user, password string) Option {
+	return func(opts *options) {
+		opts.natsOpts = append(opts.natsOpts, nats.UserInfo(user, password))
+	}
+}
+
+// WithToken configures the token used to authenticate to the NATS server.
+func WithToken(token string) Option {
+	return func(opts *options) {
+		opts.natsOpts = append(opts.natsOpts, nats.Token(token))
+	}
+}
+
+// WithCredentials configures the .creds file (user JWT and NKey seed) used to authenticate to the NATS server.
+func WithCredentials(file string) Option {
+	return func(opts *options) {
+		opts.natsOpts = append(opts.natsOpts, nats.UserCredentials(file))
+	}
+}
+
+// WithNkeySeed configures the NKey seed file used to authenticate to the NATS server.
+// The file is read when connecting.
+func WithNkeySeed(seedFile string) Option {
+	return func(opts *options) {
+		opts.nkeySeed = seedFile
+	}
+}
+
+// WithNATSOptions configures any other NATS connection options.
+// They are applied after the options above, so they take precedence, e.g. they may replace the logging handlers.
+func WithNATSOptions(natsOpts ...nats.Option) Option {
+	return func(opts *options) {
+		opts.natsOpts = append(opts.natsOpts, natsOpts...)
+	}
+}
+
+// Environment variables read by EnvOptions.
+const (
+	EnvURL         = "NATS_URL"
+	EnvUser        = "NATS_USER"
+	EnvPassword    = "NATS_PASSWORD"
+	EnvToken       = "NATS_TOKEN"
+	EnvCredentials = "NATS_CREDS"
+	EnvNkeySeed    = "NATS_NKEY_SEED"
+	EnvRootCAs     = "NATS_TLS_CA"
+	EnvClientCert  = "NATS_TLS_CERT"
+	EnvClientKey   = "NATS_TLS_KEY"
+)
+
+// EnvOptions creates connection options from environment variables, unset variables are ignored.
+func EnvOptions() []Option {
+	var opts []Option
+	if url := os.Getenv(EnvURL); url != "" {
+		opts = append(opts, WithURL(url))
+	}
+	if user := os.Getenv(EnvUser); user != "" {
+		opts = append(opts, WithUserInfo(user, os.Getenv(EnvPassword)))
+	}
+	if token := os.Getenv(EnvToken); token != "" {
+		opts = append(opts, WithToken(token))
+	}
+	if creds := os.Getenv(EnvCredentials); creds != "" {
+		opts = append(opts, WithCredentials(creds))
+	}
+	if seed := os.Getenv(EnvNkeySeed); seed != "" {
+		opts = append(opts, WithNkeySeed(seed))
+	}
+	if ca := os.Getenv(EnvRootCAs); ca != "" {
+		opts = append(opts, WithRootCAs(ca))
+	}
+	if cert, key := os.Getenv(EnvClientCert), os.Getenv(EnvClientKey); cert != "" && key != "" {
+		opts = append(opts, WithClientCert(cert, key))
+	}
+	return opts
+}
+
+// natsOptions returns NATS connection options, the logging handlers go first.
+func (opts *options) natsOptions() ([]nats.Option, error) {
+	natsOpts := []nats.Option{
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			log.Warn().Err(err).Msg("(nats) disconnected")
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Info().Msg(fmt.Sprintf("(nats) reconnected to %s", nc.ConnectedUrl()))
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			log.Debug().Msg("(nats) connection closed")
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			if sub != nil {
+				log.Err(err).Msg(fmt.Sprintf("(nats) error on subscription: %s", sub.Subject))
+				return
+			}
+			log.Err(err).Msg("(nats) error")
+		}),
+	}
+	if opts.nkeySeed != "" {
+		nkey, err := nats.NkeyOptionFromSeed(opts.nkeySeed)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load NKey seed: %v", err)
+		}
+		natsOpts = append(natsOpts, nkey)
+	}
+	return append(natsOpts, opts.natsOpts...), nil
+}
+
+// connect returns the configured connection or creates a new one.
+// The second returned value tells whether the connection is owned by the caller of connect.
+func (opts *options) connect() (*nats.Conn, bool, error) {
+	if opts.conn != nil {
+		if !opts.conn.IsConnected() {
+			return nil, false, fmt.Errorf("NATS connection has invalid state: %v", opts.conn.Status())
+		}
+		return opts.conn, false, nil
+	}
+	natsOpts, err := opts.natsOptions()
+	if err != nil {
+		return nil, false, err
+	}
+	nc, err := nats.Connect(opts.url, natsOpts...)
+	if err != nil {
+		return nil, false, err
+	}
+	if !nc.IsConnected() {
+		nc.Close()
+		return nil, false, fmt.Errorf("cannot connect, connection status is %s", nc.Status())
+	}
+	return nc, true, nil
+}
@@ -0,0 +1,256 @@
+package dispatcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPKI holds paths of PEM files of a test CA, server and client certificates.
+type testPKI struct {
+	ca, serverCert, serverKey, clientCert, clientKey string
+}
+
+// writePEM writes a single PEM block to a file in dir.
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatalf("Cannot write %s: %v", name, err)
+	}
+	return path
+}
+
+// issue creates a key and a certificate signed by the parent (or self-signed if parent is nil).
+func issue(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %v", err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Cannot create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Cannot parse certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Cannot encode key: %v", err)
+	}
+	return cert, key, der, keyDer
+}
+
+// MakeTestPKI creates a CA with server (localhost) and client certificates in a temporary directory.
+func MakeTestPKI(t *testing.T) testPKI {
+	dir := t.TempDir()
+	notBefore, notAfter := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	ca, caKey, caDer, _ := issue(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	_, _, srvDer, srvKey := issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}, ca, caKey)
+	_, _, cliDer, cliKey := issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "test-client"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	return testPKI{
+		ca:         writePEM(t, dir, "ca.pem", "CERTIFICATE", caDer),
+		serverCert: writePEM(t, dir, "server.pem", "CERTIFICATE", srvDer),
+		serverKey:  writePEM(t, dir, "server-key.pem", "EC PRIVATE KEY", srvKey),
+		clientCert: writePEM(t, dir, "client.pem", "CERTIFICATE", cliDer),
+		clientKey:  writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", cliKey),
+	}
+}
+
+// RunTestServerWithOptions runs test server on random port with options modified by configure.
+func RunTestServerWithOptions(t *testing.T, configure func(opts *server.Options)) *server.Server {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	configure(&opts)
+	return natsserver.RunServer(&opts)
+}
+
+// RunTestTLSServer runs test server with TLS enabled, client certificates are required if verify is set.
+func RunTestTLSServer(t *testing.T, pki testPKI, verify bool) *server.Server {
+	cfg, err := server.GenTLSConfig(&server.TLSConfigOpts{
+		CertFile: pki.serverCert,
+		KeyFile:  pki.serverKey,
+		CaFile:   pki.ca,
+		Verify:   verify,
+	})
+	if err != nil {
+		t.Fatalf("Cannot configure TLS: %v", err)
+	}
+	return RunTestServerWithOptions(t, func(opts *server.Options) {
+		opts.TLSConfig = cfg
+		opts.TLSVerify = verify
+		opts.TLSTimeout = 2
+	})
+}
+
+// assertConnects asserts whether connecting with given options succeeds.
+func assertConnects(t *testing.T, want bool, opts ...Option) {
+	nc, owned, err := newOptions(opts...).connect()
+	if !want {
+		assert.Error(t, err)
+		return
+	}
+	if assert.NoError(t, err) {
+		assert.True(t, owned)
+		assert.True(t, nc.IsConnected())
+		nc.Close()
+	}
+}
+
+func TestConnectTLS(t *testing.T) {
+	pki := MakeTestPKI(t)
+	srv := RunTestTLSServer(t, pki, false)
+	defer srv.Shutdown()
+	url := srv.ClientURL()
+
+	t.Run("without CA", func(t *testing.T) {
+		assertConnects(t, false, WithURL(url))
+	})
+	t.Run("with CA", func(t *testing.T) {
+		assertConnects(t, true, WithURL(url), WithRootCAs(pki.ca))
+	})
+}
+
+func TestConnectMutualTLS(t *testing.T) {
+	pki := MakeTestPKI(t)
+	srv := RunTestTLSServer(t, pki, true)
+	defer srv.Shutdown()
+	url := srv.ClientURL()
+
+	t.Run("without client certificate", func(t *testing.T) {
+		assertConnects(t, false, WithURL(url), WithRootCAs(pki.ca))
+	})
+	t.Run("with client certificate", func(t *testing.T) {
+		assertConnects(t, true, WithURL(url), WithRootCAs(pki.ca), WithClientCert(pki.clientCert, pki.clientKey))
+	})
+}
+
+func TestConnectUserInfo(t *testing.T) {
+	srv := RunTestServerWithOptions(t, func(opts *server.Options) {
+		opts.Username = "alice"
+		opts.Password = "secret"
+	})
+	defer srv.Shutdown()
+	url := srv.ClientURL()
+
+	assertConnects(t, false, WithURL(url))
+	assertConnects(t, false, WithURL(url), WithUserInfo("alice", "wrong"))
+	assertConnects(t, true, WithURL(url), WithUserInfo("alice", "secret"))
+}
+
+func TestConnectToken(t *testing.T) {
+	srv := RunTestServerWithOptions(t, func(opts *server.Options) {
+		opts.Authorization = "test-token"
+	})
+	defer srv.Shutdown()
+	url := srv.ClientURL()
+
+	assertConnects(t, false, WithURL(url))
+	assertConnects(t, false, WithURL(url), WithToken("wrong"))
+	assertConnects(t, true, WithURL(url), WithToken("test-token"))
+}
+
+func TestConnectNkey(t *testing.T) {
+	user, err := nkeys.CreateUser()
+	assert.NoError(t, err)
+	public, err := user.PublicKey()
+	assert.NoError(t, err)
+	seed, err := user.Seed()
+	assert.NoError(t, err)
+	seedFile := filepath.Join(t.TempDir(), "user.nk")
+	assert.NoError(t, os.WriteFile(seedFile, seed, 0600))
+
+	srv := RunTestServerWithOptions(t, func(opts *server.Options) {
+		opts.Nkeys = []*server.NkeyUser{{Nkey: public}}
+	})
+	defer srv.Shutdown()
+	url := srv.ClientURL()
+
+	assertConnects(t, false, WithURL(url))
+	assertConnects(t, false, WithURL(url), WithNkeySeed(filepath.Join(t.TempDir(), "missing.nk")))
+	assertConnects(t, true, WithURL(url), WithNkeySeed(seedFile))
+}
+
+func TestConnectCredentialsMissingFile(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+
+	assertConnects(t, false, WithCredentials(filepath.Join(t.TempDir(), "missing.creds")))
+}
+
+func TestEnvOptions(t *testing.T) {
+	pki := MakeTestPKI(t)
+	srv := RunTestTLSServer(t, pki, true)
+	defer srv.Shutdown()
+
+	t.Setenv(EnvURL, srv.ClientURL())
+	t.Setenv(EnvRootCAs, pki.ca)
+	t.Setenv(EnvClientCert, pki.clientCert)
+	t.Setenv(EnvClientKey, pki.clientKey)
+
+	assertConnects(t, true, EnvOptions()...)
+}
+
+func TestDispatcherAndReceiverOverMutualTLS(t *testing.T) {
+	pki := MakeTestPKI(t)
+	srv := RunTestTLSServer(t, pki, true)
+	defer srv.Shutdown()
+	secure := []Option{WithURL(srv.ClientURL()), WithRootCAs(pki.ca), WithClientCert(pki.clientCert, pki.clientKey)}
+
+	dispatcher, err := NewDispatcher(ConsumerNameCallback, secure...)
+	assert.NoError(t, err)
+	assert.NoError(t, dispatcher.Run())
+	defer dispatcher.Shutdown()
+
+	receiver, err := NewReceiver(nop, secure...)
+	assert.NoError(t, err)
+	assert.NoError(t, receiver.Run())
+	defer func() {
+		assert.NoError(t, receiver.Shutdown())
+	}()
+
+	assert.Eventually(t, func() bool {
+		consumers := dispatcher.Consumers()
+		return len(consumers) == 1 && consumers[0].Address == receiver.Address()
+	}, time.Second, time.Millisecond)
+}
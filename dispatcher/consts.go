@@ -7,3 +7,15 @@ const DefaultAnnouncements = "announcements"
 const DefaultDispatcherPeriod = 1 * time.Minute
 
 const DefaultAnnouncementPeriod = time.Second
+
+// DefaultConsumerTTL tolerates a couple of lost announcements before the consumer is dropped.
+const DefaultConsumerTTL = 3 * DefaultAnnouncementPeriod
+
+// DefaultRequestTimeout limits how long Receiver waits for the reply to a request sent to Dispatcher.
+const DefaultRequestTimeout = time.Second
+
+// DefaultRedeliveries is how many times Receiver requests the redelivery of the workload its handler has failed on.
+const DefaultRedeliveries = 2
+
+// DefaultJoinReserve is the fraction of every allowance Dispatcher keeps for consumers joining in the middle of a round.
+const DefaultJoinReserve = 0.1
@@ -23,12 +23,18 @@ func WithTTL(ttl time.Duration) ConsumerOption {
 	}
 }
 
-// Consumers represents a set of expiring cons.
+// consumer is the last announcement of a consumer together with its expiration time.
+type consumer struct {
+	ann     Announcement
+	expires time.Time
+}
+
+// Consumers represents a set of expiring cons, keyed by address.
 type Consumers struct {
 	opts   *consumerOptions
 	mu     sync.Mutex
 	now    func() time.Time
-	ttlSet map[string]time.Time
+	ttlSet map[string]consumer
 }
 
 // NewConsumers creates an empty Consumers instance.
@@ -48,36 +54,49 @@ func NewConsumers(opts ...ConsumerOption) *Consumers {
 		opts:   configured,
 		mu:     sync.Mutex{},
 		now:    time.Now,
-		ttlSet: make(map[string]time.Time, 10),
+		ttlSet: make(map[string]consumer, 10),
 	}
 }
 
-// Join adds given consumer to the set.
-func (cs *Consumers) Join(consumer string) {
+// Join adds given consumer to the set or refreshes its announcement.
+// It returns true if the consumer is new, i.e. it was not in the set or has expired.
+func (cs *Consumers) Join(ann Announcement) bool {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	cs.ttlSet[consumer] = cs.now().Add(cs.opts.ttl)
+	now := cs.now()
+	prev, ok := cs.ttlSet[ann.Address]
+	cs.ttlSet[ann.Address] = consumer{ann: ann, expires: now.Add(cs.opts.ttl)}
+	return !ok || !prev.expires.After(now)
 }
 
-// Leave removes given consumer from the set.
-func (cs *Consumers) Leave(consumer string) {
+// Leave removes consumer with given address from the set.
+func (cs *Consumers) Leave(address string) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	delete(cs.ttlSet, consumer)
+	delete(cs.ttlSet, address)
 }
 
-// List returns not expired cons.
-func (cs *Consumers) List() []string {
+// List returns announcements of not expired cons.
+func (cs *Consumers) List() []Announcement {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 	now := cs.now()
-	consumers := make([]string, 0, len(cs.ttlSet))
-	for con, ttl := range cs.ttlSet {
-		if ttl.After(now) {
-			consumers = append(consumers, con)
+	consumers := make([]Announcement, 0, len(cs.ttlSet))
+	for address, con := range cs.ttlSet {
+		if con.expires.After(now) {
+			consumers = append(consumers, con.ann)
 		} else {
-			delete(cs.ttlSet, con)
+			delete(cs.ttlSet, address)
 		}
 	}
 	return consumers
 }
+
+// Addresses returns addresses of given announcements.
+func Addresses(anns []Announcement) []string {
+	res := make([]string, len(anns))
+	for i, ann := range anns {
+		res[i] = ann.Address
+	}
+	return res
+}
@@ -28,9 +28,9 @@ func TestConsumers_Join(t *testing.T) {
 			// Ensure test is not affected by expiring cons
 			cs := NewConsumers(WithTTL(time.Hour))
 			for _, con := range tt.args {
-				cs.Join(con)
+				cs.Join(MakeTestAnnouncement(con))
 			}
-			got := cs.List()
+			got := Addresses(cs.List())
 			sort.Strings(got)
 			assert.Equal(t, tt.want, got)
 		})
@@ -56,12 +56,12 @@ func TestConsumers_Leave(t *testing.T) {
 			// Ensure test is not affected by expiring cons
 			cs := NewConsumers(WithTTL(time.Hour))
 			for _, con := range tt.args.current {
-				cs.Join(con)
+				cs.Join(MakeTestAnnouncement(con))
 			}
 			for _, con := range tt.args.leaving {
 				cs.Leave(con)
 			}
-			got := cs.List()
+			got := Addresses(cs.List())
 			sort.Strings(got)
 			assert.Equal(t, tt.want, got)
 		})
@@ -85,3 +85,32 @@ func TestWithTTL(t *testing.T) {
 		})
 	}
 }
+
+func TestConsumers_JoinKeepsLatestAnnouncement(t *testing.T) {
+	cs := NewConsumers(WithTTL(time.Hour))
+	cs.Join(Announcement{ID: "alice", Address: "inbox", Capacity: 100})
+	cs.Join(Announcement{ID: "alice", Address: "inbox", Capacity: 100, Load: 42})
+	assert.Equal(t, []Announcement{{ID: "alice", Address: "inbox", Capacity: 100, Load: 42}}, cs.List())
+}
+
+func TestConsumers_JoinTellsNewConsumers(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+	cs := NewConsumers(WithTTL(time.Second))
+	cs.now = func() time.Time { return now }
+	assert.True(t, cs.Join(MakeTestAnnouncement("alice")))
+	assert.False(t, cs.Join(MakeTestAnnouncement("alice")))
+	// The consumer joins again after it has expired.
+	now = now.Add(time.Second)
+	assert.True(t, cs.Join(MakeTestAnnouncement("alice")))
+}
+
+func TestConsumers_ListSkipsExpired(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+	cs := NewConsumers(WithTTL(time.Second))
+	cs.now = func() time.Time { return now }
+	cs.Join(MakeTestAnnouncement("alice"))
+	now = now.Add(500 * time.Millisecond)
+	cs.Join(MakeTestAnnouncement("bob"))
+	now = now.Add(600 * time.Millisecond)
+	assert.Equal(t, []string{"bob"}, Addresses(cs.List()))
+}
@@ -0,0 +1,69 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// sent is the allowances sent to a consumer in the round, the base of the delta sent in the next round.
+type sent struct {
+	round      uint64
+	allowances Allowances
+}
+
+// delta creates the workload of the current round for the consumer and records it as sent.
+// The workload is the delta relative to the previous round if deltas are enabled, the consumer got the previous
+// round, and the delta is smaller than the full workload.
+func (d *Dispatcher) delta(prev map[string]sent, consumer string, a Allowances) Workload {
+	d.sent[consumer] = sent{round: d.round, allowances: a}
+	w := d.workload(a)
+	base, ok := prev[consumer]
+	if !d.opts.deltas || !ok || base.round != d.round-1 {
+		return w
+	}
+	delta := Allowances{}
+	for id, amount := range a {
+		if old, ok := base.allowances[id]; !ok || old != amount {
+			delta[id] = amount
+		}
+	}
+	var removed []uuid.UUID
+	for id := range base.allowances {
+		if _, ok := a[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	if len(delta)+len(removed) >= len(a) {
+		return w
+	}
+	w.Allowances, w.Base, w.Removed = delta, base.round, removed
+	return w
+}
+
+// resyncSubject returns the subject the dispatcher serves full workloads on.
+func (d *Dispatcher) resyncSubject() string {
+	if d.resync == nil {
+		return ""
+	}
+	return d.resync.Subject
+}
+
+// sync replies with the full workload of the current round to the consumer which has missed a round.
+func (d *Dispatcher) sync(msg *nats.Msg) {
+	var req SyncRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		d.budget.policy.onError(fmt.Errorf("cannot decode sync request: %w", err))
+		return
+	}
+	// The consumer without allowances in the round gets an empty workload, the allowances come when it joins
+	w, _ := d.pool.current(req.Consumer)
+	enc, err := json.Marshal(w)
+	if err == nil {
+		err = msg.Respond(enc)
+	}
+	if err != nil {
+		d.budget.policy.onError(fmt.Errorf("cannot reply to sync request of consumer %s: %w", req.Consumer, err))
+	}
+}
@@ -0,0 +1,110 @@
+package dispatcher
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcherDelta(t *testing.T) {
+	alice, bob, charlie, dave := MakeTestLineItem("alice"), MakeTestLineItem("bob"), MakeTestLineItem("charlie"), MakeTestLineItem("dave")
+	base := Allowances{alice: 1, bob: 2, charlie: 3, dave: 4}
+	tests := []struct {
+		name   string
+		deltas bool
+		prev   map[string]sent
+		arg    Allowances
+		want   Workload
+	}{
+		{"first round", true, nil, base, Workload{Round: 2, Allowances: base}},
+		{"deltas disabled", false, map[string]sent{"consumer": {1, base}}, base, Workload{Round: 2, Allowances: base}},
+		{"unchanged", true, map[string]sent{"consumer": {1, base}}, base,
+			Workload{Round: 2, Base: 1, Allowances: Allowances{}}},
+		{"changed and removed", true, map[string]sent{"consumer": {1, base}}, Allowances{alice: 1, bob: 2, charlie: 30},
+			Workload{Round: 2, Base: 1, Allowances: Allowances{charlie: 30}, Removed: []uuid.UUID{dave}}},
+		{"delta is not smaller", true, map[string]sent{"consumer": {1, base}}, Allowances{alice: 10},
+			Workload{Round: 2, Allowances: Allowances{alice: 10}}},
+		{"missed round", true, map[string]sent{"consumer": {0, base}}, base, Workload{Round: 2, Allowances: base}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{}
+			if tt.deltas {
+				opts = append(opts, WithDeltaWorkloads())
+			}
+			d := newDispatcher(opts...)
+			d.round, d.sent = 2, map[string]sent{}
+			assert.Equal(t, tt.want, d.delta(tt.prev, "consumer", tt.arg))
+			assert.Equal(t, sent{2, tt.arg}, d.sent["consumer"])
+		})
+	}
+}
+
+// changingCallback allocates the same allowances to every consumer, the test changes them between rounds.
+type changingCallback struct {
+	mu         sync.Mutex
+	allowances Allowances
+}
+
+func (cc *changingCallback) set(a Allowances) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.allowances = a
+}
+
+func (cc *changingCallback) callback(consumers []Announcement) map[string]Allowances {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	res := make(map[string]Allowances, len(consumers))
+	for _, c := range consumers {
+		res[c.Address] = copyAllowances(cc.allowances)
+	}
+	return res
+}
+
+func TestDeltaWorkloads(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	alice, bob, charlie := MakeTestLineItem("alice"), MakeTestLineItem("bob"), MakeTestLineItem("charlie")
+
+	cc := &changingCallback{allowances: Allowances{alice: 1, bob: 2, charlie: 3}}
+	dispatcher, _ := NewDispatcher(cc.callback,
+		WithDispatchPeriod(time.Hour),
+		WithJoinReserve(0),
+		WithMissedRounds(SkipMissedRounds),
+		WithDeltaWorkloads(),
+	)
+	dispatcher.trigger = make(chan struct{})
+	assert.Nil(t, dispatcher.Run())
+	defer dispatcher.Shutdown()
+
+	ws := new(workloads)
+	receiver, _ := NewReceiver(collect(ws))
+	assert.Nil(t, receiver.Run())
+	defer func() { _ = receiver.Shutdown() }()
+	assert.Eventually(t, func() bool { return len(dispatcher.Consumers()) == 1 }, time.Second, Delay)
+
+	dispatcher.trigger <- struct{}{}
+	assert.Eventually(t, func() bool { return ws.len() == 1 }, time.Second, Delay)
+
+	// The delta carries only the changed line item, the callback gets the full workload.
+	cc.set(Allowances{alice: 1, bob: 2, charlie: 30})
+	dispatcher.trigger <- struct{}{}
+	assert.Eventually(t, func() bool { return ws.len() == 2 }, time.Second, Delay)
+	w, err := DecodeWorkload([]byte(ws.get(1)))
+	assert.NoError(t, err)
+	assert.False(t, w.IsDelta())
+	assert.Equal(t, uint64(2), w.Round)
+	assert.Equal(t, Allowances{alice: 1, bob: 2, charlie: 30}, w.Allowances)
+
+	// The receiver misses a round, the full workload is requested.
+	receiver.leases.Update(Workload{Lease: time.Now().Add(time.Hour), Round: 1, Allowances: Allowances{}})
+	cc.set(Allowances{alice: 1, bob: 20, charlie: 30})
+	dispatcher.trigger <- struct{}{}
+	assert.Eventually(t, func() bool { return ws.len() == 3 }, time.Second, Delay)
+	assert.Equal(t, Allowances{alice: 1, bob: 20, charlie: 30}, receiver.Allowances())
+	_, src, _ := receiver.leases.find(alice)
+	assert.Equal(t, uint64(3), src.round)
+}
@@ -2,85 +2,531 @@ package dispatcher
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
-	"pacing.go/shared"
 	"time"
 )
 
-type WorkloadCallback func(consumers []string) map[string]interface{}
+// joinsBuffer limits the number of joins waiting for the dispatcher routine, the excess ones wait for the next round.
+const joinsBuffer = 64
 
+// WorkloadCallback computes allowances for active consumers, the result is keyed by consumer address.
+type WorkloadCallback func(consumers []Announcement) map[string]Allowances
+
+// Dispatcher periodically sends workloads to consumers observed on the announcements subject.
 type Dispatcher struct {
-	url           string
-	announcements string
-	cons          *Consumers
-	period        time.Duration
-	wcb           WorkloadCallback
+	opts *options
+	wcb  WorkloadCallback
+	scb  SharesCallback
+
+	conn     *nats.Conn
+	ownsConn bool
+	observer *Observer
+	elector  *Elector
+	shards   *Shards
+	reclaim  *nats.Subscription
+	resync   *nats.Subscription
+	pulls    *nats.Subscription
+	limiter  *pullLimiter
+	pool     *reclaimPool
+	sent     map[string]sent
+	round    uint64
+	started  time.Time
+	lease    time.Time
+	last     time.Time
+	joins    chan Announcement
+	takeover chan handoff
+	trigger  chan struct{}
+	budget   *errorBudget
+	publish  func(subject string, data []byte) error
+	now      func() time.Time
+	done     chan byte
+}
+
+// NewDispatcher creates new Dispatcher instance.
+// Configurable options are:
+// - WithURL or WithConn,
+// - WithAnnouncementsSubject,
+// - WithConsumerTTL,
+// - WithDispatchPeriod, WithDispatchOffset, WithMissedRounds and WithLease,
+// - WithJoinReserve and WithDeltaWorkloads,
+// - WithPullSubject and WithPullInterval,
+// - WithErrorHandler, WithFatalHandler, WithErrorBudget and WithRetry,
+// - WithLeaderElection and WithStateHandoff,
+// - WithSharding.
+func NewDispatcher(wcb WorkloadCallback, opts ...Option) (*Dispatcher, error) {
+	if wcb == nil {
+		return nil, fmt.Errorf("workload callback is required argument")
+	}
+	d := newDispatcher(opts...)
+	d.wcb = wcb
+	return d, nil
+}
 
-	conn *nats.Conn
-	sub  *nats.Subscription
-	done chan byte
+// NewBroadcastDispatcher creates new Dispatcher instance working in the broadcast mode.
+// Every round it publishes a single message with the shares of all consumers on the broadcast subject,
+// instead of a workload per consumer. It accepts the same options as NewDispatcher and WithBroadcastSubject.
+func NewBroadcastDispatcher(scb SharesCallback, opts ...Option) (*Dispatcher, error) {
+	if scb == nil {
+		return nil, fmt.Errorf("shares callback is required argument")
+	}
+	d := newDispatcher(opts...)
+	d.scb = scb
+	return d, nil
 }
 
-func NewDispatcher(wcb WorkloadCallback) (*Dispatcher, error) {
+func newDispatcher(opts ...Option) *Dispatcher {
+	options := newOptions(opts...)
 	return &Dispatcher{
-		url:           nats.DefaultURL,
-		announcements: DefaultAnnouncements,
-		cons:          NewConsumers(),
-		period:        DefaultDispatcherPeriod,
-		wcb:           wcb,
-	}, nil
+		opts:     options,
+		pool:     newReclaimPool(),
+		limiter:  newPullLimiter(options.pullInterval),
+		joins:    make(chan Announcement, joinsBuffer),
+		takeover: make(chan handoff, 1),
+		budget:   newErrorBudget(options.failurePolicy()),
+		now:      time.Now,
+	}
 }
 
 func (d *Dispatcher) Run() error {
 	var err error
 	// Connect to NATs server
-	d.conn, err = nats.Connect(d.url)
+	d.conn, d.ownsConn, err = d.opts.connect()
 	if err != nil {
 		return err
 	}
-	if !d.conn.IsConnected() {
-		return errors.New(fmt.Sprintf("Cannot connect, connection status is %s\n", d.conn.Status()))
+	// Observe announcements, the observer period is used as the consumer TTL
+	d.observer, err = NewObserver(d.conn,
+		WithSubject(d.opts.announcements),
+		WithPeriod(d.opts.ttl),
+		WithJoinHandler(d.joined),
+	)
+	if err != nil {
+		d.disconnect()
+		return err
+	}
+	if d.publish == nil {
+		d.publish = d.conn.Publish
+	}
+	// Campaign for leadership, the followers keep observing the consumers to take over quickly
+	if d.opts.election {
+		electionOpts := append([]ElectionOption{WithLeadershipHandler(d.leadershipChanged)}, d.opts.electionOpts...)
+		d.elector, err = NewElector(d.conn, electionOpts...)
+		if err != nil {
+			d.Shutdown()
+			return err
+		}
+	}
+	// Announce this replica to others sharing the line items
+	if d.opts.sharding {
+		shardsOpts := append([]AnnouncementsOption{WithPeriod(d.opts.announcementsPeriod)}, d.opts.shardsOpts...)
+		d.shards, err = NewShards(d.conn, shardsOpts...)
+		if err != nil {
+			d.Shutdown()
+			return err
+		}
+	}
+	// Serve adjustments of allowances sent by consumers in the middle of the round
+	d.reclaim, err = d.conn.Subscribe(nats.NewInbox(), d.adjust)
+	if err == nil {
+		// Serve full workloads to consumers which have missed a round
+		d.resync, err = d.conn.Subscribe(nats.NewInbox(), d.sync)
+	}
+	if err == nil {
+		// Serve current workloads to consumers pulling them on demand
+		d.pulls, err = d.conn.Subscribe(d.opts.pullSubject, d.pull)
 	}
-	// Subscribe to announcements
-	d.sub, err = d.conn.Subscribe(d.announcements, d.watchAnnouncements)
 	if err != nil {
+		d.Shutdown()
 		return err
 	}
 	// Run dispatcher routine
 	d.done = make(chan byte)
-	go d.dispatcher()
+	go d.dispatcher(d.now())
 	// Done
 	return nil
 }
 
-func (d *Dispatcher) watchAnnouncements(msg *nats.Msg) {
-	d.cons.Join(string(msg.Data))
+// IsLeader tells whether the dispatcher is the leader, it is always true when the election is disabled.
+func (d *Dispatcher) IsLeader() bool {
+	return d.elector == nil || d.elector.IsLeader()
 }
 
-func (d *Dispatcher) dispatcher() {
-	var err error
-	var enc []byte
-	ticker := time.NewTicker(d.period)
+// Owns tells whether the dispatcher owns given line item, it is always true when the sharding is disabled.
+func (d *Dispatcher) Owns(id uuid.UUID) bool {
+	return d.shards == nil || d.shards.Owns(id)
+}
+
+// source identifies the dispatcher in workloads, it is empty when the sharding is disabled.
+func (d *Dispatcher) source() string {
+	if d.shards == nil {
+		return ""
+	}
+	return d.shards.ID()
+}
+
+// owned returns the allowances of line items owned by the dispatcher.
+func (d *Dispatcher) owned(a Allowances) Allowances {
+	if d.shards == nil {
+		return a
+	}
+	res := make(Allowances, len(a))
+	for id, allowance := range a {
+		if d.shards.Owns(id) {
+			res[id] = allowance
+		}
+	}
+	return res
+}
+
+// handoff is the state committed by the leader to the leader record before it sends the workloads of the round.
+// The next leader continues the round numbering, holds the allowances already dispatched in the round
+// and skips the scheduled round which has been dispatched by the previous leader, so it is not allocated twice.
+type handoff struct {
+	Round     uint64                `json:"round"`
+	Scheduled time.Time             `json:"scheduled"`
+	Started   time.Time             `json:"started"`
+	Lease     time.Time             `json:"lease"`
+	Held      map[string]Allowances `json:"held,omitempty"`
+	Shares    *Shares               `json:"shares,omitempty"`
+	Reserved  Allowances            `json:"reserved,omitempty"`
+	// State is the application state, see WithStateHandoff.
+	State json.RawMessage `json:"state,omitempty"`
+}
+
+// leadershipChanged restores the state handed over by the previous leader.
+// The dispatched round is passed to the dispatcher routine, the application state is restored right away.
+func (d *Dispatcher) leadershipChanged(leader bool, state []byte) {
+	if !leader || state == nil {
+		return
+	}
+	var h handoff
+	if err := json.Unmarshal(state, &h); err != nil {
+		d.budget.failure(fmt.Errorf("cannot decode state handed over by previous leader: %w", err))
+		return
+	}
+	if h.State != nil && d.opts.restoreState != nil {
+		if err := d.opts.restoreState(h.State); err != nil {
+			d.budget.failure(fmt.Errorf("cannot restore state handed over by previous leader: %w", err))
+		}
+	}
+	if h.Round == 0 {
+		return
+	}
+	// Only the latest handoff matters
+	select {
+	case <-d.takeover:
+	default:
+	}
+	d.takeover <- h
+}
+
+// takeOver continues the round dispatched by the previous leader, the consumers keep their allowances
+// and can adjust them with this dispatcher.
+func (d *Dispatcher) takeOver(h handoff) {
+	log.Info().Msg(fmt.Sprintf("(dispatcher) taking over round: %d", h.Round))
+	d.resume(h)
+	d.sent = make(map[string]sent, len(h.Held))
+	for c, a := range h.Held {
+		d.sent[c] = sent{round: h.Round, allowances: a}
+	}
+}
+
+// pendingTakeover takes over the round handed over by the previous leader, if the routine has not done it yet.
+func (d *Dispatcher) pendingTakeover() {
+	select {
+	case h := <-d.takeover:
+		d.takeOver(h)
+	default:
+	}
+}
+
+// resume starts the round of the handoff.
+func (d *Dispatcher) resume(h handoff) {
+	d.round, d.started, d.lease, d.last = h.Round, h.Started, h.Lease, h.Scheduled
+	if h.Shares != nil {
+		d.pool.resetShares(d.workload(nil), *h.Shares, h.Reserved)
+	} else {
+		d.pool.reset(d.workload(nil), h.Held, h.Reserved)
+	}
+}
+
+// lead renews the leadership and commits the round together with the state before its workloads are sent.
+// It returns false if the dispatcher is not the leader, then the round must be skipped.
+func (d *Dispatcher) lead(h handoff) bool {
+	if d.elector == nil {
+		return true
+	}
+	if d.opts.saveState != nil {
+		var err error
+		if h.State, err = d.opts.saveState(); err != nil {
+			d.budget.failure(fmt.Errorf("cannot save state: %w", err))
+			return false
+		}
+	}
+	state, err := json.Marshal(h)
+	if err != nil {
+		d.budget.failure(fmt.Errorf("cannot encode state: %w", err))
+		return false
+	}
+	return d.elector.Renew(state) == nil
+}
+
+// Conn returns the NATS connection of the dispatcher, it is nil until Run is called.
+func (d *Dispatcher) Conn() *nats.Conn {
+	return d.conn
+}
+
+// Consumers returns active consumers' announcements.
+func (d *Dispatcher) Consumers() []Announcement {
+	return d.observer.Consumers()
+}
+
+// dispatcher runs the dispatch rounds aligned to the wall clock.
+// The round of the slot the dispatcher starts in is handled according to the missed rounds policy.
+func (d *Dispatcher) dispatcher(now time.Time) {
+	sched := d.opts.schedule()
+	scheduled := sched.last(now)
+	wait := time.Duration(0)
+	if !scheduled.Equal(now) && d.opts.missedRounds == SkipMissedRounds {
+		scheduled = scheduled.Add(d.opts.period)
+		wait = scheduled.Sub(now)
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			for c, w := range d.wcb(d.cons.List()) {
-				log.Debug().Msg(fmt.Sprintf("(dispatcher) sending workload to consumer: %v", c))
-				enc, err = json.Marshal(w)
-				shared.PanicIf(err)
-				err = d.conn.Publish(c, enc)
-				shared.PanicIf(err)
+		case <-timer.C:
+			now = d.now()
+			if missed := sched.missed(scheduled, now); missed < 0 {
+				// Woken up too early, e.g. the wall clock has been set back
+				timer.Reset(scheduled.Sub(now))
+				continue
+			} else if missed > 0 {
+				d.budget.policy.onError(fmt.Errorf("%w: %d rounds since %v", ErrMissedRounds, missed, scheduled))
+				if d.opts.missedRounds == SkipMissedRounds {
+					scheduled = sched.last(now).Add(d.opts.period)
+					timer.Reset(scheduled.Sub(now))
+					continue
+				}
+			}
+			if !d.dispatch(scheduled) {
+				return
+			}
+			scheduled = sched.last(now).Add(d.opts.period)
+			timer.Reset(scheduled.Sub(d.now()))
+		case <-d.trigger:
+			if !d.dispatch(time.Time{}) {
+				return
+			}
+		case h := <-d.takeover:
+			d.takeOver(h)
+		case ann := <-d.joins:
+			if !d.join(ann) {
+				return
 			}
 		case <-d.done:
-			ticker.Stop()
 			return
 		}
 	}
 }
 
+// dispatch sends workloads to all active consumers, all of them share the same lease.
+// The allowances returned by consumers in the previous round are dropped, the new round starts with fresh ones.
+// The round scheduled at given time is skipped if it has been dispatched already by the previous leader,
+// the zero time dispatches the round unconditionally.
+// The failures are reported to the error budget, one per failed consumer.
+// It returns false if the dispatcher has been stopped in the meantime.
+func (d *Dispatcher) dispatch(scheduled time.Time) bool {
+	d.pendingTakeover()
+	if !d.IsLeader() {
+		return true
+	}
+	if !scheduled.IsZero() && !scheduled.After(d.last) {
+		log.Debug().Msg(fmt.Sprintf("(dispatcher) skipping round dispatched by previous leader: %v", scheduled))
+		return true
+	}
+	h := handoff{Round: d.round + 1, Scheduled: d.last, Started: d.now(), Reserved: Allowances{}}
+	if !scheduled.IsZero() {
+		h.Scheduled = scheduled
+	}
+	h.Lease = h.Started.Add(d.opts.lease)
+	if d.scb != nil {
+		shares := d.scb(d.observer.Consumers())
+		shares.Allowances = d.reserve(d.owned(shares.Allowances), h.Reserved)
+		h.Shares = &shares
+	} else {
+		h.Held = map[string]Allowances{}
+		for c, a := range d.wcb(d.observer.Consumers()) {
+			h.Held[c] = d.reserve(d.owned(a), h.Reserved)
+		}
+	}
+	if !d.lead(h) {
+		return true
+	}
+	d.resume(h)
+	if h.Shares != nil {
+		log.Debug().Msg(fmt.Sprintf("(dispatcher) broadcasting workload to consumers: %d", len(h.Shares.Weights)))
+		return d.send(d.opts.broadcast, d.broadcast(*h.Shares))
+	}
+	prev := d.sent
+	d.sent = make(map[string]sent, len(h.Held))
+	for c, a := range h.Held {
+		log.Debug().Msg(fmt.Sprintf("(dispatcher) sending workload to consumer: %v", c))
+		if !d.send(c, d.delta(prev, c, a)) {
+			return false
+		}
+	}
+	return true
+}
+
+// send publishes the workload to the subject, the failures are reported to the error budget.
+// It returns false if the dispatcher has been stopped in the meantime.
+func (d *Dispatcher) send(subject string, w any) bool {
+	enc, err := json.Marshal(w)
+	if err != nil {
+		d.budget.failure(fmt.Errorf("cannot encode workload for %s: %w", subject, err))
+		return true
+	}
+	err = retry(d.budget.policy, d.done, func() error {
+		return d.publish(subject, enc)
+	})
+	switch {
+	case err == errStopped:
+		return false
+	case err != nil:
+		d.budget.failure(fmt.Errorf("cannot publish workload to %s: %w", subject, err))
+	default:
+		d.budget.success()
+	}
+	return true
+}
+
+// workload creates the workload of the current round with given allowances.
+func (d *Dispatcher) workload(a Allowances) Workload {
+	return Workload{
+		Source:     d.source(),
+		Lease:      d.lease,
+		Allowances: a,
+		Round:      d.round,
+		Reclaim:    d.reclaimSubject(),
+		Resync:     d.resyncSubject(),
+	}
+}
+
+// broadcast creates the broadcast message of the current round with given shares.
+func (d *Dispatcher) broadcast(shares Shares) Broadcast {
+	return Broadcast{
+		Source:  d.source(),
+		Lease:   d.lease,
+		Round:   d.round,
+		Reclaim: d.reclaimSubject(),
+		Shares:  shares,
+	}
+}
+
+// allowancesOf computes the allowances of the consumer as if they were dispatched now.
+func (d *Dispatcher) allowancesOf(address string) (Allowances, bool) {
+	consumers := d.observer.Consumers()
+	if d.scb != nil {
+		return d.scb(consumers).Share(address)
+	}
+	a, ok := d.wcb(consumers)[address]
+	return a, ok
+}
+
+// reserve keeps the configured fraction of the allowances undispensed, it returns the allowances left for the consumer.
+func (d *Dispatcher) reserve(a Allowances, reserved Allowances) Allowances {
+	if d.opts.joinReserve == 0 {
+		return a
+	}
+	res := make(Allowances, len(a))
+	for id, amount := range a {
+		r := int64(float64(amount) * d.opts.joinReserve)
+		res[id] = amount - r
+		reserved[id] += r
+	}
+	return res
+}
+
+// joined passes the consumer which has just joined to the dispatcher routine, it is dropped if the routine is busy.
+func (d *Dispatcher) joined(ann Announcement) {
+	select {
+	case d.joins <- ann:
+	default:
+	}
+}
+
+// join sends the workload to the consumer which joined in the middle of the round.
+// The consumer gets its share prorated to the rest of the round, at most what is left undispensed.
+// The existing consumers are rebalanced at the next round.
+// It returns false if the dispatcher has been stopped in the meantime.
+func (d *Dispatcher) join(ann Announcement) bool {
+	d.pendingTakeover()
+	if d.round == 0 || !d.IsLeader() {
+		return true
+	}
+	a, ok := d.allowancesOf(ann.Address)
+	if !ok {
+		return true
+	}
+	left := 1 - float64(d.now().Sub(d.started))/float64(d.opts.period)
+	if left <= 0 {
+		return true
+	}
+	prorated := make(Allowances, len(a))
+	for id, amount := range d.owned(a) {
+		prorated[id] = int64(float64(amount) * left)
+	}
+	granted, ok := d.pool.join(ann.Address, prorated)
+	if !ok {
+		return true
+	}
+	log.Debug().Msg(fmt.Sprintf("(dispatcher) sending prorated workload to joined consumer: %v", ann.Address))
+	if d.sent != nil {
+		d.sent[ann.Address] = sent{round: d.round, allowances: granted}
+	}
+	return d.send(ann.Address, d.workload(granted))
+}
+
+// reclaimSubject returns the subject the dispatcher serves adjustments on.
+func (d *Dispatcher) reclaimSubject() string {
+	if d.reclaim == nil {
+		return ""
+	}
+	return d.reclaim.Subject
+}
+
+// adjust takes back the allowances returned by a consumer and tops up the requested ones from the reclaimed budget.
+func (d *Dispatcher) adjust(msg *nats.Msg) {
+	a, err := DecodeAdjustment(msg.Data)
+	if err != nil {
+		d.budget.policy.onError(fmt.Errorf("cannot decode adjustment: %w", err))
+		return
+	}
+	// Only the announced consumer may adjust the allowances held at its address
+	if !d.observed(a.ID, a.Consumer) {
+		d.respond(msg, Grant{Error: "consumer is not observed"}, a.Consumer)
+		return
+	}
+	g := d.pool.adjust(a)
+	log.Debug().Msg(fmt.Sprintf("(dispatcher) adjusted allowances of consumer %v: returned %v, granted %v", a.Consumer, g.Returned, g.Granted))
+	d.respond(msg, g, a.Consumer)
+}
+
+// respond replies with the grant to the adjustment of the consumer.
+func (d *Dispatcher) respond(msg *nats.Msg, g Grant, consumer string) {
+	enc, err := json.Marshal(g)
+	if err == nil {
+		err = msg.Respond(enc)
+	}
+	if err != nil {
+		d.budget.policy.onError(fmt.Errorf("cannot reply to adjustment of consumer %s: %w", consumer, err))
+	}
+}
+
 func (d *Dispatcher) Shutdown() {
 	// Shutdown dispatcher routine
 	if d.done != nil {
@@ -88,12 +534,42 @@ func (d *Dispatcher) Shutdown() {
 		close(d.done)
 		d.done = nil
 	}
+	// Stop serving adjustments, resyncs and pulls
+	if d.reclaim != nil {
+		_ = d.reclaim.Unsubscribe()
+		d.reclaim = nil
+	}
+	if d.resync != nil {
+		_ = d.resync.Unsubscribe()
+		d.resync = nil
+	}
+	if d.pulls != nil {
+		_ = d.pulls.Unsubscribe()
+		d.pulls = nil
+	}
+	// Leave the shards
+	if d.shards != nil {
+		_ = d.shards.Stop()
+		d.shards = nil
+	}
+	// Release leadership
+	if d.elector != nil {
+		d.elector.Stop()
+		d.elector = nil
+	}
 	// Unsubscribe from announcements
-	if d.sub != nil {
+	if d.observer != nil {
 		// The subscription is either not valid or connection is broken
-		_ = d.sub.Unsubscribe()
-		d.sub = nil
+		_ = d.observer.Stop()
+		d.observer = nil
+	}
+	d.disconnect()
+}
+
+// disconnect closes the connection if it is owned by the dispatcher.
+func (d *Dispatcher) disconnect() {
+	if d.conn != nil && d.ownsConn {
+		d.conn.Close()
 	}
-	// Disconnect fromNATS server
-	d.conn.Close()
+	d.conn = nil
 }
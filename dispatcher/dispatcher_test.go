@@ -1,7 +1,7 @@
 package dispatcher
 
 import (
-	"encoding/json"
+	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -10,10 +10,16 @@ import (
 
 const Delay = time.Millisecond
 
-func ConsumerNameCallback(consumers []string) map[string]interface{} {
-	res := make(map[string]interface{}, len(consumers))
+// MakeTestLineItem returns the line item identifier derived from the consumer address.
+func MakeTestLineItem(address string) uuid.UUID {
+	return uuid.NewSHA1(uuid.Nil, []byte(address))
+}
+
+// ConsumerNameCallback allocates a unit of the line item derived from the address to every consumer.
+func ConsumerNameCallback(consumers []Announcement) map[string]Allowances {
+	res := make(map[string]Allowances, len(consumers))
 	for _, c := range consumers {
-		res[c] = c
+		res[c.Address] = Allowances{MakeTestLineItem(c.Address): 1}
 	}
 	return res
 }
@@ -32,6 +38,39 @@ func TestNewDispatcher(t *testing.T) {
 	dispatcher.Shutdown()
 }
 
+func TestNewDispatcherRequiresCallback(t *testing.T) {
+	dispatcher, err := NewDispatcher(nil)
+	assert.Error(t, err)
+	assert.Nil(t, dispatcher)
+}
+
+func TestRunDispatcherWithoutServer(t *testing.T) {
+	dispatcher, err := NewDispatcher(ConsumerNameCallback, WithURL("nats://127.0.0.1:1"))
+	assert.Nil(t, err)
+	assert.Error(t, dispatcher.Run())
+}
+
+func TestDispatcherWithConn(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+
+	dispatcher, err := NewDispatcher(ConsumerNameCallback, WithConn(nc), WithAnnouncementsSubject("test-announcements"))
+	assert.Nil(t, err)
+	assert.Nil(t, dispatcher.Run())
+
+	err = nc.Publish("test-announcements", EncodeTestAnnouncement(t, "consumer-1"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return len(dispatcher.Consumers()) == 1
+	}, time.Second, Delay)
+
+	dispatcher.Shutdown()
+	// The injected connection is owned by the caller.
+	assert.True(t, nc.IsConnected())
+}
+
 func TestWatchAnnouncements(t *testing.T) {
 	srv := RunTestServer()
 	defer srv.Shutdown()
@@ -46,24 +85,24 @@ func TestWatchAnnouncements(t *testing.T) {
 	nc, err := nats.Connect(nats.DefaultURL)
 	assert.Nil(t, err)
 
-	err = nc.Publish(DefaultAnnouncements, []byte("consumer-1"))
+	err = nc.Publish(DefaultAnnouncements, EncodeTestAnnouncement(t, "consumer-1"))
 	assert.Nil(t, err)
 
-	time.Sleep(Delay)
-
-	consumers := dispatcher.cons.List()
-	assert.Len(t, consumers, 1)
+	assert.Eventually(t, func() bool {
+		return len(dispatcher.Consumers()) == 1
+	}, time.Second, Delay)
+	consumers := Addresses(dispatcher.Consumers())
 	assert.Contains(t, consumers, "consumer-1")
 
-	err = nc.Publish(DefaultAnnouncements, []byte("consumer-2"))
+	err = nc.Publish(DefaultAnnouncements, EncodeTestAnnouncement(t, "consumer-2"))
 	assert.Nil(t, err)
-	err = nc.Publish(DefaultAnnouncements, []byte("consumer-3"))
+	err = nc.Publish(DefaultAnnouncements, EncodeTestAnnouncement(t, "consumer-3"))
 	assert.Nil(t, err)
 
-	time.Sleep(Delay)
-
-	consumers = dispatcher.cons.List()
-	assert.Len(t, consumers, 3)
+	assert.Eventually(t, func() bool {
+		return len(dispatcher.Consumers()) == 3
+	}, time.Second, Delay)
+	consumers = Addresses(dispatcher.Consumers())
 	assert.Contains(t, consumers, "consumer-1")
 	assert.Contains(t, consumers, "consumer-2")
 	assert.Contains(t, consumers, "consumer-3")
@@ -73,8 +112,16 @@ func TestDispatchWorkload(t *testing.T) {
 	srv := RunTestServer()
 	defer srv.Shutdown()
 
-	dispatcher, _ := NewDispatcher(ConsumerNameCallback)
-	dispatcher.period = 100 * time.Millisecond
+	period := 100 * time.Millisecond
+	dispatcher, _ := NewDispatcher(ConsumerNameCallback,
+		WithDispatchPeriod(time.Hour),
+		WithLease(time.Hour),
+		WithMissedRounds(SkipMissedRounds),
+	)
+	// Started in the middle of the slot, the rounds are triggered by the test.
+	now := time.Date(2023, 2, 17, 0, 30, 0, 0, time.UTC)
+	dispatcher.now = func() time.Time { return now }
+	dispatcher.trigger = make(chan struct{})
 	_ = dispatcher.Run()
 	defer dispatcher.Shutdown()
 
@@ -86,27 +133,40 @@ func TestDispatchWorkload(t *testing.T) {
 	c2, err := nc.SubscribeSync("consumer-2")
 	assert.Nil(t, err)
 
-	err = nc.Publish(DefaultAnnouncements, []byte("consumer-1"))
+	err = nc.Publish(DefaultAnnouncements, EncodeTestAnnouncement(t, "consumer-1"))
 	assert.Nil(t, err)
-	err = nc.Publish(DefaultAnnouncements, []byte("consumer-2"))
+	err = nc.Publish(DefaultAnnouncements, EncodeTestAnnouncement(t, "consumer-2"))
 	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return len(dispatcher.Consumers()) == 2
+	}, time.Second, Delay)
+	dispatcher.trigger <- struct{}{}
 
-	time.Sleep(dispatcher.period)
-
-	msg1, err := c1.NextMsg(time.Millisecond)
+	msg1, err := c1.NextMsg(2 * period)
 	assert.Nil(t, err)
 	err = c1.Unsubscribe()
 	assert.Nil(t, err)
-	msg2, err := c2.NextMsg(time.Millisecond)
+	msg2, err := c2.NextMsg(2 * period)
 	assert.Nil(t, err)
 	err = c2.Unsubscribe()
 	assert.Nil(t, err)
 
-	var workload string
-	err = json.Unmarshal(msg1.Data, &workload)
-	assert.Nil(t, err)
-	assert.Equal(t, "consumer-1", workload)
-	err = json.Unmarshal(msg2.Data, &workload)
-	assert.Nil(t, err)
-	assert.Equal(t, "consumer-2", workload)
+	workload, err := DecodeWorkload(msg1.Data)
+	assert.Nil(t, err)
+	assert.Equal(t, Workload{
+		Lease:      now.Add(time.Hour),
+		Allowances: Allowances{MakeTestLineItem("consumer-1"): 1},
+		Round:      1,
+		Reclaim:    dispatcher.reclaimSubject(),
+		Resync:     dispatcher.resyncSubject(),
+	}, workload)
+	workload, err = DecodeWorkload(msg2.Data)
+	assert.Nil(t, err)
+	assert.Equal(t, Workload{
+		Lease:      now.Add(time.Hour),
+		Allowances: Allowances{MakeTestLineItem("consumer-2"): 1},
+		Round:      1,
+		Reclaim:    dispatcher.reclaimSubject(),
+		Resync:     dispatcher.resyncSubject(),
+	}, workload)
 }
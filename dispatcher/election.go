@@ -0,0 +1,317 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// DefaultElectionBucket is the JetStream key-value bucket used for leader election if none provided.
+const DefaultElectionBucket = "pacing-election"
+
+// DefaultElectionKey is the key holding the leader record if none provided.
+const DefaultElectionKey = "leader"
+
+// DefaultLeaderTTL is the time the leadership is valid without renewal.
+const DefaultLeaderTTL = 3 * time.Second
+
+// ErrNotLeader is returned when the operation requires leadership and the candidate is not the leader.
+var ErrNotLeader = errors.New("not a leader")
+
+// LeadershipHandler is called when the candidate gains or loses leadership.
+// On gain, the state committed by the previous leader is passed, it is nil if there was none.
+type LeadershipHandler func(leader bool, state []byte)
+
+// electionOptions represents configurable options for Elector.
+type electionOptions struct {
+	bucket  string
+	key     string
+	id      string
+	ttl     time.Duration
+	handler LeadershipHandler
+}
+
+// ElectionOption allows to define configurable options.
+type ElectionOption func(opts *electionOptions)
+
+// WithElectionBucket configures the JetStream key-value bucket used for leader election.
+func WithElectionBucket(bucket string) ElectionOption {
+	return func(opts *electionOptions) {
+		opts.bucket = bucket
+	}
+}
+
+// WithElectionKey configures the key holding the leader record, candidates with the same key compete.
+func WithElectionKey(key string) ElectionOption {
+	return func(opts *electionOptions) {
+		opts.key = key
+	}
+}
+
+// WithCandidateID configures the candidate identifier, a random one is used if none provided.
+func WithCandidateID(id string) ElectionOption {
+	return func(opts *electionOptions) {
+		opts.id = id
+	}
+}
+
+// WithLeaderTTL configures the time the leadership is valid without renewal.
+// The leader renews it three times per TTL, the followers check it at the same pace.
+func WithLeaderTTL(ttl time.Duration) ElectionOption {
+	return func(opts *electionOptions) {
+		opts.ttl = ttl
+	}
+}
+
+// WithLeadershipHandler configures the handler called when the candidate gains or loses leadership.
+func WithLeadershipHandler(handler LeadershipHandler) ElectionOption {
+	return func(opts *electionOptions) {
+		opts.handler = handler
+	}
+}
+
+// leaderRecord is the value of the election key.
+// The state is kept in the same record, so it is handed over atomically with the leadership.
+type leaderRecord struct {
+	ID      string          `json:"id"`
+	Expires time.Time       `json:"expires"`
+	State   json.RawMessage `json:"state,omitempty"`
+}
+
+// Elector campaigns for leadership among candidates sharing the election key.
+// The leadership is a lease stored in a JetStream key-value bucket and renewed with compare-and-swap,
+// so at most one candidate holds it at a time, as long as the clocks of the candidates are roughly in sync.
+type Elector struct {
+	opts *electionOptions
+	kv   nats.KeyValue
+	now  func() time.Time
+	done chan bool
+	// write serializes the writes of the leader record, the KV round trip is done without holding mu,
+	// so it does not block IsLeader
+	write sync.Mutex
+
+	mu       sync.Mutex
+	leader   bool
+	revision uint64
+	expires  time.Time
+	state    []byte
+}
+
+// NewElector creates new Elector instance and starts campaigning.
+func NewElector(nc *nats.Conn, opts ...ElectionOption) (*Elector, error) {
+	if nc == nil {
+		return nil, fmt.Errorf("NATS connection is required argument")
+	}
+	if !nc.IsConnected() {
+		return nil, fmt.Errorf("NATS connection has invalid state: %v", nc.Status())
+	}
+	options := &electionOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.bucket == "" {
+		options.bucket = DefaultElectionBucket
+	}
+	if options.key == "" {
+		options.key = DefaultElectionKey
+	}
+	if options.id == "" {
+		options.id = uuid.NewString()
+	}
+	if options.ttl <= 0 {
+		options.ttl = DefaultLeaderTTL
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("cannot access JetStream: %v", err)
+	}
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: options.bucket, History: 1})
+	if err != nil {
+		if kv, err = js.KeyValue(options.bucket); err != nil {
+			return nil, fmt.Errorf("cannot access election bucket: %v", err)
+		}
+	}
+	e := &Elector{
+		opts: options,
+		kv:   kv,
+		now:  time.Now,
+		done: make(chan bool),
+	}
+	go e.loop()
+	return e, nil
+}
+
+// ID is the candidate identifier.
+func (e *Elector) ID() string {
+	return e.opts.id
+}
+
+// IsLeader tells whether the candidate holds the leadership.
+// The leader which failed to renew the leadership in time is not considered the leader anymore.
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader && e.now().Before(e.expires)
+}
+
+// Renew extends the leadership and commits the state, it fails with ErrNotLeader when the candidate is not the leader.
+// Once it succeeds, no other candidate may become the leader within the TTL.
+func (e *Elector) Renew(state []byte) error {
+	e.write.Lock()
+	e.mu.Lock()
+	leader, revision := e.leader, e.revision
+	if state == nil {
+		state = e.state
+	}
+	e.mu.Unlock()
+	if !leader {
+		e.write.Unlock()
+		return ErrNotLeader
+	}
+	err := e.renew(revision, state)
+	e.write.Unlock()
+	if err != nil {
+		e.stepDown(err)
+	}
+	return err
+}
+
+// Stop stops campaigning and releases the leadership, so other candidates can take over immediately.
+func (e *Elector) Stop() {
+	e.done <- true
+	e.write.Lock()
+	defer e.write.Unlock()
+	e.mu.Lock()
+	leader, revision, state := e.leader, e.revision, e.state
+	e.leader = false
+	e.mu.Unlock()
+	if !leader {
+		return
+	}
+	rec, err := json.Marshal(leaderRecord{ID: e.opts.id, Expires: e.now(), State: state})
+	if err == nil {
+		_, err = e.kv.Update(e.opts.key, rec, revision)
+	}
+	if err != nil {
+		log.Err(err).Msg("(election) cannot release leadership")
+	}
+}
+
+// renew writes the leader record guarded by given revision, it must be called with the write lock held.
+func (e *Elector) renew(revision uint64, state []byte) error {
+	expires := e.now().Add(e.opts.ttl)
+	rec, err := json.Marshal(leaderRecord{ID: e.opts.id, Expires: expires, State: state})
+	if err != nil {
+		return err
+	}
+	revision, err = e.kv.Update(e.opts.key, rec, revision)
+	if err != nil {
+		return fmt.Errorf("cannot renew leadership: %w", err)
+	}
+	e.mu.Lock()
+	e.revision = revision
+	e.expires = expires
+	e.state = state
+	e.mu.Unlock()
+	return nil
+}
+
+// campaign takes over the leadership if there is no leader or its lease has expired.
+// The record which cannot be decoded is left alone, e.g. written by a newer version, so its state is not lost,
+// the candidate tries again on the next tick.
+func (e *Elector) campaign() {
+	var prev leaderRecord
+	var revision uint64
+	entry, err := e.kv.Get(e.opts.key)
+	switch {
+	case errors.Is(err, nats.ErrKeyNotFound):
+	case err != nil:
+		log.Err(err).Msg("(election) cannot read leader record")
+		return
+	default:
+		if err = json.Unmarshal(entry.Value(), &prev); err != nil {
+			log.Err(err).Msg("(election) cannot decode leader record, not taking over")
+			return
+		}
+		if prev.ID != e.opts.id && e.now().Before(prev.Expires) {
+			return
+		}
+		revision = entry.Revision()
+	}
+	expires := e.now().Add(e.opts.ttl)
+	rec, err := json.Marshal(leaderRecord{ID: e.opts.id, Expires: expires, State: prev.State})
+	if err == nil {
+		e.write.Lock()
+		if revision == 0 {
+			revision, err = e.kv.Create(e.opts.key, rec)
+		} else {
+			revision, err = e.kv.Update(e.opts.key, rec, revision)
+		}
+		e.write.Unlock()
+	}
+	if err != nil {
+		// Another candidate was faster.
+		return
+	}
+	// The state is handed over before the candidate is considered the leader.
+	if e.opts.handler != nil {
+		e.opts.handler(true, prev.State)
+	}
+	e.mu.Lock()
+	e.leader = true
+	e.revision = revision
+	e.expires = expires
+	e.state = prev.State
+	e.mu.Unlock()
+	log.Info().Msg(fmt.Sprintf("(election) %s became the leader", e.opts.id))
+}
+
+// stepDown gives up the leadership after the failed renewal.
+func (e *Elector) stepDown(err error) {
+	e.mu.Lock()
+	wasLeader := e.leader
+	e.leader = false
+	e.mu.Unlock()
+	if !wasLeader {
+		return
+	}
+	log.Warn().Err(err).Msg(fmt.Sprintf("(election) %s lost the leadership", e.opts.id))
+	if e.opts.handler != nil {
+		e.opts.handler(false, nil)
+	}
+}
+
+// tick renews the leadership or campaigns for it.
+func (e *Elector) tick() {
+	e.mu.Lock()
+	leader := e.leader
+	e.mu.Unlock()
+	if !leader {
+		e.campaign()
+		return
+	}
+	if err := e.Renew(nil); err != nil && !errors.Is(err, ErrNotLeader) {
+		log.Err(err).Msg("(election) renewal failed")
+	}
+}
+
+// loop is election routine skeleton.
+func (e *Elector) loop() {
+	// Run once immediately
+	e.tick()
+	ticker := time.NewTicker(e.opts.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.tick()
+		case <-e.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RunTestJetStreamServer runs test server with JetStream enabled.
+func RunTestJetStreamServer(t *testing.T) *server.Server {
+	return RunTestServerWithOptions(t, func(opts *server.Options) {
+		opts.JetStream = true
+		opts.StoreDir = t.TempDir()
+	})
+}
+
+// MakeTestBucket creates the election bucket.
+func MakeTestBucket(t *testing.T, nc *nats.Conn) nats.KeyValue {
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("Cannot access JetStream: %v", err)
+	}
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: DefaultElectionBucket, History: 1})
+	if err != nil {
+		t.Fatalf("Cannot create bucket: %v", err)
+	}
+	return kv
+}
+
+// newTestElector creates Elector which does not campaign on its own and uses given clock.
+func newTestElector(kv nats.KeyValue, id string, now *time.Time, handler LeadershipHandler) *Elector {
+	return &Elector{
+		opts: &electionOptions{bucket: DefaultElectionBucket, key: DefaultElectionKey, id: id, ttl: time.Second, handler: handler},
+		kv:   kv,
+		now:  func() time.Time { return *now },
+		done: make(chan bool, 1),
+	}
+}
+
+func TestNewElector(t *testing.T) {
+	srv := RunTestJetStreamServer(t)
+	defer srv.Shutdown()
+	nc, err := nats.Connect(srv.ClientURL())
+	assert.NoError(t, err)
+	defer nc.Close()
+	broken, err := nats.Connect(srv.ClientURL())
+	assert.NoError(t, err)
+	broken.Close()
+
+	_, err = NewElector(nil)
+	assert.Error(t, err)
+	_, err = NewElector(broken)
+	assert.Error(t, err)
+
+	e, err := NewElector(nc, WithCandidateID("alice"), WithLeaderTTL(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", e.ID())
+	assert.Equal(t, DefaultElectionBucket, e.opts.bucket)
+	assert.Equal(t, DefaultElectionKey, e.opts.key)
+	assert.Eventually(t, e.IsLeader, time.Second, time.Millisecond)
+	e.Stop()
+	assert.False(t, e.IsLeader())
+}
+
+func TestElectorHandover(t *testing.T) {
+	srv := RunTestJetStreamServer(t)
+	defer srv.Shutdown()
+	nc, err := nats.Connect(srv.ClientURL())
+	assert.NoError(t, err)
+	defer nc.Close()
+	kv := MakeTestBucket(t, nc)
+
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.UTC)
+	var handedOver []byte
+	alice := newTestElector(kv, "alice", &now, nil)
+	bob := newTestElector(kv, "bob", &now, func(leader bool, state []byte) {
+		if leader {
+			handedOver = state
+		}
+	})
+
+	alice.campaign()
+	assert.True(t, alice.IsLeader())
+	assert.NoError(t, alice.Renew([]byte(`{"spend":1}`)))
+
+	// Bob cannot take over while the lease is valid.
+	bob.campaign()
+	assert.False(t, bob.IsLeader())
+	assert.ErrorIs(t, bob.Renew(nil), ErrNotLeader)
+
+	// Alice fails to renew in time, she is not the leader from her own point of view anymore.
+	now = now.Add(time.Second)
+	assert.False(t, alice.IsLeader())
+
+	// Bob takes over with the state committed by Alice.
+	bob.campaign()
+	assert.True(t, bob.IsLeader())
+	assert.JSONEq(t, `{"spend":1}`, string(handedOver))
+
+	// Alice is fenced off, her renewal fails even though the clock would allow it.
+	now = now.Add(-time.Second)
+	assert.Error(t, alice.Renew([]byte(`{"spend":2}`)))
+	assert.False(t, alice.IsLeader())
+}
+
+func TestElectorReleasesLeadershipOnStop(t *testing.T) {
+	srv := RunTestJetStreamServer(t)
+	defer srv.Shutdown()
+	nc, err := nats.Connect(srv.ClientURL())
+	assert.NoError(t, err)
+	defer nc.Close()
+	kv := MakeTestBucket(t, nc)
+
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.UTC)
+	alice := newTestElector(kv, "alice", &now, nil)
+	bob := newTestElector(kv, "bob", &now, nil)
+
+	alice.campaign()
+	assert.True(t, alice.IsLeader())
+	alice.Stop()
+	assert.False(t, alice.IsLeader())
+
+	// The lease has been released, Bob does not need to wait for its expiration.
+	bob.campaign()
+	assert.True(t, bob.IsLeader())
+}
+
+func TestElectorKeepsUndecodableRecord(t *testing.T) {
+	srv := RunTestJetStreamServer(t)
+	defer srv.Shutdown()
+	nc, err := nats.Connect(srv.ClientURL())
+	assert.NoError(t, err)
+	defer nc.Close()
+	kv := MakeTestBucket(t, nc)
+
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.UTC)
+	_, err = kv.Create(DefaultElectionKey, []byte(`{"id":1}`))
+	assert.NoError(t, err)
+
+	// The record written e.g. by another version is not overwritten, its state would be lost.
+	alice := newTestElector(kv, "alice", &now, nil)
+	alice.campaign()
+	assert.False(t, alice.IsLeader())
+	entry, err := kv.Get(DefaultElectionKey)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":1}`, string(entry.Value()))
+}
+
+// handoffState is the concurrency safe state used to test state handoff between dispatchers.
+type handoffState struct {
+	mu    sync.Mutex
+	state string
+}
+
+func (hs *handoffState) save() ([]byte, error) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return []byte(hs.state), nil
+}
+
+func (hs *handoffState) restore(state []byte) error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.state = string(state)
+	return nil
+}
+
+func (hs *handoffState) get() string {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.state
+}
+
+func TestDispatchersWithLeaderElection(t *testing.T) {
+	srv := RunTestJetStreamServer(t)
+	defer srv.Shutdown()
+	url := srv.ClientURL()
+
+	nc, err := nats.Connect(url)
+	assert.NoError(t, err)
+	defer nc.Close()
+
+	states := []*handoffState{{state: `"first"`}, {state: `"second"`}}
+	dispatchers := make([]*Dispatcher, len(states))
+	publishers := make([]*failingPublisher, len(states))
+	for i, hs := range states {
+		dispatchers[i], err = NewDispatcher(ConsumerNameCallback,
+			WithURL(url),
+			WithDispatchPeriod(10*time.Millisecond),
+			WithLeaderElection(WithLeaderTTL(300*time.Millisecond)),
+			WithStateHandoff(hs.save, hs.restore),
+		)
+		assert.NoError(t, err)
+		publishers[i] = &failingPublisher{}
+		dispatchers[i].publish = publishers[i].publish
+		assert.NoError(t, dispatchers[i].Run())
+	}
+
+	// Exactly one leader is elected.
+	leaderIdx := -1
+	assert.Eventually(t, func() bool {
+		for i, d := range dispatchers {
+			if d.IsLeader() {
+				leaderIdx = i
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+	follower := dispatchers[1-leaderIdx]
+	assert.False(t, follower.IsLeader())
+
+	// Only the leader dispatches.
+	assert.NoError(t, nc.Publish(DefaultAnnouncements, EncodeTestAnnouncement(t, "consumer-1")))
+	assert.Eventually(t, func() bool {
+		return publishers[leaderIdx].deliveredCount() >= 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 0, publishers[1-leaderIdx].deliveredCount())
+
+	// The follower takes over quickly after the leader leaves, together with its state.
+	dispatchers[leaderIdx].Shutdown()
+	assert.Eventually(t, follower.IsLeader, time.Second, time.Millisecond)
+	assert.Equal(t, states[leaderIdx].get(), states[1-leaderIdx].get())
+	follower.Shutdown()
+}
+
+// nextTestRound triggers the round and returns the workload received by the consumer.
+func nextTestRound(t *testing.T, d *Dispatcher, sub *nats.Subscription) Workload {
+	d.trigger <- struct{}{}
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Cannot receive workload: %v", err)
+	}
+	w, err := DecodeWorkload(msg.Data)
+	assert.NoError(t, err)
+	return w
+}
+
+func TestDispatcherTakesOverDispatchedRound(t *testing.T) {
+	srv := RunTestJetStreamServer(t)
+	defer srv.Shutdown()
+	url := srv.ClientURL()
+
+	nc, err := nats.Connect(url)
+	assert.NoError(t, err)
+	defer nc.Close()
+	sub, err := nc.SubscribeSync("consumer-1")
+	assert.NoError(t, err)
+
+	// Both replicas are in the middle of the same slot, the rounds are triggered by the test.
+	now := time.Date(2023, 2, 17, 0, 30, 0, 0, time.UTC)
+	replica := func() *Dispatcher {
+		d, err := NewDispatcher(ConsumerNameCallback,
+			WithURL(url),
+			WithDispatchPeriod(time.Hour),
+			WithLease(time.Hour),
+			WithMissedRounds(SkipMissedRounds),
+			WithLeaderElection(WithLeaderTTL(300*time.Millisecond)),
+		)
+		assert.NoError(t, err)
+		d.now = func() time.Time { return now }
+		d.trigger = make(chan struct{})
+		assert.NoError(t, d.Run())
+		assert.Eventually(t, d.IsLeader, time.Second, Delay)
+		assert.NoError(t, nc.Publish(DefaultAnnouncements, EncodeTestAnnouncement(t, "consumer-1")))
+		assert.Eventually(t, func() bool {
+			return len(d.Consumers()) == 1
+		}, time.Second, Delay)
+		return d
+	}
+
+	alice := replica()
+	first := nextTestRound(t, alice, sub)
+	alice.Shutdown()
+
+	// Bob holds the allowances dispatched by Alice, the consumer can adjust them with him.
+	bob := replica()
+	defer bob.Shutdown()
+	assert.Eventually(t, func() bool {
+		w, ok := bob.pool.current("consumer-1")
+		return ok && w.Round == first.Round && w.Lease.Equal(first.Lease)
+	}, time.Second, Delay)
+	w, _ := bob.pool.current("consumer-1")
+	assert.Equal(t, first.Allowances, w.Allowances)
+
+	// The round numbering continues.
+	second := nextTestRound(t, bob, sub)
+	assert.Equal(t, first.Round+1, second.Round)
+}
+
+func TestDispatcherSkipsRoundOfPreviousLeader(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+
+	nc, err := nats.Connect(nats.DefaultURL)
+	assert.NoError(t, err)
+	defer nc.Close()
+	sub, err := nc.SubscribeSync("consumer-1")
+	assert.NoError(t, err)
+
+	dispatcher, _ := NewDispatcher(ConsumerNameCallback,
+		WithDispatchPeriod(time.Hour),
+		WithLease(time.Hour),
+	)
+	now := time.Date(2023, 2, 17, 0, 30, 0, 0, time.UTC)
+	dispatcher.now = func() time.Time { return now }
+	dispatcher.trigger = make(chan struct{})
+
+	// The previous leader has dispatched the round of the current slot, it is not caught up again.
+	state, err := json.Marshal(handoff{
+		Round:     5,
+		Scheduled: dispatcher.opts.schedule().last(now),
+		Started:   now,
+		Lease:     now.Add(time.Hour),
+		Held:      map[string]Allowances{"consumer-1": {MakeTestLineItem("consumer-1"): 1}},
+	})
+	assert.NoError(t, err)
+	dispatcher.leadershipChanged(true, state)
+	assert.NoError(t, dispatcher.Run())
+	defer dispatcher.Shutdown()
+
+	assert.NoError(t, nc.Publish(DefaultAnnouncements, EncodeTestAnnouncement(t, "consumer-1")))
+	assert.Eventually(t, func() bool {
+		return len(dispatcher.Consumers()) == 1
+	}, time.Second, Delay)
+	// The consumer holds the allowances of the round, it gets nothing until the next round.
+	w := nextTestRound(t, dispatcher, sub)
+	assert.Equal(t, uint64(6), w.Round)
+	_, err = sub.NextMsg(50 * time.Millisecond)
+	assert.ErrorIs(t, err, nats.ErrTimeout)
+}
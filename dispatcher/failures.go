@@ -0,0 +1,115 @@
+package dispatcher
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// DefaultErrorBudget is the number of consecutive failures tolerated before the failure is considered fatal.
+const DefaultErrorBudget = 10
+
+// DefaultRetryAttempts is the number of attempts made for a single publish.
+const DefaultRetryAttempts = 3
+
+// DefaultRetryBackoff is the delay before the first retry, it doubles with every next retry.
+const DefaultRetryBackoff = 50 * time.Millisecond
+
+// ErrorHandler is called with errors occurred in background routines.
+type ErrorHandler func(err error)
+
+// ErrErrorBudgetExceeded is passed (wrapped) to the fatal handler when the error budget is exceeded.
+var ErrErrorBudgetExceeded = errors.New("error budget exceeded")
+
+// LogError is the default ErrorHandler, it only logs the error.
+func LogError(err error) {
+	log.Err(err).Msg("error occurred in background routine")
+}
+
+// errStopped is returned by retry when the routine is being stopped.
+var errStopped = errors.New("stopped")
+
+// failurePolicy describes how background routines handle failures.
+type failurePolicy struct {
+	// onError is called with every failure, after the retries are exhausted.
+	onError ErrorHandler
+	// onFatal is called when the number of consecutive failures exceeds the budget, nil means never.
+	onFatal  ErrorHandler
+	budget   int
+	attempts int
+	backoff  time.Duration
+}
+
+// withDefaults returns copy of the policy with invalid values replaced by defaults.
+func (p failurePolicy) withDefaults() failurePolicy {
+	if p.onError == nil {
+		p.onError = LogError
+	}
+	if p.budget <= 0 {
+		p.budget = DefaultErrorBudget
+	}
+	if p.attempts <= 0 {
+		p.attempts = DefaultRetryAttempts
+	}
+	if p.backoff <= 0 {
+		p.backoff = DefaultRetryBackoff
+	}
+	return p
+}
+
+// errorBudget counts consecutive failures and escalates them to the fatal handler when the budget is exceeded.
+type errorBudget struct {
+	mu       sync.Mutex
+	policy   failurePolicy
+	failures int
+}
+
+// newErrorBudget creates errorBudget for given policy.
+func newErrorBudget(policy failurePolicy) *errorBudget {
+	return &errorBudget{policy: policy.withDefaults()}
+}
+
+// success resets the counter of consecutive failures.
+func (b *errorBudget) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// failure reports the error and escalates it if the budget is exceeded.
+func (b *errorBudget) failure(err error) {
+	b.mu.Lock()
+	b.failures++
+	exceeded := b.failures > b.policy.budget
+	if exceeded {
+		b.failures = 0
+	}
+	b.mu.Unlock()
+	b.policy.onError(err)
+	if exceeded && b.policy.onFatal != nil {
+		b.policy.onFatal(fmt.Errorf("%w: %v", ErrErrorBudgetExceeded, err))
+	}
+}
+
+// retry calls f until it succeeds or the attempts are exhausted, waiting with exponential backoff in between.
+// The waiting is interrupted when done receives a value, then errStopped is returned.
+func retry[T any](policy failurePolicy, done <-chan T, f func() error) error {
+	policy = policy.withDefaults()
+	backoff := policy.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || attempt >= policy.attempts {
+			return err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return errStopped
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,212 @@
+package dispatcher
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTestPublish = errors.New("test publish failure")
+
+// collectedErrors is the concurrency safe collection of errors passed to a handler.
+type collectedErrors struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (ce *collectedErrors) handler(err error) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.errs = append(ce.errs, err)
+}
+
+func (ce *collectedErrors) len() int {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	return len(ce.errs)
+}
+
+func (ce *collectedErrors) get(i int) error {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	return ce.errs[i]
+}
+
+// failingPublisher fails the first n publishes and records the subjects of the successful ones.
+type failingPublisher struct {
+	mu        sync.Mutex
+	n         int
+	calls     int
+	delivered []string
+}
+
+func (fp *failingPublisher) publish(subject string, _ []byte) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.calls++
+	if fp.calls <= fp.n {
+		return errTestPublish
+	}
+	fp.delivered = append(fp.delivered, subject)
+	return nil
+}
+
+func (fp *failingPublisher) deliveredCount() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return len(fp.delivered)
+}
+
+func TestErrorBudget(t *testing.T) {
+	errs, fatal := new(collectedErrors), new(collectedErrors)
+	b := newErrorBudget(failurePolicy{onError: errs.handler, onFatal: fatal.handler, budget: 2})
+
+	b.failure(errTestPublish)
+	b.failure(errTestPublish)
+	assert.Equal(t, 2, errs.len())
+	assert.Equal(t, 0, fatal.len())
+
+	b.success()
+	b.failure(errTestPublish)
+	b.failure(errTestPublish)
+	assert.Equal(t, 0, fatal.len())
+
+	b.failure(errTestPublish)
+	assert.Equal(t, 5, errs.len())
+	assert.Equal(t, 1, fatal.len())
+	assert.ErrorIs(t, fatal.get(0), ErrErrorBudgetExceeded)
+	assert.ErrorContains(t, fatal.get(0), errTestPublish.Error())
+}
+
+func TestErrorBudgetWithoutFatalHandler(t *testing.T) {
+	errs := new(collectedErrors)
+	b := newErrorBudget(failurePolicy{onError: errs.handler, budget: 1})
+	assert.NotPanics(t, func() {
+		for i := 0; i < 5; i++ {
+			b.failure(errTestPublish)
+		}
+	})
+	assert.Equal(t, 5, errs.len())
+}
+
+func TestRetry(t *testing.T) {
+	policy := failurePolicy{attempts: 3, backoff: time.Millisecond}
+	tests := []struct {
+		name      string
+		failures  int
+		wantErr   error
+		wantCalls int
+	}{
+		{"success", 0, nil, 1},
+		{"transient failure", 2, nil, 3},
+		{"attempts exhausted", 3, errTestPublish, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp := &failingPublisher{n: tt.failures}
+			err := retry(policy, make(chan byte), func() error {
+				return fp.publish("subject", nil)
+			})
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.wantCalls, fp.calls)
+		})
+	}
+}
+
+func TestRetryStopped(t *testing.T) {
+	done := make(chan bool, 1)
+	done <- true
+	fp := &failingPublisher{n: 10}
+	err := retry(failurePolicy{attempts: 10, backoff: time.Hour}, done, func() error {
+		return fp.publish("subject", nil)
+	})
+	assert.Equal(t, errStopped, err)
+	assert.Equal(t, 1, fp.calls)
+}
+
+func TestDispatcherRetriesTransientPublishFailure(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+
+	errs, fatal := new(collectedErrors), new(collectedErrors)
+	dispatcher, _ := NewDispatcher(ConsumerNameCallback,
+		WithDispatchPeriod(10*time.Millisecond),
+		WithRetry(3, time.Millisecond),
+		WithErrorHandler(errs.handler),
+		WithFatalHandler(fatal.handler),
+	)
+	fp := &failingPublisher{n: 2}
+	dispatcher.publish = fp.publish
+	assert.NoError(t, dispatcher.Run())
+	defer dispatcher.Shutdown()
+
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+	assert.NoError(t, nc.Publish(DefaultAnnouncements, EncodeTestAnnouncement(t, "consumer-1")))
+
+	assert.Eventually(t, func() bool { return fp.deliveredCount() > 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, errs.len())
+	assert.Equal(t, 0, fatal.len())
+}
+
+func TestDispatcherEscalatesAfterErrorBudget(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+
+	errs, fatal := new(collectedErrors), new(collectedErrors)
+	dispatcher, _ := NewDispatcher(ConsumerNameCallback,
+		WithDispatchPeriod(5*time.Millisecond),
+		WithRetry(1, time.Millisecond),
+		WithErrorBudget(3),
+		WithErrorHandler(func(err error) {
+			// The short period may make the loaded dispatcher miss rounds, they are reported but not counted in the budget
+			if !errors.Is(err, ErrMissedRounds) {
+				errs.handler(err)
+			}
+		}),
+		WithFatalHandler(fatal.handler),
+	)
+	fp := &failingPublisher{n: 1_000_000}
+	dispatcher.publish = fp.publish
+	assert.NoError(t, dispatcher.Run())
+	defer dispatcher.Shutdown()
+
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+	assert.NoError(t, nc.Publish(DefaultAnnouncements, EncodeTestAnnouncement(t, "consumer-1")))
+
+	// The process survives failures within the budget.
+	assert.Eventually(t, func() bool { return errs.len() >= 3 }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return fatal.len() >= 1 }, time.Second, time.Millisecond)
+	assert.ErrorIs(t, errs.get(0), errTestPublish)
+}
+
+func TestAnnouncerReportsPublishFailures(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+
+	errs, fatal := new(collectedErrors), new(collectedErrors)
+	a, err := NewAnnouncer(nc, WithPeriod(time.Hour), withFailurePolicy(failurePolicy{
+		onError:  errs.handler,
+		onFatal:  fatal.handler,
+		budget:   1,
+		attempts: 2,
+		backoff:  time.Millisecond,
+	}))
+	assert.NoError(t, err)
+	// Turn off automatic message sending
+	a.Stop()
+
+	fp := &failingPublisher{n: 3}
+	a.publish = fp.publish
+	assert.True(t, a.announceWithRetry())
+	assert.Equal(t, 1, errs.len())
+	assert.Equal(t, 0, fatal.len())
+	assert.True(t, a.announceWithRetry())
+	assert.Equal(t, 1, errs.len())
+	assert.Equal(t, 1, fp.deliveredCount())
+}
@@ -0,0 +1,262 @@
+package dispatcher
+
+import (
+	"github.com/google/uuid"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LeaseEvent describes the change of the lease state.
+type LeaseEvent struct {
+	// FailSafe is true when the leases of the last workloads have lapsed and no budget is available.
+	FailSafe bool
+	// At is the time of the change.
+	At time.Time
+}
+
+// LeaseHandler is called when the receiver enters or leaves the fail-safe mode.
+type LeaseHandler func(event LeaseEvent)
+
+// source is the last workload received from a dispatcher.
+type source struct {
+	lease      time.Time
+	allowances Allowances
+	base       Allowances
+	round      uint64
+	reclaim    string
+}
+
+// Leases keeps track of allowances received in workloads and their leases.
+// Workloads from different dispatchers (sources) are merged, a workload replaces only the allowances
+// of its own source. If more than one source allocates the same line item, the one with the latest lease wins.
+// When the leases of all sources lapse the Leases enter fail-safe mode, where no budget is available.
+type Leases struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	sources  map[string]source
+	failSafe bool
+	timer    *time.Timer
+	handler  LeaseHandler
+}
+
+// NewLeases creates Leases in fail-safe mode, the handler is optional.
+func NewLeases(handler LeaseHandler) *Leases {
+	return &Leases{
+		now:      time.Now,
+		sources:  map[string]source{},
+		failSafe: true,
+		handler:  handler,
+	}
+}
+
+// Update replaces the allowances of the workload source with ones from given workload.
+// A delta workload is applied over the last workload of the source, the adjustments made since are dropped.
+// It returns false and changes nothing if the delta is not relative to the last workload of the source,
+// then the full workload must be requested, or if the workload is from an older round of the source,
+// e.g. redelivered late, so it does not roll the lease back. The older round with a later lease is accepted,
+// the source has been restarted and numbers the rounds from the start.
+func (ls *Leases) Update(w Workload) bool {
+	ls.mu.Lock()
+	now := ls.now()
+	base := w.Allowances
+	if src, ok := ls.sources[w.Source]; ok && w.Round < src.round && !w.Lease.After(src.lease) {
+		ls.mu.Unlock()
+		return false
+	}
+	if w.IsDelta() {
+		src, ok := ls.sources[w.Source]
+		if !ok || src.round != w.Base {
+			ls.mu.Unlock()
+			return false
+		}
+		base = copyAllowances(src.base)
+		for id, a := range w.Allowances {
+			base[id] = a
+		}
+		for _, id := range w.Removed {
+			delete(base, id)
+		}
+	}
+	ls.sources[w.Source] = source{
+		lease:      w.Lease,
+		allowances: copyAllowances(base),
+		base:       base,
+		round:      w.Round,
+		reclaim:    w.Reclaim,
+	}
+	latest := w.Lease
+	for name, src := range ls.sources {
+		if !src.lease.After(now) {
+			delete(ls.sources, name)
+		} else if src.lease.After(latest) {
+			latest = src.lease
+		}
+	}
+	ls.schedule(latest)
+	event, changed := ls.check()
+	ls.mu.Unlock()
+	ls.emit(event, changed)
+	return true
+}
+
+// workload returns the full workload last received from the source, adjustments included.
+func (ls *Leases) workload(name string) (Workload, bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	src, ok := ls.sources[name]
+	if !ok {
+		return Workload{}, false
+	}
+	return src.workload(name), true
+}
+
+// workload returns the full workload of the source with given name.
+func (src source) workload(name string) Workload {
+	return Workload{
+		Source:     name,
+		Lease:      src.lease,
+		Allowances: copyAllowances(src.allowances),
+		Round:      src.round,
+		Reclaim:    src.reclaim,
+	}
+}
+
+// Workloads returns the full workloads of all sources with active leases, adjustments included.
+func (ls *Leases) Workloads() []Workload {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	now := ls.now()
+	res := make([]Workload, 0, len(ls.sources))
+	for name, src := range ls.sources {
+		if src.lease.After(now) {
+			res = append(res, src.workload(name))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Source < res[j].Source })
+	return res
+}
+
+// Available returns the allowance of given line item, it is zero when the lease has lapsed.
+func (ls *Leases) Available(id uuid.UUID) int64 {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	now := ls.now()
+	var allowance int64
+	var latest time.Time
+	for _, src := range ls.sources {
+		if a, ok := src.allowances[id]; ok && src.lease.After(now) && src.lease.After(latest) {
+			allowance, latest = a, src.lease
+		}
+	}
+	return allowance
+}
+
+// Allowances returns the merged allowances with active leases.
+func (ls *Leases) Allowances() Allowances {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	now := ls.now()
+	res := Allowances{}
+	leases := map[uuid.UUID]time.Time{}
+	for _, src := range ls.sources {
+		if !src.lease.After(now) {
+			continue
+		}
+		for id, a := range src.allowances {
+			if src.lease.After(leases[id]) {
+				res[id], leases[id] = a, src.lease
+			}
+		}
+	}
+	return res
+}
+
+// find returns the name of the active source the allowance of given line item comes from.
+func (ls *Leases) find(id uuid.UUID) (string, source, bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	now := ls.now()
+	var name string
+	var found source
+	for n, src := range ls.sources {
+		if _, ok := src.allowances[id]; ok && src.lease.After(now) && src.lease.After(found.lease) {
+			name, found = n, src
+		}
+	}
+	return name, found, !found.lease.IsZero()
+}
+
+// apply subtracts the returned and adds the granted allowances of the source.
+// The grant is ignored when the source has moved to another round in the meantime.
+func (ls *Leases) apply(name string, g Grant) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	src, ok := ls.sources[name]
+	if !ok || src.round != g.Round {
+		return
+	}
+	for id, amount := range g.Returned {
+		src.allowances[id] -= amount
+	}
+	for id, amount := range g.Granted {
+		src.allowances[id] += amount
+	}
+}
+
+// FailSafe tells whether the leases of all sources have lapsed.
+func (ls *Leases) FailSafe() bool {
+	ls.mu.Lock()
+	event, changed := ls.check()
+	failSafe := ls.failSafe
+	ls.mu.Unlock()
+	ls.emit(event, changed)
+	return failSafe
+}
+
+// Stop cancels the pending lease check.
+func (ls *Leases) Stop() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.timer != nil {
+		ls.timer.Stop()
+		ls.timer = nil
+	}
+}
+
+// schedule arranges the check at the time the lease expires, it must be called with the lock held.
+func (ls *Leases) schedule(expires time.Time) {
+	if ls.timer != nil {
+		ls.timer.Stop()
+	}
+	ls.timer = time.AfterFunc(expires.Sub(ls.now()), func() {
+		ls.mu.Lock()
+		event, changed := ls.check()
+		ls.mu.Unlock()
+		ls.emit(event, changed)
+	})
+}
+
+// check updates the fail-safe state and tells whether it has changed, it must be called with the lock held.
+func (ls *Leases) check() (LeaseEvent, bool) {
+	now := ls.now()
+	failSafe := true
+	for _, src := range ls.sources {
+		if src.lease.After(now) {
+			failSafe = false
+			break
+		}
+	}
+	if failSafe == ls.failSafe {
+		return LeaseEvent{}, false
+	}
+	ls.failSafe = failSafe
+	return LeaseEvent{FailSafe: failSafe, At: now}, true
+}
+
+// emit calls the handler if the state has changed, it must be called without the lock held.
+func (ls *Leases) emit(event LeaseEvent, changed bool) {
+	if changed && ls.handler != nil {
+		ls.handler(event)
+	}
+}
@@ -0,0 +1,183 @@
+package dispatcher
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLeases(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.UTC)
+	var events []LeaseEvent
+	ls := NewLeases(func(event LeaseEvent) {
+		events = append(events, event)
+	})
+	defer ls.Stop()
+	ls.now = func() time.Time { return now }
+	alice, bob := MakeTestLineItem("alice"), MakeTestLineItem("bob")
+
+	// No workload received yet.
+	assert.True(t, ls.FailSafe())
+	assert.Equal(t, int64(0), ls.Available(alice))
+	assert.Empty(t, events)
+
+	ls.Update(Workload{Lease: now.Add(time.Minute), Allowances: Allowances{alice: 10, bob: 20}})
+	assert.False(t, ls.FailSafe())
+	assert.Equal(t, int64(10), ls.Available(alice))
+	assert.Equal(t, Allowances{alice: 10, bob: 20}, ls.Allowances())
+	assert.Equal(t, []LeaseEvent{{FailSafe: false, At: now}}, events)
+
+	// The next workload replaces the allowances.
+	ls.Update(Workload{Lease: now.Add(time.Minute), Allowances: Allowances{bob: 5}})
+	assert.Equal(t, int64(0), ls.Available(alice))
+	assert.Equal(t, int64(5), ls.Available(bob))
+	assert.Len(t, events, 1)
+
+	// The lease lapses.
+	now = now.Add(time.Minute)
+	assert.True(t, ls.FailSafe())
+	assert.Equal(t, int64(0), ls.Available(bob))
+	assert.Empty(t, ls.Allowances())
+	assert.Equal(t, []LeaseEvent{{FailSafe: false, At: now.Add(-time.Minute)}, {FailSafe: true, At: now}}, events)
+}
+
+func TestLeasesMergesSources(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.UTC)
+	ls := NewLeases(nil)
+	defer ls.Stop()
+	ls.now = func() time.Time { return now }
+	alice, bob, charlie := MakeTestLineItem("alice"), MakeTestLineItem("bob"), MakeTestLineItem("charlie")
+
+	ls.Update(Workload{Source: "first", Lease: now.Add(time.Minute), Allowances: Allowances{alice: 1, bob: 2}})
+	ls.Update(Workload{Source: "second", Lease: now.Add(2 * time.Minute), Allowances: Allowances{charlie: 3}})
+	assert.Equal(t, Allowances{alice: 1, bob: 2, charlie: 3}, ls.Allowances())
+
+	// The line item moved between sources, the latest lease wins, so it is not allocated twice.
+	ls.Update(Workload{Source: "second", Lease: now.Add(2 * time.Minute), Allowances: Allowances{bob: 5, charlie: 3}})
+	assert.Equal(t, int64(5), ls.Available(bob))
+	assert.Equal(t, Allowances{alice: 1, bob: 5, charlie: 3}, ls.Allowances())
+
+	// The first source goes silent, only its line items lapse.
+	now = now.Add(time.Minute)
+	assert.False(t, ls.FailSafe())
+	assert.Equal(t, int64(0), ls.Available(alice))
+	assert.Equal(t, Allowances{bob: 5, charlie: 3}, ls.Allowances())
+
+	now = now.Add(time.Minute)
+	assert.True(t, ls.FailSafe())
+	assert.Empty(t, ls.Allowances())
+}
+
+func TestLeasesAppliesDeltas(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.UTC)
+	ls := NewLeases(nil)
+	defer ls.Stop()
+	ls.now = func() time.Time { return now }
+	alice, bob, charlie := MakeTestLineItem("alice"), MakeTestLineItem("bob"), MakeTestLineItem("charlie")
+	lease := now.Add(time.Minute)
+
+	// The delta needs the base.
+	assert.False(t, ls.Update(Workload{Lease: lease, Round: 2, Base: 1, Allowances: Allowances{alice: 1}}))
+	assert.Empty(t, ls.Allowances())
+
+	assert.True(t, ls.Update(Workload{Lease: lease, Round: 1, Allowances: Allowances{alice: 10, bob: 20}}))
+	// The adjustments are dropped by the next round.
+	ls.apply("", Grant{Round: 1, Granted: Allowances{bob: 5}})
+	assert.Equal(t, int64(25), ls.Available(bob))
+
+	assert.True(t, ls.Update(Workload{Lease: lease, Round: 2, Base: 1, Allowances: Allowances{charlie: 30}, Removed: []uuid.UUID{alice}}))
+	assert.Equal(t, Allowances{bob: 20, charlie: 30}, ls.Allowances())
+
+	// The delta relative to a missed round is not applied.
+	assert.False(t, ls.Update(Workload{Lease: lease, Round: 4, Base: 3, Allowances: Allowances{alice: 1}}))
+	assert.Equal(t, Allowances{bob: 20, charlie: 30}, ls.Allowances())
+}
+
+func TestLeasesRejectsStaleRounds(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.UTC)
+	ls := NewLeases(nil)
+	defer ls.Stop()
+	ls.now = func() time.Time { return now }
+	alice := MakeTestLineItem("alice")
+
+	assert.True(t, ls.Update(Workload{Lease: now.Add(time.Minute), Round: 1, Allowances: Allowances{alice: 10}}))
+	assert.True(t, ls.Update(Workload{Lease: now.Add(2 * time.Minute), Round: 2, Allowances: Allowances{alice: 20}}))
+
+	// The late redelivery of the older round does not roll the lease back.
+	assert.False(t, ls.Update(Workload{Lease: now.Add(time.Minute), Round: 1, Allowances: Allowances{alice: 10}}))
+	assert.Equal(t, int64(20), ls.Available(alice))
+	assert.Equal(t, now.Add(2*time.Minute), ls.Workloads()[0].Lease)
+
+	// The restarted source numbers the rounds from the start.
+	assert.True(t, ls.Update(Workload{Lease: now.Add(3 * time.Minute), Round: 1, Allowances: Allowances{alice: 30}}))
+	assert.Equal(t, int64(30), ls.Available(alice))
+}
+
+func TestLeasesEmptyWorkloadIsNotFailSafe(t *testing.T) {
+	ls := NewLeases(nil)
+	defer ls.Stop()
+	ls.Update(Workload{Lease: time.Now().Add(time.Hour), Allowances: Allowances{}})
+	assert.False(t, ls.FailSafe())
+	assert.Empty(t, ls.Allowances())
+}
+
+func TestLeasesEmitsFailSafeOnExpiry(t *testing.T) {
+	events := make(chan LeaseEvent, 2)
+	ls := NewLeases(func(event LeaseEvent) {
+		events <- event
+	})
+	defer ls.Stop()
+	ls.Update(Workload{Lease: time.Now().Add(10 * time.Millisecond), Allowances: Allowances{MakeTestLineItem("alice"): 1}})
+	assert.False(t, (<-events).FailSafe)
+	select {
+	case event := <-events:
+		assert.True(t, event.FailSafe)
+	case <-time.After(time.Second):
+		t.Fatal("fail-safe event has not been emitted")
+	}
+}
+
+func TestDecodeWorkload(t *testing.T) {
+	lease := time.Date(2023, 2, 17, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		args    string
+		want    Workload
+		wantErr bool
+	}{
+		{"full", `{"lease":"2023-02-17T00:00:00Z","allowances":{"` + MakeTestLineItem("alice").String() + `":3}}`, Workload{Lease: lease, Allowances: Allowances{MakeTestLineItem("alice"): 3}}, false},
+		{"no allowances", `{"lease":"2023-02-17T00:00:00Z"}`, Workload{Lease: lease, Allowances: Allowances{}}, false},
+		{"no lease", `{"allowances":{}}`, Workload{}, true},
+		{"not json", `workload`, Workload{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeWorkload([]byte(tt.args))
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLeasesWorkloads(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.UTC)
+	ls := NewLeases(nil)
+	defer ls.Stop()
+	ls.now = func() time.Time { return now }
+	alice, bob := MakeTestLineItem("alice"), MakeTestLineItem("bob")
+
+	first := Workload{Source: "first", Lease: now.Add(time.Minute), Round: 1, Allowances: Allowances{alice: 1}}
+	second := Workload{Source: "second", Lease: now.Add(2 * time.Minute), Round: 2, Allowances: Allowances{bob: 2}, Reclaim: "reclaim"}
+	ls.Update(second)
+	ls.Update(first)
+	assert.Equal(t, []Workload{first, second}, ls.Workloads())
+
+	// The lapsed workloads are not returned.
+	now = now.Add(time.Minute)
+	assert.Equal(t, []Workload{second}, ls.Workloads())
+}
@@ -0,0 +1,302 @@
+package dispatcher
+
+import (
+	"github.com/nats-io/nats.go"
+	"pacing.go/shared"
+	"time"
+)
+
+// options represents configurable options for Dispatcher and Receiver.
+type options struct {
+	url                 string
+	conn                *nats.Conn
+	announcements       string
+	announcementsPeriod time.Duration
+	ttl                 time.Duration
+	period              time.Duration
+	lease               time.Duration
+	leaseHandler        LeaseHandler
+	announcerOpts       []AnnouncementsOption
+	natsOpts            []nats.Option
+	nkeySeed            string
+	failures            failurePolicy
+	electionOpts        []ElectionOption
+	election            bool
+	sharding            bool
+	shardsOpts          []AnnouncementsOption
+	saveState           func() ([]byte, error)
+	restoreState        func(state []byte) error
+	requestTimeout      time.Duration
+	joinReserve         float64
+	offset              time.Duration
+	missedRounds        MissedRoundsPolicy
+	broadcast           string
+	deltas              bool
+	pullSubject         string
+	pullInterval        time.Duration
+	redeliveries        int
+}
+
+// Option allows to define configurable options of Dispatcher and Receiver.
+type Option func(opts *options)
+
+// WithURL configures the NATS server URL, it is ignored when the connection is provided with WithConn.
+func WithURL(url string) Option {
+	return func(opts *options) {
+		opts.url = url
+	}
+}
+
+// WithConn configures the NATS connection to use instead of creating a new one.
+// The connection is owned by the caller and is not closed on shutdown.
+func WithConn(nc *nats.Conn) Option {
+	return func(opts *options) {
+		opts.conn = nc
+	}
+}
+
+// WithAnnouncementsSubject configures the NATS subject used for announcements.
+func WithAnnouncementsSubject(subject string) Option {
+	return func(opts *options) {
+		opts.announcements = subject
+	}
+}
+
+// WithBroadcastSubject configures the NATS subject the workloads are published to in the broadcast mode.
+func WithBroadcastSubject(subject string) Option {
+	return func(opts *options) {
+		opts.broadcast = subject
+	}
+}
+
+// WithAnnouncementsPeriod configures the period between consecutive announcements made by Receiver.
+func WithAnnouncementsPeriod(period time.Duration) Option {
+	return func(opts *options) {
+		opts.announcementsPeriod = period
+	}
+}
+
+// WithConsumerTTL configures how long Dispatcher keeps the consumer after its last announcement.
+func WithConsumerTTL(ttl time.Duration) Option {
+	return func(opts *options) {
+		opts.ttl = ttl
+	}
+}
+
+// WithDispatchPeriod configures the period between consecutive dispatch rounds of Dispatcher.
+func WithDispatchPeriod(period time.Duration) Option {
+	return func(opts *options) {
+		opts.period = period
+	}
+}
+
+// WithDispatchOffset configures when the dispatch rounds take place relative to the slot start.
+// The rounds are aligned to the wall clock, e.g. with one minute period and 5 seconds offset
+// the rounds take place 5 seconds past every full minute.
+func WithDispatchOffset(offset time.Duration) Option {
+	return func(opts *options) {
+		opts.offset = offset
+	}
+}
+
+// WithMissedRounds configures what Dispatcher does when the time of a dispatch round has passed,
+// by default it catches up and dispatches the round of the current slot immediately.
+func WithMissedRounds(policy MissedRoundsPolicy) Option {
+	return func(opts *options) {
+		opts.missedRounds = policy
+	}
+}
+
+// WithLease configures for how long the workloads sent by Dispatcher are valid.
+// By default, the lease lasts two dispatch periods, so a single missed round does not stop the consumers.
+func WithLease(lease time.Duration) Option {
+	return func(opts *options) {
+		opts.lease = lease
+	}
+}
+
+// WithLeaseHandler configures the handler called when Receiver enters or leaves the fail-safe mode.
+func WithLeaseHandler(handler LeaseHandler) Option {
+	return func(opts *options) {
+		opts.leaseHandler = handler
+	}
+}
+
+// WithAnnouncerOptions configures the announcement metadata (ID, version, labels, etc.) published by Receiver.
+// The address configured with WithAddress is the one Receiver consumes workloads on, a new inbox is used if none provided.
+// A consumer restarted with the same ID and address keeps the allowances held at the address, e.g. it can return them.
+func WithAnnouncerOptions(announcerOpts ...AnnouncementsOption) Option {
+	return func(opts *options) {
+		opts.announcerOpts = append(opts.announcerOpts, announcerOpts...)
+	}
+}
+
+// WithErrorHandler configures the handler called with errors occurred in background routines.
+// By default, errors are logged.
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(opts *options) {
+		opts.failures.onError = handler
+	}
+}
+
+// WithFatalHandler configures the handler called when the error budget is exceeded.
+// By default, it panics and brings the process down.
+func WithFatalHandler(handler ErrorHandler) Option {
+	return func(opts *options) {
+		opts.failures.onFatal = handler
+	}
+}
+
+// WithErrorBudget configures the number of consecutive failures tolerated before the fatal handler is called.
+func WithErrorBudget(budget int) Option {
+	return func(opts *options) {
+		opts.failures.budget = budget
+	}
+}
+
+// WithRetry configures the number of attempts of a single publish and the delay before the first retry.
+// The delay doubles with every next retry.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(opts *options) {
+		opts.failures.attempts = attempts
+		opts.failures.backoff = backoff
+	}
+}
+
+// WithLeaderElection enables leader election among Dispatcher replicas, only the leader dispatches workloads.
+// The election requires JetStream enabled on the NATS server.
+func WithLeaderElection(electionOpts ...ElectionOption) Option {
+	return func(opts *options) {
+		opts.election = true
+		opts.electionOpts = append(opts.electionOpts, electionOpts...)
+	}
+}
+
+// WithSharding enables partitioning of line items among Dispatcher replicas, each dispatches only its own line items.
+// The options configure how the replicas announce themselves to each other, e.g. WithID sets the stable replica ID.
+func WithSharding(shardsOpts ...AnnouncementsOption) Option {
+	return func(opts *options) {
+		opts.sharding = true
+		opts.shardsOpts = append(opts.shardsOpts, shardsOpts...)
+	}
+}
+
+// WithStateHandoff configures how the Dispatcher state is handed over between leaders.
+// The state is saved before every dispatch round and restored when the replica becomes the leader.
+func WithStateHandoff(save func() ([]byte, error), restore func(state []byte) error) Option {
+	return func(opts *options) {
+		opts.saveState = save
+		opts.restoreState = restore
+	}
+}
+
+// WithRequestTimeout configures how long Receiver waits for the reply when it returns or asks for allowances.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(opts *options) {
+		opts.requestTimeout = timeout
+	}
+}
+
+// WithDeltaWorkloads makes Dispatcher send only the allowances changed since the previous round
+// to consumers which got it. The consumers which have missed a round request the full workload.
+// It does not apply to the broadcast mode.
+func WithDeltaWorkloads() Option {
+	return func(opts *options) {
+		opts.deltas = true
+	}
+}
+
+// WithPullSubject configures the NATS subject consumers pull their current workloads from.
+func WithPullSubject(subject string) Option {
+	return func(opts *options) {
+		opts.pullSubject = subject
+	}
+}
+
+// WithPullInterval configures the minimum time between consecutive pulls of a consumer,
+// Dispatcher rejects the pulls coming more often.
+func WithPullInterval(interval time.Duration) Option {
+	return func(opts *options) {
+		opts.pullInterval = interval
+	}
+}
+
+// WithRedeliveries configures how many times Receiver requests the redelivery of the workload its handler
+// has failed on, DefaultRedeliveries by default. Zero disables the redeliveries.
+func WithRedeliveries(redeliveries int) Option {
+	return func(opts *options) {
+		opts.redeliveries = redeliveries
+	}
+}
+
+// WithJoinReserve configures the fraction of every allowance Dispatcher keeps undispensed in a round.
+// Consumers joining in the middle of the round get their prorated share immediately from the reserve,
+// and consumers running out of budget may top up from it. By default, DefaultJoinReserve is reserved,
+// zero disables the reserve, then joining consumers may get only the allowances returned by others.
+func WithJoinReserve(fraction float64) Option {
+	return func(opts *options) {
+		opts.joinReserve = fraction
+	}
+}
+
+// newOptions applies given options over defaults.
+func newOptions(opts ...Option) *options {
+	configured := &options{joinReserve: DefaultJoinReserve, redeliveries: DefaultRedeliveries}
+	for _, opt := range opts {
+		opt(configured)
+	}
+	if configured.url == "" {
+		configured.url = nats.DefaultURL
+	}
+	if configured.announcements == "" {
+		configured.announcements = DefaultAnnouncements
+	}
+	if configured.broadcast == "" {
+		configured.broadcast = DefaultBroadcastSubject
+	}
+	if configured.pullSubject == "" {
+		configured.pullSubject = DefaultPullSubject
+	}
+	if configured.pullInterval <= 0 {
+		configured.pullInterval = DefaultPullInterval
+	}
+	if configured.announcementsPeriod <= 0 {
+		configured.announcementsPeriod = DefaultAnnouncementPeriod
+	}
+	if configured.ttl <= 0 {
+		configured.ttl = DefaultConsumerTTL
+	}
+	if configured.period <= 0 {
+		configured.period = DefaultDispatcherPeriod
+	}
+	if configured.offset < 0 || configured.offset >= configured.period {
+		configured.offset = 0
+	}
+	if configured.lease <= 0 {
+		configured.lease = 2 * configured.period
+	}
+	if configured.joinReserve < 0 || configured.joinReserve >= 1 {
+		configured.joinReserve = DefaultJoinReserve
+	}
+	if configured.requestTimeout <= 0 {
+		configured.requestTimeout = DefaultRequestTimeout
+	}
+	if configured.redeliveries < 0 {
+		configured.redeliveries = DefaultRedeliveries
+	}
+	return configured
+}
+
+// schedule returns the schedule of dispatch rounds.
+func (opts *options) schedule() schedule {
+	return schedule{period: opts.period, offset: opts.offset}
+}
+
+// failurePolicy returns the configured failure policy with defaults applied.
+func (opts *options) failurePolicy() failurePolicy {
+	policy := opts.failures.withDefaults()
+	if policy.onFatal == nil {
+		policy.onFatal = shared.PanicIf
+	}
+	return policy
+}
@@ -0,0 +1,134 @@
+package dispatcher
+
+import (
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNewOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		args []Option
+		want options
+	}{
+		{"defaults", nil, options{
+			url:                 nats.DefaultURL,
+			announcements:       DefaultAnnouncements,
+			broadcast:           DefaultBroadcastSubject,
+			pullSubject:         DefaultPullSubject,
+			pullInterval:        DefaultPullInterval,
+			announcementsPeriod: DefaultAnnouncementPeriod,
+			ttl:                 DefaultConsumerTTL,
+			period:              DefaultDispatcherPeriod,
+			lease:               2 * DefaultDispatcherPeriod,
+			requestTimeout:      DefaultRequestTimeout,
+			joinReserve:         DefaultJoinReserve,
+			redeliveries:        DefaultRedeliveries,
+		}},
+		{"custom", []Option{
+			WithURL("nats://example:4222"),
+			WithAnnouncementsSubject("test-announcements"),
+			WithBroadcastSubject("test-workloads"),
+			WithPullSubject("test-pull"),
+			WithPullInterval(6 * time.Millisecond),
+			WithAnnouncementsPeriod(time.Millisecond),
+			WithConsumerTTL(2 * time.Millisecond),
+			WithDispatchPeriod(3 * time.Millisecond),
+			WithLease(4 * time.Millisecond),
+			WithRequestTimeout(5 * time.Millisecond),
+			WithJoinReserve(0.25),
+			WithDispatchOffset(time.Millisecond),
+			WithMissedRounds(SkipMissedRounds),
+			WithDeltaWorkloads(),
+			WithRedeliveries(7),
+		}, options{
+			url:                 "nats://example:4222",
+			announcements:       "test-announcements",
+			broadcast:           "test-workloads",
+			pullSubject:         "test-pull",
+			pullInterval:        6 * time.Millisecond,
+			announcementsPeriod: time.Millisecond,
+			ttl:                 2 * time.Millisecond,
+			period:              3 * time.Millisecond,
+			lease:               4 * time.Millisecond,
+			requestTimeout:      5 * time.Millisecond,
+			joinReserve:         0.25,
+			offset:              time.Millisecond,
+			missedRounds:        SkipMissedRounds,
+			deltas:              true,
+			redeliveries:        7,
+		}},
+		{"disabled", []Option{
+			WithJoinReserve(0),
+			WithRedeliveries(0),
+		}, options{
+			url:                 nats.DefaultURL,
+			announcements:       DefaultAnnouncements,
+			broadcast:           DefaultBroadcastSubject,
+			pullSubject:         DefaultPullSubject,
+			pullInterval:        DefaultPullInterval,
+			announcementsPeriod: DefaultAnnouncementPeriod,
+			ttl:                 DefaultConsumerTTL,
+			period:              DefaultDispatcherPeriod,
+			lease:               2 * DefaultDispatcherPeriod,
+			requestTimeout:      DefaultRequestTimeout,
+		}},
+		{"invalid (zero)", []Option{
+			WithURL(""),
+			WithAnnouncementsSubject(""),
+			WithBroadcastSubject(""),
+			WithPullSubject(""),
+			WithPullInterval(0),
+			WithAnnouncementsPeriod(0),
+			WithConsumerTTL(0),
+			WithDispatchPeriod(0),
+			WithLease(0),
+			WithRequestTimeout(0),
+			WithJoinReserve(1),
+			WithDispatchOffset(-time.Millisecond),
+			WithRedeliveries(-1),
+		}, options{
+			url:                 nats.DefaultURL,
+			announcements:       DefaultAnnouncements,
+			broadcast:           DefaultBroadcastSubject,
+			pullSubject:         DefaultPullSubject,
+			pullInterval:        DefaultPullInterval,
+			announcementsPeriod: DefaultAnnouncementPeriod,
+			ttl:                 DefaultConsumerTTL,
+			period:              DefaultDispatcherPeriod,
+			lease:               2 * DefaultDispatcherPeriod,
+			requestTimeout:      DefaultRequestTimeout,
+			joinReserve:         DefaultJoinReserve,
+			redeliveries:        DefaultRedeliveries,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, *newOptions(tt.args...))
+		})
+	}
+}
+
+func TestOptionsConnect(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+	broken := MakeTestConnection(t)
+	broken.Close()
+
+	got, owned, err := newOptions(WithConn(nc)).connect()
+	assert.NoError(t, err)
+	assert.Same(t, nc, got)
+	assert.False(t, owned)
+
+	_, _, err = newOptions(WithConn(broken)).connect()
+	assert.Error(t, err)
+
+	got, owned, err = newOptions().connect()
+	assert.NoError(t, err)
+	assert.True(t, owned)
+	got.Close()
+}
@@ -0,0 +1,128 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"sync"
+	"time"
+)
+
+// DefaultPullSubject is the NATS subject consumers pull their current workloads from.
+const DefaultPullSubject = "workloads.pull"
+
+// DefaultPullInterval is the minimum time between consecutive pulls of a consumer.
+const DefaultPullInterval = time.Second
+
+// ErrPullRejected is returned by Pull when a dispatcher rejects the pull, e.g. when it is rate limited.
+var ErrPullRejected = errors.New("pull rejected")
+
+// PullRequest is the request for the current workload sent by a consumer to the pull subject.
+// The consumer is identified by its announcement, only the consumers observed by the dispatcher are served.
+type PullRequest struct {
+	// ID is the identifier of the consumer announced.
+	ID string `json:"id"`
+	// Consumer is the address of the consumer announced.
+	Consumer string `json:"consumer"`
+}
+
+// PullReply is the reply of every dispatcher to PullRequest.
+// The workload carries the allowances the consumer holds in the current round, it never grants more.
+type PullReply struct {
+	Workload
+	// Sources is the number of dispatchers sharing the line items, i.e. the number of replies to expect.
+	Sources int `json:"sources"`
+	// Error describes why the pull has been rejected, the workload is empty then.
+	Error string `json:"error,omitempty"`
+}
+
+// pullLimiter limits how often a consumer may pull its workload.
+type pullLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func newPullLimiter(interval time.Duration) *pullLimiter {
+	return &pullLimiter{interval: interval, last: map[string]time.Time{}}
+}
+
+// allow tells whether the consumer may pull now, it records the pull if so.
+// The pulls older than the interval are forgotten, so the limiter does not grow with consumers churning.
+func (l *pullLimiter) allow(consumer string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.last[consumer]; ok && now.Sub(last) < l.interval {
+		return false
+	}
+	for c, last := range l.last {
+		if now.Sub(last) >= l.interval {
+			delete(l.last, c)
+		}
+	}
+	l.last[consumer] = now
+	return true
+}
+
+// sources returns the number of dispatchers sharing the line items.
+func (d *Dispatcher) sources() int {
+	if d.shards == nil {
+		return 1
+	}
+	return len(d.shards.Members())
+}
+
+// pull replies with the current workload to the observed consumer. Only the leader replies, and nothing
+// is replied before the first round, then the consumer gets its workload when the round takes place.
+func (d *Dispatcher) pull(msg *nats.Msg) {
+	var req PullRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		d.budget.policy.onError(fmt.Errorf("cannot decode pull request: %w", err))
+		return
+	}
+	if !d.IsLeader() {
+		return
+	}
+	w, _ := d.pool.current(req.Consumer)
+	if w.Round == 0 {
+		return
+	}
+	reply := PullReply{Workload: w, Sources: d.sources()}
+	switch {
+	case !d.observed(req.ID, req.Consumer):
+		reply = PullReply{Workload: Workload{Source: w.Source}, Sources: reply.Sources, Error: "consumer is not observed"}
+	case !d.limiter.allow(req.ID, d.now()):
+		reply = PullReply{Workload: Workload{Source: w.Source}, Sources: reply.Sources, Error: "too many pulls"}
+	}
+	enc, err := json.Marshal(reply)
+	if err == nil {
+		err = msg.Respond(enc)
+	}
+	if err != nil {
+		d.budget.policy.onError(fmt.Errorf("cannot reply to pull request of consumer %s: %w", req.Consumer, err))
+	}
+}
+
+// observed tells whether the consumer has announced itself with given ID and address.
+func (d *Dispatcher) observed(id string, address string) bool {
+	return d.observer.Announced(id, address)
+}
+
+// DecodePullReply decodes the pull reply, the workload is validated unless the pull was rejected.
+func DecodePullReply(data []byte) (PullReply, error) {
+	var reply PullReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return PullReply{}, err
+	}
+	if reply.Error != "" {
+		return reply, nil
+	}
+	if reply.Lease.IsZero() {
+		return PullReply{}, fmt.Errorf("workload has no lease")
+	}
+	if reply.Allowances == nil {
+		reply.Allowances = Allowances{}
+	}
+	return reply, nil
+}
@@ -0,0 +1,122 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPullLimiter(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.UTC)
+	l := newPullLimiter(time.Second)
+	tests := []struct {
+		name     string
+		consumer string
+		after    time.Duration
+		want     bool
+	}{
+		{"first pull", "alice", 0, true},
+		{"other consumer", "bob", 0, true},
+		{"too early", "alice", 500 * time.Millisecond, false},
+		{"rejected pull does not count", "alice", 1000 * time.Millisecond, true},
+		{"after interval", "bob", 1000 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, l.allow(tt.consumer, now.Add(tt.after)))
+		})
+	}
+}
+
+func TestPull(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+	lineItem := MakeTestLineItem("line-item")
+
+	cc := &changingCallback{allowances: Allowances{lineItem: 10}}
+	dispatcher, _ := NewDispatcher(cc.callback,
+		WithDispatchPeriod(time.Hour),
+		WithJoinReserve(0),
+		WithMissedRounds(SkipMissedRounds),
+		WithPullInterval(time.Hour),
+	)
+	dispatcher.trigger = make(chan struct{})
+	assert.Nil(t, dispatcher.Run())
+	defer dispatcher.Shutdown()
+
+	ws := new(workloads)
+	receiver, _ := NewReceiver(collect(ws), WithRequestTimeout(100*time.Millisecond))
+	assert.Error(t, receiver.Pull())
+	assert.Nil(t, receiver.Run())
+	defer func() { _ = receiver.Shutdown() }()
+	assert.Eventually(t, func() bool { return len(dispatcher.Consumers()) == 1 }, time.Second, Delay)
+
+	// Nothing to pull before the first round.
+	assert.Error(t, receiver.Pull())
+
+	dispatcher.trigger <- struct{}{}
+	assert.Eventually(t, func() bool { return ws.len() == 1 }, time.Second, Delay)
+	// The pull returns the allowances held in the round, including the adjustments.
+	receiver.leases.apply("", Grant{Round: 1, Returned: Allowances{lineItem: 10}})
+	assert.Equal(t, int64(0), receiver.Available(lineItem))
+	assert.NoError(t, receiver.Pull())
+	assert.Equal(t, 2, ws.len())
+	assert.Equal(t, int64(10), receiver.Available(lineItem))
+
+	// The pulls are rate limited.
+	assert.ErrorIs(t, receiver.Pull(), ErrPullRejected)
+
+	// Only announced consumers are served.
+	enc, _ := json.Marshal(PullRequest{ID: "mallory", Consumer: receiver.Address()})
+	msg, err := nc.Request(DefaultPullSubject, enc, time.Second)
+	assert.NoError(t, err)
+	reply, err := DecodePullReply(msg.Data)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, reply.Error)
+	assert.Empty(t, reply.Allowances)
+}
+
+func TestPullCollectsRejections(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+	lineItem := MakeTestLineItem("line-item")
+
+	cc := &changingCallback{allowances: Allowances{lineItem: 10}}
+	dispatcher, _ := NewDispatcher(cc.callback,
+		WithDispatchPeriod(time.Hour),
+		WithMissedRounds(SkipMissedRounds),
+		WithPullInterval(time.Hour),
+	)
+	dispatcher.trigger = make(chan struct{})
+	assert.Nil(t, dispatcher.Run())
+	defer dispatcher.Shutdown()
+
+	// Another shard rejects every pull.
+	_, err := nc.Subscribe(DefaultPullSubject, func(msg *nats.Msg) {
+		enc, _ := json.Marshal(PullReply{Workload: Workload{Source: "other"}, Sources: 2, Error: "too many pulls"})
+		_ = msg.Respond(enc)
+	})
+	assert.NoError(t, err)
+
+	ws := new(workloads)
+	receiver, _ := NewReceiver(collect(ws), WithRequestTimeout(100*time.Millisecond))
+	assert.Nil(t, receiver.Run())
+	defer func() { _ = receiver.Shutdown() }()
+	assert.Eventually(t, func() bool { return len(dispatcher.Consumers()) == 1 }, time.Second, Delay)
+	dispatcher.trigger <- struct{}{}
+	assert.Eventually(t, func() bool { return ws.len() == 1 }, time.Second, Delay)
+
+	// The workload served by one shard is enough.
+	assert.NoError(t, receiver.Pull())
+	assert.Equal(t, 2, ws.len())
+
+	// The pull fails when every shard rejects it.
+	assert.ErrorIs(t, receiver.Pull(), ErrPullRejected)
+	assert.Equal(t, 2, ws.len())
+}
@@ -1,87 +1,552 @@
 package dispatcher
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
-	"pacing.go/shared"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ConsumeCallback is called with the encoded full workload, see WorkloadHandler for the typed one.
 type ConsumeCallback func(w string)
 
+// Delivery is the metadata of the delivered workload.
+type Delivery struct {
+	// Subject is the NATS subject the workload was received on, empty for restored and adjusted workloads.
+	Subject string
+	// Header is the header of the NATS message, if any.
+	Header nats.Header
+	// ReceivedAt is the time the workload was received.
+	ReceivedAt time.Time
+	// Attempt is 1 for the first delivery of the workload and greater for its redeliveries.
+	Attempt int
+}
+
+// WorkloadHandler processes the full workload, a delta one is applied over the last workload of its source beforehand.
+// The workload is passed again with the adjusted allowances when they are returned or topped up, see Receiver.Return.
+// When it returns an error, Receiver requests the redelivery of the workload from its source, the current one
+// if the workload does not support it, and calls the handler again in the background. The pending redelivery
+// is dropped when the next workload of the source arrives. The failures are logged with the error handler
+// after the redeliveries are exhausted, see Receiver.Failures.
+type WorkloadHandler func(w Workload, d Delivery) error
+
+// ErrNotAdjustable is returned when the allowance of the line item cannot be returned or topped up,
+// because no active workload allocates it or its dispatcher does not support adjustments.
+var ErrNotAdjustable = errors.New("allowance of the line item is not adjustable")
+
+// Receiver announces itself on the announcements subject and consumes workloads sent to its address.
 type Receiver struct {
-	url                 string
-	announcements       string
-	announcementsPeriod time.Duration
-	ccb                 ConsumeCallback
+	opts     *options
+	handler  WorkloadHandler
+	failures atomic.Int64
+
+	mu      sync.Mutex
+	sources map[string]*delivery
+	done    chan struct{}
+	wg      sync.WaitGroup
 
-	conn         *nats.Conn
-	inbox        string
-	announcement []byte
-	done         chan byte
-	sub          *nats.Subscription
+	conn      *nats.Conn
+	ownsConn  bool
+	inbox     string
+	sub       *nats.Subscription
+	bsub      *nats.Subscription
+	announcer *Announcer
+	leases    *Leases
+}
+
+// NewReceiver creates new Receiver instance.
+// Configurable options are:
+// - WithURL or WithConn,
+// - WithAnnouncementsSubject,
+// - WithAnnouncementsPeriod,
+// - WithBroadcastSubject,
+// - WithAnnouncerOptions,
+// - WithLeaseHandler,
+// - WithRequestTimeout and WithPullSubject,
+// - WithErrorHandler, WithFatalHandler, WithErrorBudget and WithRetry (applied to announcements).
+func NewReceiver(ccb ConsumeCallback, opts ...Option) (*Receiver, error) {
+	if ccb == nil {
+		return nil, fmt.Errorf("consume callback is required argument")
+	}
+	return NewWorkloadReceiver(func(w Workload, _ Delivery) error {
+		enc, err := json.Marshal(w)
+		if err != nil {
+			return fmt.Errorf("cannot encode workload: %w", err)
+		}
+		ccb(string(enc))
+		return nil
+	}, opts...)
 }
 
-func NewReceiver(ccb func(workload string)) (*Receiver, error) {
+// NewWorkloadReceiver creates new Receiver instance passing the decoded workloads to given handler.
+// Configurable options are the ones of NewReceiver and WithRedeliveries.
+func NewWorkloadReceiver(handler WorkloadHandler, opts ...Option) (*Receiver, error) {
+	if handler == nil {
+		return nil, fmt.Errorf("workload handler is required argument")
+	}
+	options := newOptions(opts...)
 	return &Receiver{
-		url:                 nats.DefaultURL,
-		announcements:       DefaultAnnouncements,
-		announcementsPeriod: DefaultAnnouncementPeriod,
-		ccb:                 ccb,
+		opts:    options,
+		handler: handler,
+		leases:  NewLeases(options.leaseHandler),
+		sources: make(map[string]*delivery),
+		done:    make(chan struct{}),
 	}, nil
 }
 
 func (r *Receiver) Run() error {
 	var err error
 	// Bootstrap resources
-	r.conn, err = nats.Connect(r.url)
+	r.conn, r.ownsConn, err = r.opts.connect()
 	if err != nil {
 		return err
 	}
-	if !r.conn.IsConnected() {
-		return errors.New(fmt.Sprintf("Cannot connect, connection status is %s\n", r.conn.Status()))
-	}
-	r.inbox = nats.NewInbox()
-	// Subscribe for workloads
-	r.sub, err = r.conn.Subscribe(r.inbox, func(msg *nats.Msg) {
-		r.ccb(string(msg.Data))
-	})
-	// Run processes
-	r.announcement = []byte(r.inbox)
-	r.done = make(chan byte)
-	go r.Announcer(r.done)
+	// The address configured with the announcer options is kept, e.g. to resume the leases held before a restart
+	announced := &announcementsOptions{}
+	for _, opt := range r.opts.announcerOpts {
+		opt(announced)
+	}
+	r.inbox = announced.address
+	if r.inbox == "" {
+		r.inbox = nats.NewInbox()
+	}
+	// Subscribe for workloads before the address is announced
+	r.sub, err = r.conn.Subscribe(r.inbox, r.receive)
+	if err == nil {
+		r.bsub, err = r.conn.Subscribe(r.opts.broadcast, r.receiveBroadcast)
+	}
+	if err == nil {
+		err = r.conn.Flush()
+	}
+	if err != nil {
+		_ = r.Shutdown()
+		return err
+	}
+	// Run processes, the first announcement is sent immediately
+	announcerOpts := append([]AnnouncementsOption{
+		WithSubject(r.opts.announcements),
+		WithPeriod(r.opts.announcementsPeriod),
+	}, r.opts.announcerOpts...)
+	announcerOpts = append(announcerOpts, WithAddress(r.inbox), withFailurePolicy(r.opts.failurePolicy()))
+	r.announcer, err = NewAnnouncer(r.conn, announcerOpts...)
+	if err != nil {
+		_ = r.Shutdown()
+		return err
+	}
 	return nil
 }
 
-func (r *Receiver) Announcer(done <-chan byte) {
-	var err error
-	ticker := time.NewTicker(r.announcementsPeriod)
+// receive tracks the lease of the workload and passes it to the handler.
+// A delta workload is applied over the last workload of its source, the full one is requested if a round was missed.
+func (r *Receiver) receive(msg *nats.Msg) {
+	w, err := DecodeWorkload(msg.Data)
+	if err != nil {
+		r.opts.failurePolicy().onError(fmt.Errorf("cannot decode workload: %w", err))
+		return
+	}
+	d := Delivery{Subject: msg.Subject, Header: msg.Header, ReceivedAt: time.Now()}
+	if !w.IsDelta() {
+		if r.leases.Update(w) {
+			r.deliver(w, d)
+		}
+		return
+	}
+	// The delta is passed to the handler as the full workload of its source
+	if !r.leases.Update(w) {
+		if w, err = r.sync(w); err != nil {
+			r.opts.failurePolicy().onError(fmt.Errorf("cannot resync after missed workload: %w", err))
+			return
+		}
+		r.leases.Update(w)
+	}
+	full, _ := r.leases.workload(w.Source)
+	r.deliver(full, d)
+}
+
+// delivery serializes the handling of the workloads of a single source.
+type delivery struct {
+	sync.Mutex
+	// stale is closed when the next workload of the source arrives, it drops the pending redelivery.
+	stale chan struct{}
+}
+
+// source returns the delivery of the workloads of given source.
+func (r *Receiver) source(name string) *delivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sources[name]
+	if !ok {
+		s = &delivery{}
+		r.sources[name] = s
+	}
+	return s
+}
+
+// deliver passes the full workload to the handler and drops the pending redelivery of its source.
+// The workload the handler has failed on is redelivered in the background with the backoff of the failure policy.
+func (r *Receiver) deliver(w Workload, d Delivery) {
+	s := r.source(w.Source)
+	s.Lock()
+	defer s.Unlock()
+	r.handle(s, w, d)
+}
+
+// deliverAdjusted passes the workload of the source with the adjusted allowances to the handler,
+// so the returned allowance is not spent anymore and the granted one is. It is skipped when the source
+// has moved to another round in the meantime, the next workload has replaced the adjusted one.
+func (r *Receiver) deliverAdjusted(name string, round uint64) {
+	s := r.source(name)
+	s.Lock()
+	defer s.Unlock()
+	w, ok := r.leases.workload(name)
+	if !ok || w.Round != round {
+		return
+	}
+	r.handle(s, w, Delivery{ReceivedAt: time.Now()})
+}
+
+// handle calls the handler and schedules the redelivery if it fails, it must be called with the lock of the source held.
+func (r *Receiver) handle(s *delivery, w Workload, d Delivery) {
+	if s.stale != nil {
+		close(s.stale)
+		s.stale = nil
+	}
+	d.Attempt = 1
+	err := r.handler(w, d)
+	if err == nil {
+		return
+	}
+	if d.Attempt <= r.opts.redeliveries && r.redeliverAsync(s, w, d) {
+		return
+	}
+	r.fail(w, d, err)
+}
+
+// redeliverAsync starts the background redelivery, it returns false if the receiver has been shut down.
+// The redelivery is started under the lock Shutdown closes done with, so Shutdown waits for it.
+func (r *Receiver) redeliverAsync(s *delivery, w Workload, d Delivery) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.done:
+		return false
+	default:
+	}
+	s.stale = make(chan struct{})
+	r.wg.Add(1)
+	go r.redeliverLater(s, s.stale, w, d)
+	return true
+}
+
+// redeliverLater redelivers the workload until the handler succeeds, the redeliveries are exhausted,
+// the next workload of the source arrives or the receiver is shut down.
+func (r *Receiver) redeliverLater(s *delivery, stale chan struct{}, w Workload, d Delivery) {
+	defer r.wg.Done()
+	policy := r.opts.failurePolicy().withDefaults()
+	backoff := policy.backoff
 	for {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-stale:
+			timer.Stop()
+			return
+		case <-r.done:
+			timer.Stop()
+			return
+		}
+		backoff *= 2
+		// The request is sent without the lock, so the next workload of the source is not held up.
+		full := r.redeliver(w)
+		s.Lock()
 		select {
-		case <-ticker.C:
-			err = r.conn.Publish(r.announcements, r.announcement)
-			shared.PanicIf(err)
-		case <-done:
-			ticker.Stop()
+		case <-stale:
+			s.Unlock()
 			return
+		default:
+		}
+		d.Attempt++
+		err := r.handler(full, d)
+		if err == nil || d.Attempt > r.opts.redeliveries {
+			s.stale = nil
+			s.Unlock()
+			if err != nil {
+				r.fail(full, d, err)
+			}
+			return
+		}
+		s.Unlock()
+	}
+}
+
+// fail counts and reports the workload the handler has failed on.
+func (r *Receiver) fail(w Workload, d Delivery, err error) {
+	r.failures.Add(1)
+	r.opts.failurePolicy().onError(fmt.Errorf("cannot handle workload of round %d from %q after %d attempts: %w", w.Round, w.Source, d.Attempt, err))
+}
+
+// redeliver requests the full workload of the current round from the source of given workload.
+// It returns given workload if the source does not support it or the request fails.
+func (r *Receiver) redeliver(w Workload) Workload {
+	if w.Resync == "" || r.conn == nil {
+		return w
+	}
+	full, err := r.sync(w)
+	if err != nil {
+		r.opts.failurePolicy().onError(fmt.Errorf("cannot request redelivery: %w", err))
+		return w
+	}
+	r.leases.Update(full)
+	return full
+}
+
+// Failures returns the number of workloads the handler has failed on, after their redeliveries.
+func (r *Receiver) Failures() int64 {
+	return r.failures.Load()
+}
+
+// sync requests the full workload of the current round from the source of given delta.
+func (r *Receiver) sync(delta Workload) (Workload, error) {
+	if delta.Resync == "" {
+		return Workload{}, fmt.Errorf("workload of round %d has no resync subject", delta.Round)
+	}
+	enc, err := json.Marshal(SyncRequest{Consumer: r.inbox})
+	if err != nil {
+		return Workload{}, err
+	}
+	msg, err := r.conn.Request(delta.Resync, enc, r.opts.requestTimeout)
+	if err != nil {
+		return Workload{}, err
+	}
+	w, err := DecodeWorkload(msg.Data)
+	if err != nil {
+		return Workload{}, err
+	}
+	if w.IsDelta() {
+		return Workload{}, fmt.Errorf("resync of round %d replied with delta", delta.Round)
+	}
+	return w, nil
+}
+
+// receiveBroadcast computes the receiver's own workload from the broadcast and passes it to the handler.
+// The broadcast is ignored if the receiver is not among its consumers, it gets the workload when it joins.
+func (r *Receiver) receiveBroadcast(msg *nats.Msg) {
+	b, err := DecodeBroadcast(msg.Data)
+	if err != nil {
+		r.opts.failurePolicy().onError(fmt.Errorf("cannot decode broadcast: %w", err))
+		return
+	}
+	w, ok := b.Workload(r.inbox)
+	if !ok {
+		return
+	}
+	if r.leases.Update(w) {
+		r.deliver(w, Delivery{Subject: msg.Subject, Header: msg.Header, ReceivedAt: time.Now()})
+	}
+}
+
+// Pull requests the current workloads from the dispatchers, e.g. after a restart, instead of waiting for the next round.
+// The dispatchers reply with the allowances the receiver holds in the current round, the replies are passed
+// to the handler as workloads. It waits for the replies of all dispatchers sharing the line items,
+// at most the request timeout. Dispatchers reject the pulls of unannounced consumers and too frequent ones,
+// the rejections are returned only if no dispatcher has served the pull.
+func (r *Receiver) Pull() error {
+	if r.conn == nil || r.announcer == nil {
+		return fmt.Errorf("receiver is not running")
+	}
+	enc, err := json.Marshal(PullRequest{ID: r.announcer.ID(), Consumer: r.inbox})
+	if err != nil {
+		return err
+	}
+	inbox := nats.NewInbox()
+	sub, err := r.conn.SubscribeSync(inbox)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+	if err = r.conn.PublishRequest(r.opts.pullSubject, inbox, enc); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(r.opts.requestTimeout)
+	replied := map[string]bool{}
+	var sources, pulled int
+	var errs []error
+	for {
+		msg, err := sub.NextMsg(time.Until(deadline))
+		if err != nil {
+			if len(errs) == 0 {
+				errs = append(errs, fmt.Errorf("cannot pull workload: %w", err))
+			}
+			break
+		}
+		reply, err := DecodePullReply(msg.Data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot decode pull reply: %w", err))
+			continue
+		}
+		replied[reply.Source] = true
+		if reply.Sources > sources {
+			sources = reply.Sources
+		}
+		if reply.Error != "" {
+			errs = append(errs, fmt.Errorf("%w by %q: %s", ErrPullRejected, reply.Source, reply.Error))
+		} else {
+			pulled++
+			if r.leases.Update(reply.Workload) {
+				r.deliver(reply.Workload, Delivery{Subject: msg.Subject, Header: msg.Header, ReceivedAt: time.Now()})
+			}
 		}
+		if len(replied) >= sources {
+			break
+		}
+	}
+	if pulled > 0 {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// Drain announces the receiver as draining, so dispatchers stop allocating to it from the next round.
+// The allowances received so far are kept until their leases lapse, see Return to give them back sooner.
+func (r *Receiver) Drain() error {
+	if r.announcer == nil {
+		return fmt.Errorf("receiver is not running")
 	}
+	return r.announcer.Drain()
+}
+
+// Workloads returns the last full workloads of all sources with active leases, e.g. to persist them across restarts.
+func (r *Receiver) Workloads() []Workload {
+	return r.leases.Workloads()
 }
 
+// Restore tracks the leases of given workloads, e.g. persisted before a restart, and passes them to the handler.
+// The workloads with lapsed leases are skipped, the restored ones are replaced by the next workloads of their sources.
+func (r *Receiver) Restore(workloads []Workload) {
+	now := r.leases.now()
+	for _, w := range workloads {
+		if !w.Lease.After(now) || w.IsDelta() {
+			continue
+		}
+		if r.leases.Update(w) {
+			r.deliver(w, Delivery{ReceivedAt: time.Now()})
+		}
+	}
+}
+
+// Available returns the allowance of given line item, it is zero when the lease has lapsed.
+func (r *Receiver) Available(id uuid.UUID) int64 {
+	return r.leases.Available(id)
+}
+
+// Allowances returns the allowances with active leases.
+func (r *Receiver) Allowances() Allowances {
+	return r.leases.Allowances()
+}
+
+// Return gives the unused allowance of the line item back to its dispatcher, which can reallocate it to other consumers.
+// It returns the amount accepted back, the receiver must not spend it anymore.
+// The workload with the reduced allowance is passed to the handler before it returns.
+func (r *Receiver) Return(id uuid.UUID, amount int64) (int64, error) {
+	g, err := r.adjust(id, Adjustment{Returned: Allowances{id: amount}})
+	return g.Returned[id], err
+}
+
+// TopUp asks the dispatcher of the line item for more allowance, it returns the amount granted.
+// The dispatcher grants only what other consumers have returned in the current round, so it may be less than requested.
+// The workload with the increased allowance is passed to the handler before it returns.
+func (r *Receiver) TopUp(id uuid.UUID, amount int64) (int64, error) {
+	g, err := r.adjust(id, Adjustment{Requested: Allowances{id: amount}})
+	return g.Granted[id], err
+}
+
+// adjust sends the adjustment to the dispatcher of the line item and applies its grant to the leases.
+func (r *Receiver) adjust(id uuid.UUID, a Adjustment) (Grant, error) {
+	name, src, ok := r.leases.find(id)
+	if !ok || src.reclaim == "" || r.conn == nil || r.announcer == nil {
+		return Grant{}, ErrNotAdjustable
+	}
+	a.ID, a.Consumer, a.Round = r.announcer.ID(), r.Address(), src.round
+	enc, err := json.Marshal(a)
+	if err != nil {
+		return Grant{}, err
+	}
+	msg, err := r.conn.Request(src.reclaim, enc, r.opts.requestTimeout)
+	if err != nil {
+		return Grant{}, fmt.Errorf("cannot adjust allowance of line item %s: %w", id, err)
+	}
+	g, err := DecodeGrant(msg.Data)
+	if err != nil {
+		return Grant{}, fmt.Errorf("cannot decode grant: %w", err)
+	}
+	if g.Error != "" {
+		return Grant{}, fmt.Errorf("%w: %s", ErrAdjustmentRejected, g.Error)
+	}
+	r.leases.apply(name, g)
+	r.deliverAdjusted(name, g.Round)
+	return g, nil
+}
+
+// FailSafe tells whether the leases of the last workloads have lapsed, then no budget is available.
+// The receiver is in fail-safe mode until the first workload arrives.
+func (r *Receiver) FailSafe() bool {
+	return r.leases.FailSafe()
+}
+
+// Address returns the address the receiver consumes workloads on, it is empty until Run is called.
+func (r *Receiver) Address() string {
+	return r.inbox
+}
+
+// ID returns the ID the receiver announces itself with, it is empty until Run is called.
+func (r *Receiver) ID() string {
+	if r.announcer == nil {
+		return ""
+	}
+	return r.announcer.ID()
+}
+
+// Conn returns the NATS connection of the receiver, it is nil until Run is called.
+// The connection is closed on shutdown unless it has been provided with WithConn.
+func (r *Receiver) Conn() *nats.Conn {
+	return r.conn
+}
+
+// Shutdown stops the receiver, the subsequent calls do nothing.
+// The connection and the announcer are kept, so the NATS callbacks still running do not race with it.
 func (r *Receiver) Shutdown() error {
 	var err error
 	// Shutdown processes
-	if r.done != nil {
-		r.done <- 1
+	r.mu.Lock()
+	select {
+	case <-r.done:
+		r.mu.Unlock()
+		return nil
+	default:
 		close(r.done)
-		r.done = nil
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	r.leases.Stop()
+	if r.announcer != nil {
+		r.announcer.Stop()
 	}
 	// Free resources
+	if r.bsub != nil && r.bsub.IsValid() {
+		err = r.bsub.Unsubscribe()
+	}
+	r.bsub = nil
 	if r.sub != nil && r.sub.IsValid() {
-		err = r.sub.Unsubscribe()
+		if uerr := r.sub.Unsubscribe(); err == nil {
+			err = uerr
+		}
 	}
-	if r.conn != nil {
+	r.sub = nil
+	if r.conn != nil && r.ownsConn {
 		r.conn.Close()
 	}
 	return err
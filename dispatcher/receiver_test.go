@@ -1,8 +1,10 @@
 package dispatcher
 
 import (
+	"encoding/json"
 	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -22,6 +24,12 @@ func (ws *workloads) get(i int) string {
 	return ws.ws[i]
 }
 
+func (ws *workloads) len() int {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return len(ws.ws)
+}
+
 // collect creates a callback and a pointer where the workload is stored once callback is invoked.
 func collect(ws *workloads) func(w string) {
 	return func(w string) {
@@ -56,6 +64,13 @@ func TestNewReceiver(t *testing.T) {
 	}()
 
 	assert.Nil(t, receiver.conn)
+	assert.Empty(t, receiver.Address())
+}
+
+func TestNewReceiverRequiresCallback(t *testing.T) {
+	receiver, err := NewReceiver(nil)
+	assert.Error(t, err)
+	assert.Nil(t, receiver)
 }
 
 func TestRunReceiver(t *testing.T) {
@@ -72,14 +87,38 @@ func TestRunReceiver(t *testing.T) {
 	assert.Nil(t, err)
 
 	assert.True(t, receiver.conn.IsConnected())
-	assert.NotEmpty(t, receiver.inbox)
+	assert.NotEmpty(t, receiver.Address())
+}
+
+func TestReceiverWithConn(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+
+	receiver, _ := NewReceiver(nop, WithConn(nc))
+	assert.Nil(t, receiver.Run())
+	assert.Nil(t, receiver.Shutdown())
+	// The injected connection is owned by the caller.
+	assert.True(t, nc.IsConnected())
 }
 
 func TestAnnouncer(t *testing.T) {
 	srv := RunTestServer()
 	defer srv.Shutdown()
 
-	receiver, _ := NewReceiver(nop)
+	nc, err := nats.Connect(nats.DefaultURL)
+	assert.Nil(t, err)
+
+	sub, err := nc.SubscribeSync("test-announcements")
+	assert.Nil(t, err)
+	assert.Nil(t, nc.Flush())
+
+	receiver, _ := NewReceiver(nop,
+		WithAnnouncementsSubject("test-announcements"),
+		WithAnnouncementsPeriod(time.Hour),
+		WithAnnouncerOptions(WithID("bidder-1")),
+	)
 	defer func() {
 		err := receiver.Shutdown()
 		assert.Nil(t, err)
@@ -87,16 +126,14 @@ func TestAnnouncer(t *testing.T) {
 
 	_ = receiver.Run()
 
-	nc, err := nats.Connect(nats.DefaultURL)
-	assert.Nil(t, err)
-
-	sub, err := nc.SubscribeSync(receiver.announcements)
+	// The first announcement is sent immediately, not after the announcements period.
+	msg, err := sub.NextMsg(time.Second)
 	assert.Nil(t, err)
 
-	msg, err := sub.NextMsg(2 * receiver.announcementsPeriod)
+	ann, err := DecodeAnnouncement(msg.Data)
 	assert.Nil(t, err)
-
-	assert.Equal(t, receiver.inbox, string(msg.Data))
+	assert.Equal(t, receiver.Address(), ann.Address)
+	assert.Equal(t, "bidder-1", ann.ID)
 }
 
 func TestWorkload(t *testing.T) {
@@ -116,22 +153,65 @@ func TestWorkload(t *testing.T) {
 	nc, err := nats.Connect(nats.DefaultURL)
 	assert.Nil(t, err)
 
-	err = nc.Publish(receiver.inbox, []byte("first workload"))
+	lease := time.Now().Add(time.Hour)
+	first := EncodeTestWorkload(t, lease, Allowances{MakeTestLineItem("first"): 1})
+	second := EncodeTestWorkload(t, lease, Allowances{MakeTestLineItem("second"): 2})
+	third := EncodeTestWorkload(t, lease, Allowances{MakeTestLineItem("third"): 3})
+
+	err = nc.Publish(receiver.Address(), first)
 	assert.Nil(t, err)
 
-	time.Sleep(10 * time.Millisecond)
+	assert.Eventually(t, func() bool { return ws.len() == 1 }, time.Second, time.Millisecond)
 
-	assert.Equal(t, "first workload", ws.get(0))
+	assert.Equal(t, string(first), ws.get(0))
 
-	err = nc.Publish(receiver.inbox, []byte("second workload"))
+	err = nc.Publish(receiver.Address(), second)
+	assert.Nil(t, err)
+	err = nc.Publish(receiver.Address(), []byte("invalid workload"))
 	assert.Nil(t, err)
-	err = nc.Publish(receiver.inbox, []byte("third workload"))
+	err = nc.Publish(receiver.Address(), third)
 	assert.Nil(t, err)
 
-	time.Sleep(10 * time.Millisecond)
+	assert.Eventually(t, func() bool { return ws.len() == 3 }, time.Second, time.Millisecond)
 
-	assert.Equal(t, "second workload", ws.get(1))
-	assert.Equal(t, "third workload", ws.get(2))
+	assert.Equal(t, string(second), ws.get(1))
+	assert.Equal(t, string(third), ws.get(2))
+	// The last workload replaces allowances of the previous ones.
+	assert.Equal(t, Allowances{MakeTestLineItem("third"): 3}, receiver.Allowances())
+}
+
+func TestReceiverLease(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+
+	events := make(chan LeaseEvent, 2)
+	receiver, _ := NewReceiver(nop, WithLeaseHandler(func(event LeaseEvent) {
+		events <- event
+	}))
+	defer func() {
+		assert.Nil(t, receiver.Shutdown())
+	}()
+	assert.Nil(t, receiver.Run())
+	assert.True(t, receiver.FailSafe())
+
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+
+	lineItem := MakeTestLineItem("line-item")
+	err := nc.Publish(receiver.Address(), EncodeTestWorkload(t, time.Now().Add(50*time.Millisecond), Allowances{lineItem: 7}))
+	assert.Nil(t, err)
+
+	event := <-events
+	assert.False(t, event.FailSafe)
+	assert.False(t, receiver.FailSafe())
+	assert.Equal(t, int64(7), receiver.Available(lineItem))
+
+	// The controller goes silent and the lease lapses.
+	event = <-events
+	assert.True(t, event.FailSafe)
+	assert.True(t, receiver.FailSafe())
+	assert.Equal(t, int64(0), receiver.Available(lineItem))
+	assert.Empty(t, receiver.Allowances())
 }
 
 func TestDoubleShutdown(t *testing.T) {
@@ -148,3 +228,192 @@ func TestDoubleShutdown(t *testing.T) {
 	err = receiver.Shutdown()
 	assert.Nil(t, err)
 }
+
+func TestWorkloadHandler(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+
+	type delivered struct {
+		w Workload
+		d Delivery
+	}
+	deliveries := make(chan delivered, 1)
+	receiver, err := NewWorkloadReceiver(func(w Workload, d Delivery) error {
+		deliveries <- delivered{w, d}
+		return nil
+	})
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, receiver.Shutdown())
+	}()
+	assert.NoError(t, receiver.Run())
+
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+	lineItem := MakeTestLineItem("line-item")
+	msg := nats.NewMsg(receiver.Address())
+	msg.Header.Set("Trace-Id", "trace")
+	msg.Data = EncodeTestWorkload(t, time.Now().Add(time.Hour), Allowances{lineItem: 7})
+	assert.NoError(t, nc.PublishMsg(msg))
+
+	got := <-deliveries
+	assert.Equal(t, Allowances{lineItem: 7}, got.w.Allowances)
+	assert.Equal(t, receiver.Address(), got.d.Subject)
+	assert.Equal(t, "trace", got.d.Header.Get("Trace-Id"))
+	assert.Equal(t, 1, got.d.Attempt)
+	assert.WithinDuration(t, time.Now(), got.d.ReceivedAt, time.Second)
+}
+
+func TestNewWorkloadReceiverRequiresHandler(t *testing.T) {
+	_, err := NewWorkloadReceiver(nil)
+	assert.Error(t, err)
+}
+
+func TestWorkloadHandlerFailure(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+	lineItem := MakeTestLineItem("line-item")
+	lease := time.Now().Add(time.Hour)
+
+	// The source serves the full workload of the current round on the resync subject.
+	resync, err := nc.Subscribe(nats.NewInbox(), func(msg *nats.Msg) {
+		assert.NoError(t, msg.Respond(EncodeTestWorkload(t, lease, Allowances{lineItem: 8})))
+	})
+	assert.NoError(t, err)
+	defer func() { _ = resync.Unsubscribe() }()
+
+	tests := []struct {
+		name         string
+		failures     int
+		wantAttempts []int
+		wantAllowed  []int64
+		wantFailures int64
+	}{
+		{"redelivered", 1, []int{1, 2}, []int64{7, 8}, 0},
+		{"redeliveries exhausted", 3, []int{1, 2, 3}, []int64{7, 8, 8}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var attempts []int
+			var allowed []int64
+			errs := make(chan error, 2)
+			receiver, err := NewWorkloadReceiver(func(w Workload, d Delivery) error {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts = append(attempts, d.Attempt)
+				allowed = append(allowed, w.Allowances[lineItem])
+				if len(attempts) <= tt.failures {
+					return assert.AnError
+				}
+				return nil
+			}, WithRedeliveries(2), WithRetry(1, time.Millisecond), WithErrorHandler(func(err error) {
+				errs <- err
+			}))
+			assert.NoError(t, err)
+			defer func() {
+				assert.NoError(t, receiver.Shutdown())
+			}()
+			assert.NoError(t, receiver.Run())
+
+			enc, err := json.Marshal(Workload{Lease: lease, Allowances: Allowances{lineItem: 7}, Round: 1, Resync: resync.Subject})
+			assert.NoError(t, err)
+			assert.NoError(t, nc.Publish(receiver.Address(), enc))
+			assert.Eventually(t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(attempts) == len(tt.wantAttempts)
+			}, time.Second, time.Millisecond)
+			assert.Eventually(t, func() bool {
+				return receiver.Failures() == tt.wantFailures
+			}, time.Second, time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, tt.wantAttempts, attempts)
+			assert.Equal(t, tt.wantAllowed, allowed)
+			if tt.wantFailures > 0 {
+				assert.ErrorIs(t, <-errs, assert.AnError)
+			}
+		})
+	}
+}
+
+func TestReceiverShutdownDuringRedeliveries(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+	lease := time.Now().Add(time.Hour)
+	resync, err := nc.Subscribe(nats.NewInbox(), func(msg *nats.Msg) {
+		_ = msg.Respond(EncodeTestWorkload(t, lease, Allowances{}))
+	})
+	assert.NoError(t, err)
+	defer func() { _ = resync.Unsubscribe() }()
+
+	// The handler keeps failing, so the workloads of every source are redelivered while the receiver shuts down.
+	receiver, err := NewWorkloadReceiver(func(w Workload, d Delivery) error {
+		return assert.AnError
+	}, WithRedeliveries(1000), WithRetry(1000, time.Millisecond), WithErrorHandler(func(err error) {}))
+	assert.NoError(t, err)
+	assert.NoError(t, receiver.Run())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			enc, err := json.Marshal(Workload{Source: strconv.Itoa(i % 10), Lease: lease, Round: uint64(i + 1), Resync: resync.Subject})
+			if err != nil || nc.Publish(receiver.Address(), enc) != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, receiver.Shutdown())
+	<-done
+	assert.NotEmpty(t, receiver.ID())
+	assert.NoError(t, receiver.Shutdown())
+}
+
+func TestWorkloadHandlerRedeliveryIsDropped(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	nc := MakeTestConnection(t)
+	defer nc.Close()
+	lineItem := MakeTestLineItem("line-item")
+	lease := time.Now().Add(time.Hour)
+
+	var mu sync.Mutex
+	var rounds []uint64
+	receiver, err := NewWorkloadReceiver(func(w Workload, d Delivery) error {
+		mu.Lock()
+		defer mu.Unlock()
+		rounds = append(rounds, w.Round)
+		if w.Round == 1 {
+			return assert.AnError
+		}
+		return nil
+	}, WithRedeliveries(2), WithRetry(1, 100*time.Millisecond))
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, receiver.Shutdown())
+	}()
+	assert.NoError(t, receiver.Run())
+
+	// The failed workload does not hold up the next one, which drops its pending redelivery.
+	for round := uint64(1); round <= 2; round++ {
+		enc, err := json.Marshal(Workload{Lease: lease, Allowances: Allowances{lineItem: 7}, Round: round})
+		assert.NoError(t, err)
+		assert.NoError(t, nc.Publish(receiver.Address(), enc))
+	}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(rounds) == 2
+	}, 50*time.Millisecond, time.Millisecond)
+	time.Sleep(300 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []uint64{1, 2}, rounds)
+	assert.Equal(t, int64(0), receiver.Failures())
+}
@@ -0,0 +1,201 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrAdjustmentRejected is returned by Return and TopUp when the dispatcher rejects the adjustment,
+// e.g. when the consumer is not observed with the announced ID.
+var ErrAdjustmentRejected = errors.New("adjustment rejected")
+
+// Adjustment is the request sent by a consumer to the dispatcher in the middle of a dispatch round.
+// The consumer returns allowances it is not going to spend and asks for more of those it is running out of.
+type Adjustment struct {
+	// ID is the identifier of the consumer announced.
+	ID string `json:"id"`
+	// Consumer is the address the workload was sent to.
+	Consumer string `json:"consumer"`
+	// Round is the dispatch round of the workload being adjusted.
+	Round uint64 `json:"round"`
+	// Returned are the unused allowances given back to the dispatcher.
+	Returned Allowances `json:"returned,omitempty"`
+	// Requested are the top-ups the consumer asks for.
+	Requested Allowances `json:"requested,omitempty"`
+}
+
+// Grant is the dispatcher reply to Adjustment.
+type Grant struct {
+	// Round is the current dispatch round of the dispatcher.
+	Round uint64 `json:"round"`
+	// Returned are the allowances accepted back, the consumer must not spend them anymore.
+	Returned Allowances `json:"returned"`
+	// Granted are the top-ups given to the consumer, they are valid until the lease of the round expires.
+	Granted Allowances `json:"granted"`
+	// Error describes why the adjustment has been rejected, nothing is returned nor granted then.
+	Error string `json:"error,omitempty"`
+}
+
+// DecodeAdjustment decodes and validates the adjustment message.
+func DecodeAdjustment(data []byte) (Adjustment, error) {
+	var a Adjustment
+	if err := json.Unmarshal(data, &a); err != nil {
+		return Adjustment{}, err
+	}
+	if a.Consumer == "" {
+		return Adjustment{}, fmt.Errorf("adjustment has no consumer")
+	}
+	return a, nil
+}
+
+// DecodeGrant decodes the grant message.
+func DecodeGrant(data []byte) (Grant, error) {
+	var g Grant
+	if err := json.Unmarshal(data, &g); err != nil {
+		return Grant{}, err
+	}
+	if g.Returned == nil {
+		g.Returned = Allowances{}
+	}
+	if g.Granted == nil {
+		g.Granted = Allowances{}
+	}
+	return g, nil
+}
+
+// reclaimPool collects allowances returned by consumers during a dispatch round and gives them to others.
+// A consumer can return at most what it holds in the round, and top-ups are paid only from returned
+// and reserved allowances, so the total handed out never exceeds the allowances of the round.
+type reclaimPool struct {
+	mu        sync.Mutex
+	round     uint64
+	template  Workload
+	held      map[string]Allowances
+	shares    *Shares
+	reclaimed Allowances
+}
+
+func newReclaimPool() *reclaimPool {
+	return &reclaimPool{held: map[string]Allowances{}, reclaimed: Allowances{}}
+}
+
+// reset starts a new round with allowances held by the consumers and the reserved ones kept undispensed.
+// The template is the workload of the round without allowances. The allowances reclaimed so far are dropped.
+func (p *reclaimPool) reset(template Workload, held map[string]Allowances, reserved Allowances) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.round = template.Round
+	p.template = template
+	p.held = make(map[string]Allowances, len(held))
+	for c, a := range held {
+		p.held[c] = copyAllowances(a)
+	}
+	p.shares = nil
+	p.reclaimed = copyAllowances(reserved)
+}
+
+// resetShares starts a new round of the broadcast mode, the allowances held by consumers are computed from the shares
+// when they are needed.
+func (p *reclaimPool) resetShares(template Workload, shares Shares, reserved Allowances) {
+	p.reset(template, nil, reserved)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.shares = &shares
+}
+
+// current returns the full workload of the consumer in the round including the adjustments made so far.
+// It returns false if the consumer holds no allowances of the round, then the workload has no allowances.
+func (p *reclaimPool) current(consumer string) (Workload, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w := p.template
+	held, ok := p.holding(consumer)
+	w.Allowances = copyAllowances(held)
+	return w, ok
+}
+
+// holding returns the allowances held by the consumer in the round, it must be called with the lock held.
+func (p *reclaimPool) holding(consumer string) (Allowances, bool) {
+	if held, ok := p.held[consumer]; ok {
+		return held, true
+	}
+	if p.shares == nil {
+		return nil, false
+	}
+	held, ok := p.shares.Share(consumer)
+	if ok {
+		p.held[consumer] = held
+	}
+	return held, ok
+}
+
+// join hands the undispensed allowances, at most the wanted ones, to the consumer which joined in the middle of the round.
+// It returns false if the consumer already holds allowances of the round.
+func (p *reclaimPool) join(consumer string, wanted Allowances) (Allowances, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.holding(consumer); ok {
+		return nil, false
+	}
+	granted := Allowances{}
+	for id, amount := range wanted {
+		if amount > p.reclaimed[id] {
+			amount = p.reclaimed[id]
+		}
+		if amount <= 0 {
+			continue
+		}
+		p.reclaimed[id] -= amount
+		granted[id] = amount
+	}
+	p.held[consumer] = copyAllowances(granted)
+	return granted, true
+}
+
+// adjust accepts the returned allowances and grants the requested ones from the reclaimed budget.
+// Adjustments of other than the current round are ignored.
+func (p *reclaimPool) adjust(a Adjustment) Grant {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	g := Grant{Round: p.round, Returned: Allowances{}, Granted: Allowances{}}
+	if a.Round != p.round {
+		return g
+	}
+	held, ok := p.holding(a.Consumer)
+	if !ok {
+		return g
+	}
+	for id, amount := range a.Returned {
+		if amount > held[id] {
+			amount = held[id]
+		}
+		if amount <= 0 {
+			continue
+		}
+		held[id] -= amount
+		p.reclaimed[id] += amount
+		g.Returned[id] = amount
+	}
+	for id, amount := range a.Requested {
+		if amount > p.reclaimed[id] {
+			amount = p.reclaimed[id]
+		}
+		if amount <= 0 {
+			continue
+		}
+		p.reclaimed[id] -= amount
+		held[id] += amount
+		g.Granted[id] = amount
+	}
+	return g
+}
+
+func copyAllowances(a Allowances) Allowances {
+	res := make(Allowances, len(a))
+	for id, amount := range a {
+		res[id] = amount
+	}
+	return res
+}
@@ -0,0 +1,220 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestReclaimPool(t *testing.T) {
+	alice, bob := MakeTestLineItem("alice"), MakeTestLineItem("bob")
+	pool := newReclaimPool()
+	pool.reset(Workload{Round: 1}, map[string]Allowances{
+		"consumer-1": {alice: 10, bob: 5},
+		"consumer-2": {alice: 10},
+	}, nil)
+	tests := []struct {
+		name string
+		arg  Adjustment
+		want Grant
+	}{
+		{"nothing reclaimed yet",
+			Adjustment{Consumer: "consumer-2", Round: 1, Requested: Allowances{alice: 5}},
+			Grant{Round: 1, Returned: Allowances{}, Granted: Allowances{}}},
+		{"return",
+			Adjustment{Consumer: "consumer-1", Round: 1, Returned: Allowances{alice: 4}},
+			Grant{Round: 1, Returned: Allowances{alice: 4}, Granted: Allowances{}}},
+		{"top-up is limited by reclaimed budget",
+			Adjustment{Consumer: "consumer-2", Round: 1, Requested: Allowances{alice: 5}},
+			Grant{Round: 1, Returned: Allowances{}, Granted: Allowances{alice: 4}}},
+		{"return is limited by held allowance",
+			Adjustment{Consumer: "consumer-1", Round: 1, Returned: Allowances{alice: 100, bob: 5}},
+			Grant{Round: 1, Returned: Allowances{alice: 6, bob: 5}, Granted: Allowances{}}},
+		{"negative amounts are ignored",
+			Adjustment{Consumer: "consumer-1", Round: 1, Returned: Allowances{bob: -5}, Requested: Allowances{alice: -1}},
+			Grant{Round: 1, Returned: Allowances{}, Granted: Allowances{}}},
+		{"stale round",
+			Adjustment{Consumer: "consumer-2", Round: 0, Requested: Allowances{alice: 5}},
+			Grant{Round: 1, Returned: Allowances{}, Granted: Allowances{}}},
+		{"unknown consumer",
+			Adjustment{Consumer: "consumer-3", Round: 1, Requested: Allowances{alice: 5}},
+			Grant{Round: 1, Returned: Allowances{}, Granted: Allowances{}}},
+		{"top-up of topped up allowance can be returned",
+			Adjustment{Consumer: "consumer-2", Round: 1, Returned: Allowances{alice: 14}, Requested: Allowances{bob: 1}},
+			Grant{Round: 1, Returned: Allowances{alice: 14}, Granted: Allowances{bob: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, pool.adjust(tt.arg))
+		})
+	}
+
+	// The next round drops the reclaimed budget.
+	pool.reset(Workload{Round: 2}, map[string]Allowances{"consumer-1": {alice: 1}}, nil)
+	got := pool.adjust(Adjustment{Consumer: "consumer-1", Round: 2, Requested: Allowances{alice: 20}})
+	assert.Equal(t, Grant{Round: 2, Returned: Allowances{}, Granted: Allowances{}}, got)
+}
+
+func TestReclaimPoolJoin(t *testing.T) {
+	alice, bob := MakeTestLineItem("alice"), MakeTestLineItem("bob")
+	pool := newReclaimPool()
+	pool.reset(Workload{Round: 1}, map[string]Allowances{"consumer-1": {alice: 9, bob: 9}}, Allowances{alice: 1, bob: 1})
+
+	// The consumer of the round does not join again.
+	_, ok := pool.join("consumer-1", Allowances{alice: 5})
+	assert.False(t, ok)
+
+	granted, ok := pool.join("consumer-2", Allowances{alice: 5, bob: 0})
+	assert.True(t, ok)
+	assert.Equal(t, Allowances{alice: 1}, granted)
+	_, ok = pool.join("consumer-2", Allowances{alice: 5})
+	assert.False(t, ok)
+
+	// The joined consumer may return what it has got.
+	got := pool.adjust(Adjustment{Consumer: "consumer-2", Round: 1, Returned: Allowances{alice: 5}})
+	assert.Equal(t, Allowances{alice: 1}, got.Returned)
+}
+
+func TestReclaim(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	lineItem := MakeTestLineItem("line-item")
+
+	// Every consumer gets the same allowance and nothing is reserved, the rounds are triggered by the test.
+	dispatcher, _ := NewDispatcher(func(consumers []Announcement) map[string]Allowances {
+		res := make(map[string]Allowances, len(consumers))
+		for _, c := range consumers {
+			res[c.Address] = Allowances{lineItem: 10}
+		}
+		return res
+	}, WithDispatchPeriod(time.Hour), WithJoinReserve(0), WithMissedRounds(SkipMissedRounds))
+	dispatcher.trigger = make(chan struct{})
+	assert.Nil(t, dispatcher.Run())
+	defer dispatcher.Shutdown()
+
+	r1, _ := NewReceiver(nop)
+	assert.Nil(t, r1.Run())
+	defer func() { _ = r1.Shutdown() }()
+	ws := new(workloads)
+	r2, _ := NewReceiver(collect(ws))
+	assert.Nil(t, r2.Run())
+	defer func() { _ = r2.Shutdown() }()
+
+	// Not adjustable before the first workload.
+	_, err := r1.Return(lineItem, 1)
+	assert.ErrorIs(t, err, ErrNotAdjustable)
+
+	assert.Eventually(t, func() bool { return len(dispatcher.Consumers()) == 2 }, time.Second, Delay)
+	dispatcher.trigger <- struct{}{}
+	assert.Eventually(t, func() bool {
+		return r1.Available(lineItem) == 10 && r2.Available(lineItem) == 10
+	}, time.Second, Delay)
+
+	returned, err := r1.Return(lineItem, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), returned)
+	assert.Equal(t, int64(6), r1.Available(lineItem))
+
+	granted, err := r2.TopUp(lineItem, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), granted)
+	assert.Equal(t, int64(14), r2.Available(lineItem))
+	// The handler gets the topped up workload.
+	assert.Equal(t, 2, ws.len())
+	adjusted, err := DecodeWorkload([]byte(ws.get(1)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(14), adjusted.Allowances[lineItem])
+
+	// The adjustment on behalf of another consumer is rejected, nothing is reclaimed from it.
+	_, src, _ := r2.leases.find(lineItem)
+	forged, err := json.Marshal(Adjustment{ID: "mallory", Consumer: r2.Address(), Round: src.round, Returned: Allowances{lineItem: 14}})
+	assert.Nil(t, err)
+	msg, err := r1.conn.Request(src.reclaim, forged, time.Second)
+	assert.Nil(t, err)
+	g, err := DecodeGrant(msg.Data)
+	assert.Nil(t, err)
+	assert.Equal(t, "consumer is not observed", g.Error)
+	assert.Empty(t, g.Returned)
+
+	// The reclaimed budget is exhausted, the total stays within the round's allowance.
+	granted, err = r1.TopUp(lineItem, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), granted)
+	assert.Equal(t, int64(20), r1.Available(lineItem)+r2.Available(lineItem))
+}
+
+func TestJoinMidRound(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	lineItem := MakeTestLineItem("line-item")
+
+	// Every consumer gets the same allowance, a half of it is reserved for joining consumers.
+	dispatcher, _ := NewDispatcher(func(consumers []Announcement) map[string]Allowances {
+		res := make(map[string]Allowances, len(consumers))
+		for _, c := range consumers {
+			res[c.Address] = Allowances{lineItem: 10}
+		}
+		return res
+	}, WithDispatchPeriod(time.Hour), WithJoinReserve(0.5), WithMissedRounds(SkipMissedRounds))
+	dispatcher.trigger = make(chan struct{})
+	assert.Nil(t, dispatcher.Run())
+	defer dispatcher.Shutdown()
+
+	r1, _ := NewReceiver(nop)
+	assert.Nil(t, r1.Run())
+	defer func() { _ = r1.Shutdown() }()
+	assert.Eventually(t, func() bool { return len(dispatcher.Consumers()) == 1 }, time.Second, Delay)
+	dispatcher.trigger <- struct{}{}
+	assert.Eventually(t, func() bool { return r1.Available(lineItem) == 5 }, time.Second, Delay)
+
+	// The joining consumer gets the undispensed part right away, not the whole prorated share.
+	r2, _ := NewReceiver(nop)
+	assert.Nil(t, r2.Run())
+	defer func() { _ = r2.Shutdown() }()
+	assert.Eventually(t, func() bool { return r2.Available(lineItem) == 5 }, time.Second, Delay)
+	granted, err := r1.TopUp(lineItem, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), granted)
+
+	// The next round rebalances all consumers.
+	dispatcher.trigger <- struct{}{}
+	assert.Eventually(t, func() bool {
+		_, src1, _ := r1.leases.find(lineItem)
+		_, src2, _ := r2.leases.find(lineItem)
+		return src1.round == 2 && src2.round == 2
+	}, time.Second, Delay)
+	assert.Equal(t, int64(5), r1.Available(lineItem))
+	assert.Equal(t, int64(5), r2.Available(lineItem))
+}
+
+func TestJoinMidRoundWithDefaultReserve(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	lineItem := MakeTestLineItem("line-item")
+
+	// Every consumer gets the same allowance, the default part of it is reserved for joining consumers.
+	dispatcher, _ := NewDispatcher(func(consumers []Announcement) map[string]Allowances {
+		res := make(map[string]Allowances, len(consumers))
+		for _, c := range consumers {
+			res[c.Address] = Allowances{lineItem: 100}
+		}
+		return res
+	}, WithDispatchPeriod(time.Hour), WithMissedRounds(SkipMissedRounds))
+	dispatcher.trigger = make(chan struct{})
+	assert.Nil(t, dispatcher.Run())
+	defer dispatcher.Shutdown()
+
+	r1, _ := NewReceiver(nop)
+	assert.Nil(t, r1.Run())
+	defer func() { _ = r1.Shutdown() }()
+	assert.Eventually(t, func() bool { return len(dispatcher.Consumers()) == 1 }, time.Second, Delay)
+	dispatcher.trigger <- struct{}{}
+	assert.Eventually(t, func() bool { return r1.Available(lineItem) == 90 }, time.Second, Delay)
+
+	// The joining consumer does not wait for the next round.
+	r2, _ := NewReceiver(nop)
+	assert.Nil(t, r2.Run())
+	defer func() { _ = r2.Shutdown() }()
+	assert.Eventually(t, func() bool { return r2.Available(lineItem) == 10 }, time.Second, Delay)
+}
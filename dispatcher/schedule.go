@@ -0,0 +1,41 @@
+package dispatcher
+
+import (
+	"errors"
+	"time"
+)
+
+// MissedRoundsPolicy decides what Dispatcher does when it wakes up after the time of a dispatch round has passed,
+// e.g. after a long GC pause, a suspended VM, or when it starts in the middle of a slot.
+type MissedRoundsPolicy int
+
+const (
+	// CatchUpMissedRounds dispatches the round of the current slot immediately, the rounds of past slots are lost.
+	CatchUpMissedRounds MissedRoundsPolicy = iota
+	// SkipMissedRounds waits for the round of the next slot, the consumers get no workload for the current slot.
+	SkipMissedRounds
+)
+
+// ErrMissedRounds is passed (wrapped) to the error handler when Dispatcher detects missed dispatch rounds.
+var ErrMissedRounds = errors.New("missed dispatch rounds")
+
+// schedule aligns dispatch rounds to the wall clock, the round of a slot takes place at the slot start plus offset.
+// The slots are consecutive periods counted from the zero time, so minute periods start at full minutes.
+type schedule struct {
+	period time.Duration
+	offset time.Duration
+}
+
+// last returns the time of the latest round not after t.
+func (s schedule) last(t time.Time) time.Time {
+	r := t.Truncate(s.period).Add(s.offset)
+	if r.After(t) {
+		r = r.Add(-s.period)
+	}
+	return r
+}
+
+// missed returns the number of rounds between the scheduled one and the latest one not after t.
+func (s schedule) missed(scheduled time.Time, t time.Time) int {
+	return int(s.last(t).Sub(scheduled) / s.period)
+}
@@ -0,0 +1,122 @@
+package dispatcher
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduleLast(t *testing.T) {
+	minute := time.Date(2023, 2, 17, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		offset time.Duration
+		now    time.Time
+		want   time.Time
+	}{
+		{"at slot start", 0, minute, minute},
+		{"in the middle of slot", 0, minute.Add(30 * time.Second), minute},
+		{"before offset", 5 * time.Second, minute.Add(2 * time.Second), minute.Add(-55 * time.Second)},
+		{"at offset", 5 * time.Second, minute.Add(5 * time.Second), minute.Add(5 * time.Second)},
+		{"after offset", 5 * time.Second, minute.Add(50 * time.Second), minute.Add(5 * time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := schedule{period: time.Minute, offset: tt.offset}
+			assert.Equal(t, tt.want, s.last(tt.now))
+		})
+	}
+}
+
+func TestScheduleMissed(t *testing.T) {
+	s := schedule{period: time.Minute}
+	scheduled := time.Date(2023, 2, 17, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 0, s.missed(scheduled, scheduled))
+	assert.Equal(t, 0, s.missed(scheduled, scheduled.Add(59*time.Second)))
+	assert.Equal(t, 1, s.missed(scheduled, scheduled.Add(time.Minute)))
+	assert.Equal(t, 3, s.missed(scheduled, scheduled.Add(200*time.Second)))
+	assert.Equal(t, -1, s.missed(scheduled, scheduled.Add(-time.Second)))
+}
+
+// testClock is the concurrency safe clock moved by the test.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) get() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// roundsCounter counts the dispatch rounds by workload callback calls.
+type roundsCounter struct {
+	mu     sync.Mutex
+	rounds int
+}
+
+func (rc *roundsCounter) callback(_ []Announcement) map[string]Allowances {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.rounds++
+	return nil
+}
+
+func (rc *roundsCounter) get() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.rounds
+}
+
+func TestDispatcherMissedRounds(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+	period := 50 * time.Millisecond
+	start := time.Date(2023, 2, 17, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		start time.Time
+		arg   MissedRoundsPolicy
+		want  int
+	}{
+		{"catch up in the middle of slot", start.Add(period / 2), CatchUpMissedRounds, 2},
+		{"skip in the middle of slot", start.Add(period / 2), SkipMissedRounds, 0},
+		{"skip at slot start", start, SkipMissedRounds, 1},
+	}
+	for _, tt := range tests {
+		want := tt.want
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &testClock{now: tt.start}
+			rc := new(roundsCounter)
+			errs := new(collectedErrors)
+			dispatcher, _ := NewDispatcher(rc.callback,
+				WithDispatchPeriod(period),
+				WithMissedRounds(tt.arg),
+				WithErrorHandler(errs.handler),
+			)
+			dispatcher.now = clock.get
+			assert.NoError(t, dispatcher.Run())
+			defer dispatcher.Shutdown()
+
+			// The round of the current slot is dispatched on start only if it is due or caught up.
+			if want > 0 {
+				assert.Eventually(t, func() bool { return rc.get() == 1 }, time.Second, Delay)
+			}
+			// The process is suspended for a few slots.
+			clock.set(start.Add(3*period + period/2))
+			assert.Eventually(t, func() bool { return errs.len() == 1 }, time.Second, Delay)
+			assert.ErrorIs(t, errs.get(0), ErrMissedRounds)
+			assert.Never(t, func() bool { return rc.get() > want }, 3*period, Delay)
+			assert.Equal(t, want, rc.get())
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package dispatcher
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"pacing.go/internal/hashring"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultShardsSubject is the NATS subject used by dispatchers to announce themselves to each other.
+const DefaultShardsSubject = "dispatchers"
+
+// Shards keeps track of dispatchers sharing the line items and decides which of them owns a line item.
+// The line items are partitioned with consistent hashing, so only the line items of a joining or leaving
+// dispatcher move to other dispatchers.
+type Shards struct {
+	announcer *Announcer
+	observer  *Observer
+
+	mu      sync.Mutex
+	members string
+	ring    *hashring.Ring
+}
+
+// NewShards creates new Shards instance, announcing this dispatcher and observing the others.
+// The options configure the announcements, the dispatcher is dropped after three missed announcements.
+func NewShards(nc *nats.Conn, opts ...AnnouncementsOption) (*Shards, error) {
+	options := &announcementsOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.subject == "" {
+		options.subject = DefaultShardsSubject
+	}
+	if options.period <= 0 {
+		options.period = DefaultPeriod
+	}
+	observer, err := NewObserver(nc, WithSubject(options.subject), WithPeriod(3*options.period))
+	if err != nil {
+		return nil, err
+	}
+	announcer, err := NewAnnouncer(nc, append(opts, WithSubject(options.subject), WithPeriod(options.period))...)
+	if err != nil {
+		_ = observer.Stop()
+		return nil, err
+	}
+	return &Shards{
+		announcer: announcer,
+		observer:  observer,
+	}, nil
+}
+
+// ID is the identifier of this dispatcher.
+func (s *Shards) ID() string {
+	return s.announcer.ID()
+}
+
+// Members returns sorted identifiers of active dispatchers, including this one.
+func (s *Shards) Members() []string {
+	return s.current().Members()
+}
+
+// Owns tells whether this dispatcher owns given line item.
+func (s *Shards) Owns(id uuid.UUID) bool {
+	return s.current().Owner(id[:]) == s.ID()
+}
+
+// Stop gracefully stops internal routines and cleans up resources.
+func (s *Shards) Stop() error {
+	s.announcer.Stop()
+	if err := s.observer.Stop(); err != nil {
+		return fmt.Errorf("cannot stop observing dispatchers: %v", err)
+	}
+	return nil
+}
+
+// current returns the ring of active dispatchers, it is rebuilt only when the membership changes.
+func (s *Shards) current() *hashring.Ring {
+	anns := s.observer.Consumers()
+	ids := make([]string, 0, len(anns)+1)
+	ids = append(ids, s.ID())
+	for _, ann := range anns {
+		if ann.ID != s.ID() {
+			ids = append(ids, ann.ID)
+		}
+	}
+	sort.Strings(ids)
+	members := strings.Join(ids, "\n")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ring == nil || s.members != members {
+		s.ring = hashring.New(ids, 0)
+		s.members = members
+	}
+	return s.ring
+}
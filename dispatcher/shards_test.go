@@ -0,0 +1,115 @@
+package dispatcher
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestShards(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+
+	ids := []string{"alice", "bob", "charlie"}
+	shards := make([]*Shards, len(ids))
+	for i, id := range ids {
+		var err error
+		shards[i], err = NewShards(MakeTestConnection(t), WithID(id), WithPeriod(50*time.Millisecond))
+		assert.NoError(t, err)
+		assert.Equal(t, id, shards[i].ID())
+	}
+	for _, s := range shards {
+		s := s
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(ids, s.Members())
+		}, time.Second, time.Millisecond)
+	}
+
+	// Every line item is owned by exactly one shard.
+	for i := 0; i < 1000; i++ {
+		id := uuid.New()
+		owners := 0
+		for _, s := range shards {
+			if s.Owns(id) {
+				owners++
+			}
+		}
+		assert.Equal(t, 1, owners)
+	}
+
+	// The line items are rebalanced when a shard leaves.
+	assert.NoError(t, shards[2].Stop())
+	for _, s := range shards[:2] {
+		s := s
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(ids[:2], s.Members())
+		}, time.Second, time.Millisecond)
+	}
+	for i := 0; i < 1000; i++ {
+		id := uuid.New()
+		assert.True(t, shards[0].Owns(id) != shards[1].Owns(id))
+	}
+	assert.NoError(t, shards[0].Stop())
+	assert.NoError(t, shards[1].Stop())
+}
+
+func TestShardedDispatchers(t *testing.T) {
+	srv := RunTestServer()
+	defer srv.Shutdown()
+
+	lineItems := make(Allowances, 100)
+	for i := 0; i < 100; i++ {
+		lineItems[uuid.New()] = 1
+	}
+	allLineItems := func(consumers []Announcement) map[string]Allowances {
+		res := make(map[string]Allowances, len(consumers))
+		for _, c := range consumers {
+			res[c.Address] = lineItems
+		}
+		return res
+	}
+
+	dispatchers := make([]*Dispatcher, 2)
+	for i, id := range []string{"alice", "bob"} {
+		var err error
+		dispatchers[i], err = NewDispatcher(allLineItems,
+			WithDispatchPeriod(10*time.Millisecond),
+			WithAnnouncementsPeriod(50*time.Millisecond),
+			WithSharding(WithID(id)),
+		)
+		assert.NoError(t, err)
+		assert.NoError(t, dispatchers[i].Run())
+		defer dispatchers[i].Shutdown()
+	}
+	for _, d := range dispatchers {
+		d := d
+		assert.Eventually(t, func() bool {
+			return len(d.shards.Members()) == 2
+		}, time.Second, time.Millisecond)
+	}
+
+	receiver, err := NewReceiver(nop)
+	assert.NoError(t, err)
+	assert.NoError(t, receiver.Run())
+	defer func() {
+		assert.NoError(t, receiver.Shutdown())
+	}()
+
+	// The receiver merges workloads of both dispatchers.
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(lineItems, receiver.Allowances())
+	}, time.Second, time.Millisecond)
+	receiver.leases.mu.Lock()
+	defer receiver.leases.mu.Unlock()
+	sources := make([]string, 0, 2)
+	for name, src := range receiver.leases.sources {
+		sources = append(sources, name)
+		for id := range src.allowances {
+			assert.True(t, dispatchers[0].Owns(id) == (name == "alice"))
+		}
+	}
+	sort.Strings(sources)
+	assert.Equal(t, []string{"alice", "bob"}, sources)
+}
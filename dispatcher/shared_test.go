@@ -1,10 +1,12 @@
 package dispatcher
 
 import (
+	"encoding/json"
 	"github.com/nats-io/nats-server/v2/server"
 	natsserver "github.com/nats-io/nats-server/v2/test"
 	"github.com/nats-io/nats.go"
 	"testing"
+	"time"
 )
 
 func RunTestServer() *server.Server {
@@ -19,3 +21,26 @@ func MakeTestConnection(t *testing.T) *nats.Conn {
 	}
 	return nc
 }
+
+// MakeTestAnnouncement creates minimal announcement of consumer with given address.
+func MakeTestAnnouncement(address string) Announcement {
+	return Announcement{ID: address, Address: address}
+}
+
+// EncodeTestAnnouncement creates encoded minimal announcement of consumer with given address.
+func EncodeTestAnnouncement(t *testing.T, address string) []byte {
+	msg, err := json.Marshal(MakeTestAnnouncement(address))
+	if err != nil {
+		t.Fatalf("Cannot encode announcement: %v", err)
+	}
+	return msg
+}
+
+// EncodeTestWorkload creates encoded workload.
+func EncodeTestWorkload(t *testing.T, lease time.Time, allowances Allowances) []byte {
+	msg, err := json.Marshal(Workload{Lease: lease, Allowances: allowances})
+	if err != nil {
+		t.Fatalf("Cannot encode workload: %v", err)
+	}
+	return msg
+}
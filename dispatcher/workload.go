@@ -0,0 +1,59 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Allowances maps line items to the budget a consumer may spend.
+type Allowances map[uuid.UUID]int64
+
+// Workload is the message sent by Dispatcher to a consumer.
+type Workload struct {
+	// Source identifies the dispatcher which sent the workload, it is empty when dispatchers are not sharded.
+	Source string `json:"source,omitempty"`
+	// Lease is the time until the allowances are valid.
+	// The consumer must stop spending them if no new workload arrives before.
+	Lease time.Time `json:"lease"`
+	// Allowances are the budgets the consumer may spend until the lease expires.
+	Allowances Allowances `json:"allowances"`
+	// Round numbers the dispatch rounds of the source, adjustments are accepted only for the current round.
+	Round uint64 `json:"round,omitempty"`
+	// Reclaim is the subject the consumer sends adjustments of its allowances to, it is empty when not supported.
+	Reclaim string `json:"reclaim,omitempty"`
+	// Base is the round the delta workload is relative to, it is zero for full workloads.
+	// The delta carries only the allowances changed since the base round and the removed line items.
+	Base uint64 `json:"base,omitempty"`
+	// Removed are the line items removed since the base round.
+	Removed []uuid.UUID `json:"removed,omitempty"`
+	// Resync is the subject the consumer requests its full workload at, e.g. when it has missed the base of a delta.
+	Resync string `json:"resync,omitempty"`
+}
+
+// IsDelta tells whether the workload is relative to the base round.
+func (w Workload) IsDelta() bool {
+	return w.Base != 0
+}
+
+// SyncRequest is the request for the full workload of the current round sent by a consumer to the Resync subject.
+type SyncRequest struct {
+	// Consumer is the address the workloads are sent to.
+	Consumer string `json:"consumer"`
+}
+
+// DecodeWorkload decodes and validates the workload message.
+func DecodeWorkload(data []byte) (Workload, error) {
+	var w Workload
+	if err := json.Unmarshal(data, &w); err != nil {
+		return Workload{}, err
+	}
+	if w.Lease.IsZero() {
+		return Workload{}, fmt.Errorf("workload has no lease")
+	}
+	if w.Allowances == nil {
+		w.Allowances = Allowances{}
+	}
+	return w, nil
+}
@@ -0,0 +1,99 @@
+package hashring
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of points each member has on the ring.
+const DefaultReplicas = 128
+
+// Ring is a consistent hashing ring, it maps keys to members.
+// When a member joins or leaves only the keys of that member move.
+type Ring struct {
+	points  []uint64
+	owners  []string
+	members []string
+}
+
+// New creates a Ring with given members, each having given number of points (replicas) on the ring.
+// If replicas is not positive DefaultReplicas is used.
+func New(members []string, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	unique := make(map[string]bool, len(members))
+	r := &Ring{
+		points: make([]uint64, 0, len(members)*replicas),
+		owners: make([]string, 0, len(members)*replicas),
+	}
+	for _, m := range members {
+		if unique[m] {
+			continue
+		}
+		unique[m] = true
+		r.members = append(r.members, m)
+	}
+	sort.Strings(r.members)
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	points := make([]point, 0, len(r.members)*replicas)
+	for _, m := range r.members {
+		for i := 0; i < replicas; i++ {
+			points = append(points, point{Hash([]byte(m + "#" + strconv.Itoa(i))), m})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].owner < points[j].owner
+		}
+		return points[i].hash < points[j].hash
+	})
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.owner)
+	}
+	return r
+}
+
+// Hash is the hash function used by the ring.
+func Hash(key []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	return mix(h.Sum64())
+}
+
+// mix improves the avalanche of FNV for short and similar keys (the finalizer of SplitMix64).
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Members returns sorted members of the ring.
+func (r *Ring) Members() []string {
+	return r.members
+}
+
+// Owner returns the member owning given key, it is empty if the ring has no members.
+func (r *Ring) Owner(key []byte) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	return r.owners[r.search(Hash(key))]
+}
+
+// search returns the index of the first point not smaller than the hash, wrapping around the ring.
+func (r *Ring) search(h uint64) int {
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
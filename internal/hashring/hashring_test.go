@@ -0,0 +1,66 @@
+package hashring
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func keys(n int) [][]byte {
+	res := make([][]byte, n)
+	for i := range res {
+		res[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+	return res
+}
+
+func TestEmptyRing(t *testing.T) {
+	r := New(nil, 0)
+	assert.Empty(t, r.Members())
+	assert.Equal(t, "", r.Owner([]byte("key")))
+}
+
+func TestNewDeduplicatesAndSortsMembers(t *testing.T) {
+	r := New([]string{"charlie", "alice", "bob", "alice"}, 1)
+	assert.Equal(t, []string{"alice", "bob", "charlie"}, r.Members())
+	assert.Len(t, r.points, 3)
+}
+
+func TestOwnerIsDeterministic(t *testing.T) {
+	a := New([]string{"alice", "bob", "charlie"}, 0)
+	b := New([]string{"charlie", "bob", "alice"}, 0)
+	for _, k := range keys(1000) {
+		assert.Equal(t, a.Owner(k), b.Owner(k))
+	}
+}
+
+func TestOwnerIsBalanced(t *testing.T) {
+	members := []string{"alice", "bob", "charlie", "dave"}
+	r := New(members, 0)
+	counts := map[string]int{}
+	n := 100_000
+	for _, k := range keys(n) {
+		counts[r.Owner(k)]++
+	}
+	for _, m := range members {
+		assert.InDelta(t, n/len(members), counts[m], float64(n)*0.08, "member %s", m)
+	}
+}
+
+func TestOnlyKeysOfLeavingMemberMove(t *testing.T) {
+	before := New([]string{"alice", "bob", "charlie"}, 0)
+	after := New([]string{"alice", "bob"}, 0)
+	for _, k := range keys(10_000) {
+		if owner := before.Owner(k); owner != "charlie" {
+			assert.Equal(t, owner, after.Owner(k))
+		}
+	}
+}
+
+func BenchmarkOwner(b *testing.B) {
+	r := New([]string{"alice", "bob", "charlie", "dave"}, 0)
+	key := []byte("0b9e5c3e-1b7f-4e9a-9a5c-3c1f1d7f2a11")
+	for i := 0; i < b.N; i++ {
+		_ = r.Owner(key)
+	}
+}
@@ -0,0 +1,47 @@
+package hashring
+
+import (
+	"math"
+	"sort"
+)
+
+// Rendezvous selects k members for the key with weighted rendezvous (highest random weight) hashing.
+// It returns the indices of selected members, ordered from the highest score.
+// Every member scores the key independently, so when a member joins or leaves
+// only the keys for which it is (or was) selected change their selection.
+// Non-positive weights are treated as 1.
+func Rendezvous(key []byte, members []string, weights []float64, k int) []int {
+	if k > len(members) {
+		k = len(members)
+	}
+	if k <= 0 {
+		return []int{}
+	}
+	type scored struct {
+		idx   int
+		score float64
+	}
+	scores := make([]scored, len(members))
+	buf := make([]byte, 0, len(key)+64)
+	for i, m := range members {
+		w := 1.0
+		if i < len(weights) && weights[i] > 0 {
+			w = weights[i]
+		}
+		buf = append(append(buf[:0], m...), key...)
+		// The hash is mapped to (0, 1) and the score is -w/ln(u), it gives the member selection probability proportional to its weight.
+		u := (float64(Hash(buf)>>11) + 0.5) / (1 << 53)
+		scores[i] = scored{i, -w / math.Log(u)}
+	}
+	sort.Slice(scores, func(a, b int) bool {
+		if scores[a].score == scores[b].score {
+			return members[scores[a].idx] < members[scores[b].idx]
+		}
+		return scores[a].score > scores[b].score
+	})
+	res := make([]int, k)
+	for i := range res {
+		res[i] = scores[i].idx
+	}
+	return res
+}
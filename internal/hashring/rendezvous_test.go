@@ -0,0 +1,68 @@
+package hashring
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRendezvousSize(t *testing.T) {
+	members := []string{"alice", "bob", "charlie"}
+	tests := []struct {
+		name string
+		k    int
+		want int
+	}{
+		{"zero", 0, 0},
+		{"negative", -1, 0},
+		{"subset", 2, 2},
+		{"all", 3, 3},
+		{"more than members", 5, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Rendezvous([]byte("key"), members, nil, tt.k)
+			assert.Len(t, got, tt.want)
+			seen := map[int]bool{}
+			for _, i := range got {
+				assert.False(t, seen[i])
+				seen[i] = true
+			}
+		})
+	}
+}
+
+func TestRendezvousIsStableWhenMemberLeaves(t *testing.T) {
+	before := []string{"alice", "bob", "charlie", "dave", "eve"}
+	after := []string{"alice", "bob", "dave", "eve"}
+	for _, k := range keys(1000) {
+		selected := Rendezvous(k, before, nil, 2)
+		if before[selected[0]] == "charlie" || before[selected[1]] == "charlie" {
+			continue
+		}
+		now := Rendezvous(k, after, nil, 2)
+		assert.Equal(t, []string{before[selected[0]], before[selected[1]]}, []string{after[now[0]], after[now[1]]})
+	}
+}
+
+func TestRendezvousRespectsWeights(t *testing.T) {
+	members := []string{"alice", "bob"}
+	counts := make([]int, 2)
+	n := 20_000
+	for _, k := range keys(n) {
+		counts[Rendezvous(k, members, []float64{1, 3}, 1)[0]]++
+	}
+	assert.InDelta(t, n/4, counts[0], float64(n)*0.03)
+	assert.InDelta(t, 3*n/4, counts[1], float64(n)*0.03)
+}
+
+func BenchmarkRendezvous(b *testing.B) {
+	members := make([]string, 100)
+	for i := range members {
+		members[i] = fmt.Sprintf("bidder-%d", i)
+	}
+	key := []byte("0b9e5c3e-1b7f-4e9a-9a5c-3c1f1d7f2a11")
+	for i := 0; i < b.N; i++ {
+		_ = Rendezvous(key, members, nil, 5)
+	}
+}
@@ -1,31 +1,563 @@
 package pacing
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
+	"net/http"
 	"pacing.go/dispatcher"
+	"sync"
+	"time"
 )
 
+// bidderOptions represents configurable options for Bidder.
+type bidderOptions struct {
+	reportSubject  string
+	reportInterval time.Duration
+	reportSize     int
+	bidPrice       float64
+	statePath      string
+	stateInterval  time.Duration
+	fallback       float64
+	rebalance      time.Duration
+	surplus        float64
+	watermark      float64
+	receiverOpts   []dispatcher.Option
+}
+
+// BidderOption allows to define configurable options.
+type BidderOption func(opts *bidderOptions)
+
+// WithReceiverOptions configures the receiver of workloads sent by the controller.
+func WithReceiverOptions(opts ...dispatcher.Option) BidderOption {
+	return func(o *bidderOptions) {
+		o.receiverOpts = append(o.receiverOpts, opts...)
+	}
+}
+
+// WithReportSubject configures the subject the spend is reported to, DefaultSpendSubject by default.
+func WithReportSubject(subject string) BidderOption {
+	return func(opts *bidderOptions) {
+		opts.reportSubject = subject
+	}
+}
+
+// WithReportInterval configures how often the committed spend is reported, DefaultReportInterval by default.
+func WithReportInterval(interval time.Duration) BidderOption {
+	return func(opts *bidderOptions) {
+		opts.reportInterval = interval
+	}
+}
+
+// WithReportSize configures the number of line items after which the spend is reported before the interval elapses,
+// DefaultReportSize by default.
+func WithReportSize(size int) BidderOption {
+	return func(opts *bidderOptions) {
+		opts.reportSize = size
+	}
+}
+
+// WithBidPrice configures the CPM the bidder bids with, DefaultBidPrice by default.
+func WithBidPrice(cpm float64) BidderOption {
+	return func(opts *bidderOptions) {
+		opts.bidPrice = cpm
+	}
+}
+
+// WithStateFile configures the file the bidder persists its workloads and ledger to, the state is not persisted by default.
+// On start the bidder restores the state if its leases are still valid, so it resumes bidding without waiting
+// for the controller, the next workload from the controller replaces the restored one.
+func WithStateFile(path string) BidderOption {
+	return func(opts *bidderOptions) {
+		opts.statePath = path
+	}
+}
+
+// WithStateInterval configures how often the state is persisted, DefaultStateInterval by default.
+func WithStateInterval(interval time.Duration) BidderOption {
+	return func(opts *bidderOptions) {
+		opts.stateInterval = interval
+	}
+}
+
+// WithFallbackPacing makes the bidder pace on its own at given fraction of its share of the day plan
+// when the leases of all workloads lapse, e.g. the controller is down. The bidder stops bidding by default.
+// The plan is received from the controller ahead of time, the fallback relies on the bidder's lease handler,
+// so it must not be replaced with dispatcher.WithLeaseHandler.
+func WithFallbackPacing(fraction float64) BidderOption {
+	return func(opts *bidderOptions) {
+		opts.fallback = fraction
+	}
+}
+
+// WithRebalancing makes the bidder return the allowances it is not expected to spend and ask for top-ups
+// of those it is running out of in the middle of the round, checked every interval. A line item is expected
+// to spend at its recent pace until the lease lapses. The allowance exceeding the expected spend by more than
+// the surplus fraction of the round's allowance is returned, DefaultRebalanceSurplus if not positive.
+// The top-up is requested when the remaining budget falls below the watermark fraction of the round's allowance
+// and the expected spend exceeds it, DefaultRebalanceWatermark if not positive. The bidder keeps its allowances by default.
+func WithRebalancing(interval time.Duration, surplus, watermark float64) BidderOption {
+	return func(opts *bidderOptions) {
+		opts.rebalance = interval
+		opts.surplus = surplus
+		opts.watermark = watermark
+	}
+}
+
+// Bidder receives workloads from the controller and keeps track of the budget it may spend in the Ledger.
+// The committed spend is reported back to the controller.
 type Bidder struct {
 	receiver *dispatcher.Receiver
+	ledger   *Ledger
+	reporter *spendReporter
+	handler  http.Handler
+	metadata *MetadataCache
+	selector *Selector
+	msub     *nats.Subscription
+	// fallback paces the bidder while the controller is unreachable, nil if disabled
+	fallback *fallbackPacer
+	psub     *nats.Subscription
+	mu       sync.Mutex
+	fetched  time.Time
+	// fetchKick wakes up the routine fetching the metadata, it is done out of the workload delivery
+	fetchKick chan struct{}
+	fetchDone chan struct{}
+	fetchWg   sync.WaitGroup
+	// statePath is the file the state is persisted to, empty if it is not persisted
+	statePath     string
+	stateInterval time.Duration
+	stateDone     chan struct{}
+	stateWg       sync.WaitGroup
+	// rebalance is the interval the allowances are returned and topped up at, zero if they are not
+	rebalance     time.Duration
+	surplus       float64
+	watermark     float64
+	rebalanceDone chan struct{}
+	rebalanceWg   sync.WaitGroup
 }
 
-func NewBidder() (*Bidder, error) {
-	receiver, err := dispatcher.NewReceiver(func(workload string) {
-		log.Debug().Msg(fmt.Sprintf("(bidder) received workload: %s", workload))
-	})
+// drainPollInterval is how often the draining bidder checks whether the in-flight reservations are done.
+const drainPollInterval = 10 * time.Millisecond
+
+// metadataFetchInterval limits how often the bidder requests the metadata of line items its version does not cover.
+const metadataFetchInterval = time.Second
+
+func NewBidder(opts ...BidderOption) (*Bidder, error) {
+	options := &bidderOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.reportSubject == "" {
+		options.reportSubject = DefaultSpendSubject
+	}
+	if options.reportInterval <= 0 {
+		options.reportInterval = DefaultReportInterval
+	}
+	if options.reportSize <= 0 {
+		options.reportSize = DefaultReportSize
+	}
+	if options.bidPrice <= 0 {
+		options.bidPrice = DefaultBidPrice
+	}
+	if options.stateInterval <= 0 {
+		options.stateInterval = DefaultStateInterval
+	}
+	if options.surplus <= 0 {
+		options.surplus = DefaultRebalanceSurplus
+	}
+	if options.watermark <= 0 {
+		options.watermark = DefaultRebalanceWatermark
+	}
+	b := &Bidder{
+		ledger:        NewLedger(DefaultReservationTTL),
+		metadata:      NewMetadataCache(),
+		fetchKick:     make(chan struct{}, 1),
+		statePath:     options.statePath,
+		stateInterval: options.stateInterval,
+		rebalance:     options.rebalance,
+		surplus:       options.surplus,
+		watermark:     options.watermark,
+	}
+	b.selector = NewSelector(b.ledger, b.metadata, options.bidPrice)
+	b.handler = newBidHandler(b.ledger, b.selector)
+	if options.fallback > 0 {
+		b.fallback = newFallbackPacer(b.ledger, options.fallback)
+	}
+	var state *bidderState
+	if b.statePath != "" {
+		state = b.loadState()
+	}
+	receiverOpts := []dispatcher.Option{dispatcher.WithLeaseHandler(b.leaseChanged)}
+	if state != nil && state.ID != "" && state.Address != "" {
+		// The options configured by the caller take precedence
+		receiverOpts = append(receiverOpts, dispatcher.WithAnnouncerOptions(dispatcher.WithID(state.ID), dispatcher.WithAddress(state.Address)))
+	}
+	receiver, err := dispatcher.NewWorkloadReceiver(b.consume, append(receiverOpts, options.receiverOpts...)...)
 	if err != nil {
 		return nil, err
 	}
-	return &Bidder{
-		receiver: receiver,
-	}, err
+	b.receiver = receiver
+	b.reporter = newSpendReporter(options.reportSubject, options.reportInterval, options.reportSize, receiver.ID)
+	b.ledger.commits = b.committed
+	if state != nil {
+		b.restoreState(state)
+	}
+	return b, err
+}
+
+// loadState reads the persisted state, it returns nil if there is none or it cannot be read.
+func (b *Bidder) loadState() *bidderState {
+	state, err := loadState(b.statePath)
+	if err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("(bidder) cannot read state from %s", b.statePath))
+		return nil
+	}
+	return state
+}
+
+// restoreState restores the persisted state, the ledger goes first, so the restored workloads keep its committed spend.
+// The bidder starts empty if the ledger cannot be restored.
+func (b *Bidder) restoreState(state *bidderState) {
+	if err := b.ledger.Restore(state.Ledger); err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("(bidder) cannot restore ledger from %s", b.statePath))
+		return
+	}
+	if b.fallback != nil && state.Plan != nil {
+		b.fallback.setPlan(*state.Plan)
+	}
+	b.receiver.Restore(state.Workloads)
+	b.reporter.restore(state.Reports)
+	log.Info().Msg(fmt.Sprintf("(bidder) restored %d workloads from %s", len(b.receiver.Workloads()), b.statePath))
+}
+
+// saveState persists the current state.
+func (b *Bidder) saveState() {
+	ledger, err := b.ledger.Snapshot()
+	if err == nil {
+		state := bidderState{
+			ID:        b.receiver.ID(),
+			Address:   b.receiver.Address(),
+			Workloads: b.receiver.Workloads(),
+			Ledger:    ledger,
+			Reports:   b.reporter.unacknowledged(),
+		}
+		if b.fallback != nil {
+			if plan := b.fallback.currentPlan(); plan.Version != "" {
+				state.Plan = &plan
+			}
+		}
+		err = saveState(b.statePath, state)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("(bidder) cannot save state to %s", b.statePath))
+	}
+}
+
+// persist saves the state periodically until the bidder shuts down.
+func (b *Bidder) persist() {
+	defer b.stateWg.Done()
+	ticker := time.NewTicker(b.stateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.saveState()
+		case <-b.stateDone:
+			return
+		}
+	}
+}
+
+// rebalancer returns and tops up the allowances periodically until the bidder shuts down.
+func (b *Bidder) rebalancer() {
+	defer b.rebalanceWg.Done()
+	ticker := time.NewTicker(b.rebalance)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.rebalanceAllowances()
+		case <-b.rebalanceDone:
+			return
+		}
+	}
+}
+
+// rebalanceAllowances returns the allowances the bidder is not expected to spend and asks for top-ups of those
+// it is running out of, the adjusted allowances are passed to the ledger by the receiver.
+func (b *Bidder) rebalanceAllowances() {
+	returns, topUps := b.ledger.imbalances(b.surplus, b.watermark, b.rebalance)
+	for id, amount := range returns {
+		returned, err := b.receiver.Return(id, amount)
+		if err != nil && !errors.Is(err, dispatcher.ErrNotAdjustable) {
+			log.Warn().Err(err).Msg(fmt.Sprintf("(bidder) cannot return allowance of line item %s", id))
+		} else if returned > 0 {
+			log.Debug().Msg(fmt.Sprintf("(bidder) returned allowance of line item %s: %d", id, returned))
+		}
+	}
+	for id, amount := range topUps {
+		granted, err := b.receiver.TopUp(id, amount)
+		if err != nil && !errors.Is(err, dispatcher.ErrNotAdjustable) {
+			log.Warn().Err(err).Msg(fmt.Sprintf("(bidder) cannot top up allowance of line item %s", id))
+		} else if granted > 0 {
+			log.Debug().Msg(fmt.Sprintf("(bidder) topped up allowance of line item %s: %d", id, granted))
+		}
+	}
+}
+
+// committed reports the spend committed on the allowance, the spend on the fallback allowances is told apart.
+func (b *Bidder) committed(source string, lineItem uuid.UUID, amount int64) {
+	b.reporter.add(lineItem, amount, source == fallbackSource)
+}
+
+// consume feeds the ledger with the received workload.
+func (b *Bidder) consume(w dispatcher.Workload, d dispatcher.Delivery) error {
+	log.Debug().Msg(fmt.Sprintf("(bidder) received workload of round %d from %q on %s", w.Round, w.Source, d.Subject))
+	b.ledger.Update(w)
+	if b.fallback != nil {
+		b.fallback.observe(w)
+	}
+	// A line item not covered by the metadata may have been added while the bidder was not receiving the updates,
+	// the newer metadata is fetched in the background not to delay the delivery
+	for id := range w.Allowances {
+		if !b.metadata.Covers(id) {
+			b.wakeFetcher()
+			break
+		}
+	}
+	return nil
+}
+
+// receiveMetadata caches the metadata update published by the controller.
+func (b *Bidder) receiveMetadata(msg *nats.Msg) {
+	u, err := DecodeMetadataUpdate(msg.Data)
+	if err != nil {
+		log.Error().Err(err).Msg("(bidder) cannot decode metadata")
+		return
+	}
+	if b.metadata.Update(u) {
+		log.Debug().Msg(fmt.Sprintf("(bidder) received metadata version %s", u.Version))
+	}
+}
+
+// receivePlan keeps the day plan published by the controller for the fallback pacing.
+func (b *Bidder) receivePlan(msg *nats.Msg) {
+	p, err := DecodeDayPlan(msg.Data)
+	if err != nil {
+		log.Error().Err(err).Msg("(bidder) cannot decode day plan")
+		return
+	}
+	if b.fallback.setPlan(p) {
+		log.Debug().Msg(fmt.Sprintf("(bidder) received day plan version %s", p.Version))
+	}
+}
+
+// fetchPlan requests the current day plan from the controller.
+func (b *Bidder) fetchPlan() {
+	msg, err := b.receiver.Conn().Request(planRequestSubject, nil, dispatcher.DefaultRequestTimeout)
+	if err != nil {
+		log.Warn().Err(err).Msg("(bidder) cannot fetch day plan")
+		return
+	}
+	b.receivePlan(msg)
+}
+
+// wakeFetcher makes the fetcher routine request the current metadata, it does not wait for the reply.
+func (b *Bidder) wakeFetcher() {
+	select {
+	case b.fetchKick <- struct{}{}:
+	default:
+	}
+}
+
+// fetcher fetches the metadata when woken up until the bidder is shut down.
+// The request too soon after the previous one is postponed, not dropped.
+func (b *Bidder) fetcher() {
+	defer b.fetchWg.Done()
+	for {
+		select {
+		case <-b.fetchKick:
+			b.mu.Lock()
+			wait := metadataFetchInterval - time.Since(b.fetched)
+			b.mu.Unlock()
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-b.fetchDone:
+					return
+				}
+			}
+			b.fetchMetadata()
+		case <-b.fetchDone:
+			return
+		}
+	}
+}
+
+// fetchMetadata requests the current metadata from the controller, at most once per metadataFetchInterval.
+func (b *Bidder) fetchMetadata() {
+	conn := b.receiver.Conn()
+	if conn == nil {
+		// The metadata is fetched on start
+		return
+	}
+	b.mu.Lock()
+	if time.Since(b.fetched) < metadataFetchInterval {
+		b.mu.Unlock()
+		return
+	}
+	b.fetched = time.Now()
+	b.mu.Unlock()
+	msg, err := conn.Request(metadataRequestSubject, nil, dispatcher.DefaultRequestTimeout)
+	if err != nil {
+		log.Warn().Err(err).Msg("(bidder) cannot fetch metadata")
+		return
+	}
+	b.receiveMetadata(msg)
+}
+
+// Ledger returns the budget ledger, reserve the budget at bid time, then commit it on a win or release it on a loss.
+func (b *Bidder) Ledger() *Ledger {
+	return b.ledger
+}
+
+// Selector returns the selector of line items to bid with.
+func (b *Bidder) Selector() *Selector {
+	return b.selector
+}
+
+// Metadata returns the cached metadata of line items.
+func (b *Bidder) Metadata() *MetadataCache {
+	return b.metadata
+}
+
+// leaseChanged is the default lease handler of the bidder, it switches the fallback pacing if enabled.
+// The spend committed in the fallback mode is reported as soon as the controller is back.
+func (b *Bidder) leaseChanged(event dispatcher.LeaseEvent) {
+	if event.FailSafe {
+		log.Warn().Msg("(bidder) workload lease lapsed, entering fail-safe mode")
+	} else {
+		log.Info().Msg("(bidder) workload lease acquired, leaving fail-safe mode")
+	}
+	if b.fallback == nil {
+		return
+	}
+	b.fallback.leaseChanged(event)
+	if !event.FailSafe {
+		b.reporter.wake()
+	}
+}
+
+// Handler returns the HTTP handler serving the bid endpoint and the win and loss notice endpoints.
+func (b *Bidder) Handler() http.Handler {
+	return b.handler
 }
 
 func (b *Bidder) Run() error {
-	return b.receiver.Run()
+	err := b.receiver.Run()
+	if err != nil {
+		return err
+	}
+	b.msub, err = b.receiver.Conn().Subscribe(MetadataSubject, b.receiveMetadata)
+	if err == nil && b.fallback != nil {
+		b.psub, err = b.receiver.Conn().Subscribe(PlanSubject, b.receivePlan)
+	}
+	if err != nil {
+		_ = b.receiver.Shutdown()
+		return err
+	}
+	b.fetchMetadata()
+	b.fetchDone = make(chan struct{})
+	b.fetchWg.Add(1)
+	go b.fetcher()
+	if b.fallback != nil {
+		b.fetchPlan()
+	}
+	b.reporter.start(b.receiver.Conn().Request)
+	if b.statePath != "" {
+		b.stateDone = make(chan struct{})
+		b.stateWg.Add(1)
+		go b.persist()
+	}
+	if b.rebalance > 0 {
+		b.rebalanceDone = make(chan struct{})
+		b.rebalanceWg.Add(1)
+		go b.rebalancer()
+	}
+	return nil
+}
+
+// Drain prepares the running bidder to leave without stranding its budget, call Shutdown after it.
+// The bidder announces itself as draining, so it gets no new allowances, and stops bidding.
+// Then it waits until the in-flight reservations are committed, released or expired, reports the committed spend
+// and returns the unspent allowances to the controller, which reallocates them in the current round.
+// The allowances of the past rounds are reallocated in the next rounds anyway. It returns the context error
+// if it is done before the reservations, the allowances are not returned then.
+func (b *Bidder) Drain(ctx context.Context) error {
+	if err := b.receiver.Drain(); err != nil {
+		return err
+	}
+	b.ledger.Drain()
+	log.Info().Msg("(bidder) draining")
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for b.ledger.Outstanding() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	b.reporter.flush()
+	var returned int64
+	for id, remaining := range b.ledger.Available() {
+		amount, err := b.receiver.Return(id, remaining)
+		if errors.Is(err, dispatcher.ErrNotAdjustable) {
+			// The allowance lapses with its lease, e.g. the fallback one
+			continue
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("(bidder) cannot return allowance of line item %s", id))
+			continue
+		}
+		returned += amount
+	}
+	log.Info().Msg(fmt.Sprintf("(bidder) drained, returned allowance: %d", returned))
+	return nil
 }
 
 func (b *Bidder) Shutdown() error {
+	if b.rebalanceDone != nil {
+		close(b.rebalanceDone)
+		b.rebalanceWg.Wait()
+		b.rebalanceDone = nil
+	}
+	// The spend committed so far is reported before the connection is closed
+	b.reporter.stop()
+	if b.stateDone != nil {
+		close(b.stateDone)
+		b.stateWg.Wait()
+		b.stateDone = nil
+		b.saveState()
+	}
+	if b.fetchDone != nil {
+		close(b.fetchDone)
+		b.fetchWg.Wait()
+		b.fetchDone = nil
+	}
+	if b.fallback != nil {
+		b.fallback.stop()
+	}
+	if b.psub != nil {
+		_ = b.psub.Unsubscribe()
+		b.psub = nil
+	}
+	if b.msub != nil {
+		_ = b.msub.Unsubscribe()
+		b.msub = nil
+	}
 	return b.receiver.Shutdown()
 }
@@ -1,38 +1,259 @@
 package pacing
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
 	"pacing.go/dispatcher"
+	"sync"
 	"time"
 )
 
+// controllerOptions represents configurable options for Controller.
+type controllerOptions struct {
+	weigher        Weigher
+	subsetSize     SubsetSize
+	broadcast      bool
+	spendSubject   string
+	rates          *SpendRates
+	dispatcherOpts []dispatcher.Option
+}
+
+// ControllerOption allows to define configurable options.
+type ControllerOption func(opts *controllerOptions)
+
+// WithDispatcherOptions configures the dispatcher sending workloads to bidders.
+func WithDispatcherOptions(opts ...dispatcher.Option) ControllerOption {
+	return func(o *controllerOptions) {
+		o.dispatcherOpts = append(o.dispatcherOpts, opts...)
+	}
+}
+
+// WithWeigher configures how bidders are weighted in the split of allowances, by their capacity by default.
+func WithWeigher(weigher Weigher) ControllerOption {
+	return func(opts *controllerOptions) {
+		opts.weigher = weigher
+	}
+}
+
+// WithSubsetSize configures among how many bidders a line item's allowance is split, among all by default.
+func WithSubsetSize(size SubsetSize) ControllerOption {
+	return func(opts *controllerOptions) {
+		opts.subsetSize = size
+	}
+}
+
+// WithBroadcast makes the controller publish a single message with all allowances and bidders' weights every round,
+// bidders compute their own shares. The subset size is not used in the broadcast mode.
+func WithBroadcast() ControllerOption {
+	return func(opts *controllerOptions) {
+		opts.broadcast = true
+	}
+}
+
+// WithSpendSubject configures the subject bidders report their spend to, DefaultSpendSubject by default.
+func WithSpendSubject(subject string) ControllerOption {
+	return func(opts *controllerOptions) {
+		opts.spendSubject = subject
+	}
+}
+
+// WithSpendRates makes the controller observe the spend reported by bidders in given rates,
+// e.g. to weigh the bidders with WithWeigher(rates.Weights).
+func WithSpendRates(rates *SpendRates) ControllerOption {
+	return func(opts *controllerOptions) {
+		opts.rates = rates
+	}
+}
+
+// Controller dispatches the planned spend of line items among bidders and records the spend they report back.
 type Controller struct {
+	opts       *controllerOptions
 	planned    *PlannedSpend
 	spend      *Spend
 	dispatcher *dispatcher.Dispatcher
+	reports    *nats.Subscription
+	path       string
+	mu         sync.Mutex
+	metadata   MetadataUpdate
+	metadataRq *nats.Subscription
+	plan       DayPlan
+	planRq     *nats.Subscription
 }
 
-func NewController(path string) (*Controller, error) {
+func NewController(path string, opts ...ControllerOption) (*Controller, error) {
+	options := &controllerOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.weigher == nil {
+		// Bidders are weighted by the capacity they announce, equally if none of them does.
+		options.weigher = CapacityWeights
+	}
+	if options.subsetSize == nil {
+		options.subsetSize = AllConsumers
+	}
+	if options.spendSubject == "" {
+		options.spendSubject = DefaultSpendSubject
+	}
+	snapshot, err := LoadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
 	planned := NewPlannedSpend()
-	err := planned.Load(path)
+	planned.Set(snapshot)
+	metadata, err := NewMetadataUpdate(metadataOf(snapshot))
+	if err != nil {
+		return nil, err
+	}
+	plan, err := dayPlanOf(snapshot)
 	if err != nil {
 		return nil, err
 	}
 	spend := NewSpend()
-	dsp, err := dispatcher.NewDispatcher(MakeWorkloadSplitter(planned, spend, time.Now))
+	// The spend is handed over between replicas when the leader election is enabled.
+	dispatcherOpts := append([]dispatcher.Option{dispatcher.WithStateHandoff(spend.Snapshot, spend.Restore)}, options.dispatcherOpts...)
+	var dsp *dispatcher.Dispatcher
+	if options.broadcast {
+		dsp, err = dispatcher.NewBroadcastDispatcher(MakeSharesSplitter(planned, spend, time.Now, options.weigher), dispatcherOpts...)
+	} else {
+		splitter := MakeSubsetWorkloadSplitter(planned, spend, time.Now, options.weigher, options.subsetSize)
+		dsp, err = dispatcher.NewDispatcher(splitter, dispatcherOpts...)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &Controller{
+		opts:       options,
 		planned:    planned,
 		spend:      spend,
 		dispatcher: dsp,
+		path:       path,
+		metadata:   metadata,
+		plan:       plan,
 	}, nil
 }
 
 func (c *Controller) Run() error {
-	return c.dispatcher.Run()
+	err := c.dispatcher.Run()
+	if err != nil {
+		return err
+	}
+	// Every replica records the reported spend, so it is up-to-date when the replica takes over the leadership
+	c.reports, err = c.dispatcher.Conn().Subscribe(c.opts.spendSubject, c.report)
+	if err == nil {
+		// Serve the metadata and the plan to bidders which have missed their updates, a single replica replies
+		c.metadataRq, err = c.dispatcher.Conn().QueueSubscribe(metadataRequestSubject, metadataRequestSubject, c.serve(c.currentMetadata))
+	}
+	if err == nil {
+		c.planRq, err = c.dispatcher.Conn().QueueSubscribe(planRequestSubject, planRequestSubject, c.serve(c.currentPlan))
+	}
+	if err != nil {
+		c.Shutdown()
+		return err
+	}
+	c.publish(MetadataSubject, c.currentMetadata)
+	c.publish(PlanSubject, c.currentPlan)
+	return nil
+}
+
+// Reload loads the snapshot again, the planned spend is updated and the metadata and the day plan are published
+// to bidders if they have changed.
+func (c *Controller) Reload() error {
+	snapshot, err := LoadSnapshot(c.path)
+	if err != nil {
+		return err
+	}
+	c.planned.Set(snapshot)
+	metadata, err := NewMetadataUpdate(metadataOf(snapshot))
+	if err != nil {
+		return err
+	}
+	plan, err := dayPlanOf(snapshot)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	metadataChanged := metadata.Version != c.metadata.Version
+	planChanged := plan.Version != c.plan.Version
+	c.metadata, c.plan = metadata, plan
+	c.mu.Unlock()
+	if metadataChanged {
+		c.publish(MetadataSubject, c.currentMetadata)
+	}
+	if planChanged {
+		c.publish(PlanSubject, c.currentPlan)
+	}
+	return nil
+}
+
+// currentMetadata returns the encoded metadata update of the loaded snapshot.
+func (c *Controller) currentMetadata() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return json.Marshal(c.metadata)
+}
+
+// currentPlan returns the encoded day plan of the loaded snapshot.
+func (c *Controller) currentPlan() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return json.Marshal(c.plan)
+}
+
+// publish publishes the current content to all bidders on given subject.
+func (c *Controller) publish(subject string, current func() ([]byte, error)) {
+	enc, err := current()
+	if err == nil {
+		err = c.dispatcher.Conn().Publish(subject, enc)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("(controller) cannot publish %s", subject))
+	}
+}
+
+// serve returns the handler replying to the bidder with the current content.
+func (c *Controller) serve(current func() ([]byte, error)) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		enc, err := current()
+		if err == nil {
+			err = msg.Respond(enc)
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("(controller) cannot reply on %s", msg.Subject))
+		}
+	}
+}
+
+// report records the spend reported by a bidder and acknowledges it, the retried reports are recorded only once,
+// the spend rate of the bidder is observed only for the recorded ones.
+func (c *Controller) report(msg *nats.Msg) {
+	r, err := DecodeSpendReport(msg.Data)
+	if err != nil {
+		log.Warn().Err(err).Msg("(controller) cannot decode spend report")
+		return
+	}
+	if c.spend.Report(r) && c.opts.rates != nil && r.Consumer != "" {
+		c.opts.rates.Observe(r.Consumer, r.Total())
+	}
+	if err = msg.Respond(nil); err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("(controller) cannot acknowledge spend report %s", r.Key))
+	}
 }
 
 func (c *Controller) Shutdown() {
+	if c.planRq != nil {
+		_ = c.planRq.Unsubscribe()
+		c.planRq = nil
+	}
+	if c.metadataRq != nil {
+		_ = c.metadataRq.Unsubscribe()
+		c.metadataRq = nil
+	}
+	if c.reports != nil {
+		_ = c.reports.Unsubscribe()
+		c.reports = nil
+	}
 	c.dispatcher.Shutdown()
 }
@@ -0,0 +1,50 @@
+package pacing
+
+import (
+	"github.com/google/uuid"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"pacing.go/dispatcher"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestControllerReloadRemovesLineItems(t *testing.T) {
+	srv := natsserver.RunRandClientPortServer()
+	defer srv.Shutdown()
+	kept, removed := uuid.New(), uuid.New()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	writeSnapshot(t, path,
+		&Record{LineItemID: kept, DailyBudget: TimeSlots * CurrencyUnit},
+		&Record{LineItemID: removed, DailyBudget: TimeSlots * CurrencyUnit},
+	)
+
+	controller, err := NewController(path, WithDispatcherOptions(
+		dispatcher.WithURL(srv.ClientURL()),
+		dispatcher.WithAnnouncementsPeriod(50*time.Millisecond),
+		dispatcher.WithDispatchPeriod(100*time.Millisecond),
+	))
+	require.NoError(t, err)
+	require.NoError(t, controller.Run())
+	defer controller.Shutdown()
+	bidder, err := NewBidder(WithReceiverOptions(
+		dispatcher.WithURL(srv.ClientURL()),
+		dispatcher.WithAnnouncementsPeriod(50*time.Millisecond),
+	))
+	require.NoError(t, err)
+	require.NoError(t, bidder.Run())
+	defer func() { assert.NoError(t, bidder.Shutdown()) }()
+	require.Eventually(t, func() bool {
+		return bidder.receiver.Available(kept) > 0 && bidder.receiver.Available(removed) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The line item removed from the snapshot is not dispatched in the next rounds.
+	writeSnapshot(t, path, &Record{LineItemID: kept, DailyBudget: TimeSlots * CurrencyUnit})
+	require.NoError(t, controller.Reload())
+	assert.Eventually(t, func() bool {
+		return bidder.receiver.Available(removed) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Greater(t, bidder.receiver.Available(kept), int64(0))
+}
@@ -0,0 +1,76 @@
+package pacing
+
+import (
+	"context"
+	"github.com/google/uuid"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"pacing.go/dispatcher"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBidderDrain(t *testing.T) {
+	srv := natsserver.RunRandClientPortServer()
+	defer srv.Shutdown()
+	id := uuid.New()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	writeSnapshot(t, path, &Record{LineItemID: id, DailyBudget: TimeSlots * CurrencyUnit})
+
+	controller, err := NewController(path, WithDispatcherOptions(
+		dispatcher.WithURL(srv.ClientURL()),
+		dispatcher.WithAnnouncementsPeriod(50*time.Millisecond),
+		// The allowance is returned in the round it was allocated in, the test takes less than a round
+		dispatcher.WithDispatchPeriod(2*time.Second),
+		dispatcher.WithLease(time.Minute),
+	))
+	require.NoError(t, err)
+	require.NoError(t, controller.Run())
+	defer controller.Shutdown()
+	bidder, err := NewBidder(WithReceiverOptions(
+		dispatcher.WithURL(srv.ClientURL()),
+		dispatcher.WithAnnouncementsPeriod(50*time.Millisecond),
+	))
+	require.NoError(t, err)
+	require.NoError(t, bidder.Run())
+	defer func() { assert.NoError(t, bidder.Shutdown()) }()
+	require.Eventually(t, func() bool {
+		return bidder.Ledger().Remaining(id) > 1000
+	}, 5*time.Second, 10*time.Millisecond)
+	res, err := bidder.Ledger().Reserve(id, 1000)
+	require.NoError(t, err)
+
+	// The drain waits for the in-flight reservation.
+	drained := make(chan error, 1)
+	go func() { drained <- bidder.Drain(context.Background()) }()
+	assert.Never(t, func() bool { return len(drained) > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+	assert.False(t, bidder.Ledger().ShouldBid(id))
+	assert.Eventually(t, func() bool {
+		return len(controller.dispatcher.Consumers()) == 0
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, bidder.Ledger().Commit(res, 1000))
+
+	// The unspent allowance is returned to the controller, the bidder keeps what it has spent.
+	assert.NoError(t, <-drained)
+	assert.Equal(t, int64(1000), bidder.receiver.Available(id))
+	assert.Empty(t, bidder.Ledger().Available())
+}
+
+func TestBidderDrainTimeout(t *testing.T) {
+	srv := natsserver.RunRandClientPortServer()
+	defer srv.Shutdown()
+	id := uuid.New()
+	bidder, err := NewBidder(WithReceiverOptions(dispatcher.WithURL(srv.ClientURL())))
+	require.NoError(t, err)
+	require.NoError(t, bidder.Run())
+	defer func() { assert.NoError(t, bidder.Shutdown()) }()
+	bidder.Ledger().Update(dispatcher.Workload{Lease: time.Now().Add(time.Minute), Round: 1, Allowances: dispatcher.Allowances{id: 100}})
+	_, err = bidder.Ledger().Reserve(id, 10)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, bidder.Drain(ctx), context.DeadlineExceeded)
+}
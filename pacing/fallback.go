@@ -0,0 +1,143 @@
+package pacing
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"math"
+	"pacing.go/dispatcher"
+	"sync"
+	"time"
+)
+
+// fallbackSource is the source of the allowances the bidder grants itself while the controller is unreachable.
+const fallbackSource = "fallback"
+
+// fallbackPacer paces the bidder on its own when the leases of all workloads lapse, e.g. the controller is down.
+// The bidder's share of a line item is the ratio of its allowance to the plan of the slot, observed in workloads.
+// In the fallback mode the ledger gets the fraction of the bidder's share of the plan every time slot.
+// The spend committed meanwhile is reported when the controller is back, the reports are retried until acknowledged.
+type fallbackPacer struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	ledger   *Ledger
+	fraction float64
+	plan     DayPlan
+	// shares are the bidder's shares of line items keyed by the workload source
+	shares map[string]map[uuid.UUID]fallbackShare
+	active bool
+	timer  *time.Timer
+}
+
+// fallbackShare is the largest share of the line item observed in the time slot.
+type fallbackShare struct {
+	slot  int
+	value float64
+}
+
+func newFallbackPacer(ledger *Ledger, fraction float64) *fallbackPacer {
+	return &fallbackPacer{
+		now:      time.Now,
+		ledger:   ledger,
+		fraction: math.Min(fraction, 1),
+		shares:   map[string]map[uuid.UUID]fallbackShare{},
+	}
+}
+
+// setPlan replaces the day plan, it returns false if the plan has the current version.
+func (f *fallbackPacer) setPlan(p DayPlan) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.plan.Version == p.Version {
+		return false
+	}
+	f.plan = p
+	return true
+}
+
+// currentPlan returns the day plan, the version is empty until the plan is received.
+func (f *fallbackPacer) currentPlan() DayPlan {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.plan
+}
+
+// observe records the bidder's shares of the line items in the full workload.
+// The allowance shrinks with the spend during the slot, so the largest share in the slot is kept.
+func (f *fallbackPacer) observe(w dispatcher.Workload) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	slot := TimeToSlot(f.now())
+	previous := f.shares[w.Source]
+	shares := make(map[uuid.UUID]fallbackShare, len(w.Allowances))
+	for id, allowance := range w.Allowances {
+		planned := f.plan.Planned(slot, id)
+		if planned <= 0 {
+			continue
+		}
+		share := fallbackShare{slot: slot, value: math.Min(float64(allowance)/float64(planned), 1)}
+		if p, ok := previous[id]; ok && p.slot == slot && p.value > share.value {
+			share = p
+		}
+		shares[id] = share
+	}
+	f.shares[w.Source] = shares
+}
+
+// leaseChanged enters the fallback mode when the leases lapse and leaves it when a workload is received again.
+func (f *fallbackPacer) leaseChanged(event dispatcher.LeaseEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if event.FailSafe == f.active {
+		return
+	}
+	f.active = event.FailSafe
+	if f.active {
+		log.Warn().Msg(fmt.Sprintf("(bidder) pacing at %.0f%% of the plan until the controller is back", f.fraction*100))
+		f.grant()
+		return
+	}
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	// The line items not allocated by the controller anymore get no allowance
+	f.ledger.Update(dispatcher.Workload{Source: fallbackSource})
+}
+
+// grant feeds the ledger with the allowances of the current slot and schedules the grant of the next one.
+// It must be called with the lock held.
+func (f *fallbackPacer) grant() {
+	now := f.now()
+	slot := TimeToSlot(now)
+	allowances := dispatcher.Allowances{}
+	for _, shares := range f.shares {
+		for id, share := range shares {
+			allowance := int64(math.Floor(f.fraction * share.value * float64(f.plan.Planned(slot, id))))
+			if allowance > allowances[id] {
+				allowances[id] = allowance
+			}
+		}
+	}
+	end := now.Truncate(time.Minute).Add(time.Minute)
+	// Every slot is a new round, so the committed spend is reset
+	f.ledger.Update(dispatcher.Workload{Source: fallbackSource, Lease: end, Round: uint64(slot) + 1, Allowances: allowances})
+	f.timer = time.AfterFunc(end.Sub(now), func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.active {
+			f.grant()
+		}
+	})
+}
+
+// stop cancels the grant of the next slot.
+func (f *fallbackPacer) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.active = false
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+}
@@ -0,0 +1,137 @@
+package pacing
+
+import (
+	"github.com/google/uuid"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"pacing.go/dispatcher"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDayPlan(t *testing.T) {
+	id := uuid.New()
+	plan, err := NewDayPlan(map[uuid.UUID]int64{id: 1440 * 100}, EvenShares())
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), plan.Planned(0, id))
+	assert.Equal(t, int64(100), plan.Planned(TimeSlots-1, id))
+	assert.Equal(t, int64(0), plan.Planned(TimeSlots, id))
+	assert.Equal(t, int64(0), plan.Planned(0, uuid.New()))
+
+	other, err := NewDayPlan(map[uuid.UUID]int64{id: 1440 * 200}, EvenShares())
+	require.NoError(t, err)
+	assert.NotEqual(t, plan.Version, other.Version)
+
+	_, err = NewDayPlan(nil, []float64{1})
+	assert.Error(t, err)
+	_, err = DecodeDayPlan([]byte(`{"shares":[]}`))
+	assert.Error(t, err)
+}
+
+func TestFallbackPacer(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 30, 0, time.Local)
+	first, second := uuid.New(), uuid.New()
+	ledger := NewLedger(time.Second)
+	ledger.now = func() time.Time { return now }
+	f := newFallbackPacer(ledger, 0.5)
+	f.now = func() time.Time { return now }
+	defer f.stop()
+	plan, err := NewDayPlan(map[uuid.UUID]int64{first: 1440 * 1000, second: 1440 * 1000}, EvenShares())
+	require.NoError(t, err)
+	assert.True(t, f.setPlan(plan))
+	assert.False(t, f.setPlan(plan))
+
+	// The bidder holds 40% of the first line item and all of the second one, the shrinking allowance is ignored.
+	workload := dispatcher.Workload{Source: "controller", Lease: now.Add(time.Second), Round: 1, Allowances: dispatcher.Allowances{first: 400, second: 1000}}
+	ledger.Update(workload)
+	f.observe(workload)
+	workload.Allowances = dispatcher.Allowances{first: 100, second: 500}
+	ledger.Update(workload)
+	f.observe(workload)
+
+	// The controller goes silent, the bidder paces at half of its share.
+	now = now.Add(time.Second)
+	f.leaseChanged(dispatcher.LeaseEvent{FailSafe: true, At: now})
+	assert.Equal(t, int64(200), ledger.Remaining(first))
+	assert.Equal(t, int64(500), ledger.Remaining(second))
+	res, err := ledger.Reserve(first, 150)
+	require.NoError(t, err)
+	require.NoError(t, ledger.Commit(res, 150))
+	assert.Equal(t, int64(50), ledger.Remaining(first))
+
+	// The next slot brings new allowances.
+	now = now.Add(time.Minute)
+	f.mu.Lock()
+	f.grant()
+	f.mu.Unlock()
+	assert.Equal(t, int64(200), ledger.Remaining(first))
+
+	// The controller is back and allocates only the second line item.
+	ledger.Update(dispatcher.Workload{Source: "controller", Lease: now.Add(time.Second), Round: 2, Allowances: dispatcher.Allowances{second: 300}})
+	f.leaseChanged(dispatcher.LeaseEvent{FailSafe: false, At: now})
+	assert.Equal(t, int64(0), ledger.Remaining(first))
+	assert.Equal(t, int64(300), ledger.Remaining(second))
+}
+
+func TestBidderReceivesDayPlan(t *testing.T) {
+	srv := natsserver.RunRandClientPortServer()
+	defer srv.Shutdown()
+	id := uuid.New()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	writeSnapshot(t, path, &Record{LineItemID: id, DailyBudget: 1440})
+
+	controller, err := NewController(path, WithDispatcherOptions(dispatcher.WithURL(srv.ClientURL())))
+	require.NoError(t, err)
+	require.NoError(t, controller.Run())
+	defer controller.Shutdown()
+
+	// The bidder started after the controller requests the plan.
+	bidder, err := NewBidder(WithReceiverOptions(dispatcher.WithURL(srv.ClientURL())), WithFallbackPacing(0.5))
+	require.NoError(t, err)
+	require.NoError(t, bidder.Run())
+	defer func() { assert.NoError(t, bidder.Shutdown()) }()
+	assert.Equal(t, int64(1), bidder.fallback.currentPlan().Planned(0, id))
+
+	// The changed plan is published to running bidders.
+	writeSnapshot(t, path, &Record{LineItemID: id, DailyBudget: 2880})
+	require.NoError(t, controller.Reload())
+	assert.Eventually(t, func() bool {
+		return bidder.fallback.currentPlan().Planned(0, id) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestControllerChargesFallbackSpend(t *testing.T) {
+	srv := natsserver.RunRandClientPortServer()
+	defer srv.Shutdown()
+	id := uuid.New()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	writeSnapshot(t, path, &Record{LineItemID: id, DailyBudget: 1440})
+
+	// The bidder spends on the fallback allowance while the controller is unreachable.
+	past := time.Date(2023, 2, 17, 12, 0, 0, 0, time.Local)
+	bidder, err := NewBidder(WithReceiverOptions(dispatcher.WithURL(srv.ClientURL())), WithReportInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	bidder.reporter.now = func() time.Time { return past }
+	require.NoError(t, bidder.Run())
+	defer func() { assert.NoError(t, bidder.Shutdown()) }()
+	bidder.Ledger().Update(dispatcher.Workload{Source: fallbackSource, Lease: time.Now().Add(time.Minute), Round: 1, Allowances: dispatcher.Allowances{id: 100}})
+	res, err := bidder.Ledger().Reserve(id, 40)
+	require.NoError(t, err)
+	require.NoError(t, bidder.Ledger().Commit(res, 40))
+
+	// The controller is back in the next slot, the other bidders have reported their spend already.
+	slot := TimeToSlot(past) + 1
+	controller, err := NewController(path, WithDispatcherOptions(dispatcher.WithURL(srv.ClientURL())))
+	require.NoError(t, err)
+	controller.spend.Add(slot, id, 10)
+	require.NoError(t, controller.Run())
+	defer controller.Shutdown()
+
+	// The fallback spend of the past slot is charged to the current one, so the next allowances make up for it.
+	assert.Eventually(t, func() bool {
+		return len(bidder.reporter.unacknowledged()) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(50), controller.spend.At(slot, id))
+}
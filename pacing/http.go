@@ -0,0 +1,207 @@
+package pacing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// DefaultBidPrice is the CPM the bidder bids with.
+const DefaultBidPrice = 1.0
+
+// AuctionPriceMacro is replaced by the exchange with the clearing price in the win notice URL.
+const AuctionPriceMacro = "${AUCTION_PRICE}"
+
+// BidRequest is the minimal OpenRTB bid request.
+type BidRequest struct {
+	ID  string       `json:"id"`
+	Imp []Impression `json:"imp"`
+	// Attributes are matched against the line items' targeting, they stand in for the OpenRTB objects describing the request.
+	Attributes Attributes `json:"attributes,omitempty"`
+}
+
+// Impression is the minimal OpenRTB impression object.
+type Impression struct {
+	ID string `json:"id"`
+	// BidFloor is the minimum CPM of the bid.
+	BidFloor float64 `json:"bidfloor,omitempty"`
+}
+
+// BidResponse is the minimal OpenRTB bid response.
+type BidResponse struct {
+	ID      string    `json:"id"`
+	SeatBid []SeatBid `json:"seatbid"`
+}
+
+// SeatBid is the minimal OpenRTB seat bid object.
+type SeatBid struct {
+	Bid []Bid `json:"bid"`
+}
+
+// Bid is the minimal OpenRTB bid object. The bid ID is the reservation of its budget in the ledger.
+type Bid struct {
+	ID    string `json:"id"`
+	ImpID string `json:"impid"`
+	// Price is the CPM of the bid.
+	Price float64 `json:"price"`
+	// LineItem is the line item the bid spends the budget of.
+	LineItem uuid.UUID `json:"lineitem"`
+	// NURL is the win notice URL, the exchange replaces AuctionPriceMacro with the clearing price.
+	NURL string `json:"nurl"`
+	// LURL is the loss notice URL.
+	LURL string `json:"lurl"`
+}
+
+// cpmToAmount converts the CPM to the amount spent on a single impression in CurrencyUnit.
+func cpmToAmount(cpm float64) int64 {
+	return int64(math.Round(cpm * float64(CurrencyUnit) / 1000))
+}
+
+// bidHandler serves the bid endpoint and the win and loss notice endpoints of the bidder.
+// The bids are throttled and their budget is reserved in the ledger, the win notice commits it, the loss notice releases it.
+type bidHandler struct {
+	ledger   *Ledger
+	selector *Selector
+}
+
+// newBidHandler creates the HTTP handler of the bidder.
+// The endpoints are:
+// - POST /bid with BidRequest, it replies with BidResponse or 204 No Content if there is no bid,
+// - POST /win?bid={id}&price={cpm}, the price is the clearing price, the bid price if missing,
+// - POST /loss?bid={id}.
+// The notices are accepted only with POST, so a crawler or a prefetch following the URL does not commit the spend.
+// The line items to bid with are picked by the selector.
+func newBidHandler(ledger *Ledger, selector *Selector) http.Handler {
+	h := &bidHandler{ledger: ledger, selector: selector}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bid", h.bid)
+	mux.HandleFunc("/win", h.win)
+	mux.HandleFunc("/loss", h.loss)
+	return mux
+}
+
+func (h *bidHandler) bid(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req BidRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("cannot decode bid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	res := BidResponse{ID: req.ID, SeatBid: []SeatBid{{}}}
+	for _, imp := range req.Imp {
+		if bid, ok := h.bidOn(r, req.Attributes, imp); ok {
+			res.SeatBid[0].Bid = append(res.SeatBid[0].Bid, bid)
+		}
+	}
+	if len(res.SeatBid[0].Bid) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("(bidder) cannot write bid response %s", req.ID))
+	}
+}
+
+// bidOn reserves the budget of the selected line item for the bid on the impression.
+func (h *bidHandler) bidOn(r *http.Request, attrs Attributes, imp Impression) (Bid, bool) {
+	sel, ok := h.selector.Select(attrs, imp.BidFloor)
+	if !ok {
+		return Bid{}, false
+	}
+	res, err := h.ledger.Reserve(sel.LineItem, sel.Amount)
+	if err != nil {
+		return Bid{}, false
+	}
+	bidID := strconv.FormatUint(uint64(res), 10)
+	return Bid{
+		ID:       bidID,
+		ImpID:    imp.ID,
+		Price:    sel.Price,
+		LineItem: sel.LineItem,
+		NURL:     fmt.Sprintf("%s/win?bid=%s&price=%s", baseURL(r), bidID, AuctionPriceMacro),
+		LURL:     fmt.Sprintf("%s/loss?bid=%s", baseURL(r), bidID),
+	}, true
+}
+
+func (h *bidHandler) win(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := reservationParam(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v := r.URL.Query().Get("price")
+	if v == "" {
+		// The bid price is spent when the exchange does not tell the clearing price
+		amount, ok := h.ledger.Reserved(id)
+		if !ok {
+			writeNoticeResult(w, ErrUnknownReservation)
+			return
+		}
+		writeNoticeResult(w, h.ledger.Commit(id, amount))
+		return
+	}
+	price, err := strconv.ParseFloat(v, 64)
+	if err != nil || price <= 0 {
+		http.Error(w, fmt.Sprintf("invalid price %q", v), http.StatusBadRequest)
+		return
+	}
+	writeNoticeResult(w, h.ledger.Commit(id, cpmToAmount(price)))
+}
+
+func (h *bidHandler) loss(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := reservationParam(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeNoticeResult(w, h.ledger.Release(id))
+}
+
+// reservationParam parses the bid ID of the notice.
+func reservationParam(query url.Values) (ReservationID, error) {
+	id, err := strconv.ParseUint(query.Get("bid"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bid %q", query.Get("bid"))
+	}
+	return ReservationID(id), nil
+}
+
+// writeNoticeResult replies to the notice with the status of the ledger operation.
+func writeNoticeResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	case errors.Is(err, ErrUnknownReservation):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInsufficientBudget):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// baseURL returns the URL of the bidder the request was sent to.
+func baseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
@@ -0,0 +1,109 @@
+package pacing
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postBidRequest(t *testing.T, srv *httptest.Server, req BidRequest) (*http.Response, BidResponse) {
+	enc, err := json.Marshal(req)
+	require.NoError(t, err)
+	res, err := http.Post(srv.URL+"/bid", "application/json", bytes.NewReader(enc))
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	var bids BidResponse
+	if res.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&bids))
+	}
+	return res, bids
+}
+
+func postNotice(t *testing.T, url string) int {
+	res, err := http.Post(url, "", nil)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	return res.StatusCode
+}
+
+func TestBidHandler(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+	ledger, id := newTestLedger(&now, cpmToAmount(2)*3)
+	ledger.random = func() float64 { return 0 }
+	srv := httptest.NewServer(newBidHandler(ledger, NewSelector(ledger, NewMetadataCache(), 2)))
+	defer srv.Close()
+
+	res, bids := postBidRequest(t, srv, BidRequest{ID: "req-1", Imp: []Impression{{ID: "imp-1"}, {ID: "imp-2", BidFloor: 3}}})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "req-1", bids.ID)
+	require.Len(t, bids.SeatBid, 1)
+	require.Len(t, bids.SeatBid[0].Bid, 1)
+	won := bids.SeatBid[0].Bid[0]
+	assert.Equal(t, "imp-1", won.ImpID)
+	assert.Equal(t, 2.0, won.Price)
+	assert.Equal(t, id, won.LineItem)
+	assert.Equal(t, cpmToAmount(2)*2, ledger.Remaining(id))
+
+	_, bids = postBidRequest(t, srv, BidRequest{ID: "req-2", Imp: []Impression{{ID: "imp-1"}}})
+	lost := bids.SeatBid[0].Bid[0]
+
+	// The notices are not followed with GET, e.g. by a crawler.
+	res, err := http.Get(strings.Replace(won.NURL, AuctionPriceMacro, "1.5", 1))
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	res, err = http.Get(lost.LURL)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	assert.Equal(t, int64(0), ledger.Committed(id))
+	assert.Equal(t, cpmToAmount(2), ledger.Remaining(id))
+
+	// The win notice commits the clearing price, the loss notice releases the budget.
+	assert.Equal(t, http.StatusOK, postNotice(t, strings.Replace(won.NURL, AuctionPriceMacro, "1.5", 1)))
+	assert.Equal(t, http.StatusOK, postNotice(t, lost.LURL))
+	assert.Equal(t, cpmToAmount(1.5), ledger.Committed(id))
+	assert.Equal(t, cpmToAmount(2)*3-cpmToAmount(1.5), ledger.Remaining(id))
+	assert.Equal(t, http.StatusNotFound, postNotice(t, lost.LURL))
+	assert.Equal(t, http.StatusBadRequest, postNotice(t, srv.URL+"/win?bid=invalid"))
+
+	// There is no bid without enough budget.
+	_, err = ledger.Reserve(id, ledger.Remaining(id)-1)
+	require.NoError(t, err)
+	res, _ = postBidRequest(t, srv, BidRequest{ID: "req-3", Imp: []Impression{{ID: "imp-1"}}})
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, err = http.Post(srv.URL+"/bid", "application/json", strings.NewReader("invalid"))
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestBidHandlerUsesMetadataPrice(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+	ledger, id := newTestLedger(&now, cpmToAmount(5))
+	ledger.random = func() float64 { return 0 }
+	metadata := NewMetadataCache()
+	u, err := NewMetadataUpdate(map[uuid.UUID]json.RawMessage{id: json.RawMessage(`{"bid_price":4}`)})
+	require.NoError(t, err)
+	metadata.Update(u)
+	srv := httptest.NewServer(newBidHandler(ledger, NewSelector(ledger, metadata, 2)))
+	defer srv.Close()
+
+	_, bids := postBidRequest(t, srv, BidRequest{ID: "req-1", Imp: []Impression{{ID: "imp-1", BidFloor: 3}}})
+	require.Len(t, bids.SeatBid, 1)
+	require.Len(t, bids.SeatBid[0].Bid, 1)
+	bid := bids.SeatBid[0].Bid[0]
+	assert.Equal(t, 4.0, bid.Price)
+
+	// The bid price is committed when the win notice has no clearing price.
+	assert.Equal(t, http.StatusOK, postNotice(t, strings.Replace(bid.NURL, "&price="+AuctionPriceMacro, "", 1)))
+	assert.Equal(t, cpmToAmount(4), ledger.Committed(id))
+}
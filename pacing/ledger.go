@@ -0,0 +1,479 @@
+package pacing
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"math"
+	"math/rand"
+	"pacing.go/dispatcher"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultReservationTTL is how long a reservation holds the budget if it is neither committed nor released.
+const DefaultReservationTTL = 10 * time.Second
+
+// DefaultRebalanceSurplus is the fraction of the round's allowance the bidder keeps over its expected spend,
+// the rest is returned, see WithRebalancing.
+const DefaultRebalanceSurplus = 0.1
+
+// DefaultRebalanceWatermark is the fraction of the round's allowance below which the bidder asks for a top-up,
+// see WithRebalancing.
+const DefaultRebalanceWatermark = 0.2
+
+// throttleHalfLife is the time after which the observed requests and spend lose half of their weight in the throttling.
+const throttleHalfLife = 10 * time.Second
+
+var (
+	// ErrInsufficientBudget is returned when the amount exceeds the remaining allowance of the line item.
+	ErrInsufficientBudget = errors.New("insufficient budget")
+	// ErrUnknownReservation is returned when the reservation does not exist, it has been committed, released or expired.
+	ErrUnknownReservation = errors.New("unknown reservation")
+	// ErrInvalidAmount is returned when the amount is not positive.
+	ErrInvalidAmount = errors.New("invalid amount")
+	// ErrDraining is returned when the budget is reserved after the ledger has started draining.
+	ErrDraining = errors.New("ledger is draining")
+)
+
+// ReservationID identifies the reservation in the ledger.
+type ReservationID uint64
+
+// reservation holds the budget of a line item between the bid and the win or loss notice.
+type reservation struct {
+	lineItem uuid.UUID
+	amount   int64
+	expires  time.Time
+}
+
+// ledgerItem is the budget of a line item in the current round of its source.
+type ledgerItem struct {
+	source    string
+	round     uint64
+	lease     time.Time
+	allowance int64
+	committed int64
+	reserved  int64
+	// received is the time the round was received, initial is the allowance of the round before adjustments
+	received time.Time
+	initial  int64
+	// since is the time of the first request, requests, allowed bids and cost of bids are the recent ones
+	since    time.Time
+	requests decayingSum
+	allowed  decayingSum
+	cost     decayingSum
+}
+
+// remaining returns the budget which may be reserved, there is none when the lease has lapsed.
+func (it *ledgerItem) remaining(now time.Time) int64 {
+	if !it.lease.After(now) {
+		return 0
+	}
+	if r := it.allowance - it.committed - it.reserved; r > 0 {
+		return r
+	}
+	return 0
+}
+
+// spendRate returns the recent spend per second, including the outstanding reservations.
+// The decaying sum is divided by its value for the rate of one unit per second since the first request,
+// so the rate is not underestimated before the sum converges.
+func (it *ledgerItem) spendRate(now time.Time) float64 {
+	elapsed := now.Sub(it.since)
+	if elapsed < time.Second {
+		elapsed = time.Second
+	}
+	window := throttleHalfLife.Seconds() / math.Ln2 * (1 - math.Exp2(-elapsed.Seconds()/throttleHalfLife.Seconds()))
+	return it.cost.decayed(now, throttleHalfLife).value / window
+}
+
+// unthrottledRate returns the recent spend per second scaled up to the spend without throttling,
+// as the spend is observed with the recent share of allowed bids.
+func (it *ledgerItem) unthrottledRate(now time.Time) float64 {
+	spend := it.spendRate(now)
+	requests := it.requests.decayed(now, throttleHalfLife).value
+	allowed := it.allowed.decayed(now, throttleHalfLife).value
+	if requests <= 0 || allowed <= 0 {
+		return spend
+	}
+	return spend * requests / allowed
+}
+
+// probability returns the chance of bidding which spends the remaining budget evenly until the lease lapses.
+// The remaining budget per second left is compared with the recent spend per second without throttling,
+// the outstanding reservations are expected to win.
+func (it *ledgerItem) probability(remaining int64, now time.Time) float64 {
+	unthrottled := it.unthrottledRate(now)
+	if unthrottled <= 0 {
+		return 1
+	}
+	target := float64(remaining) / it.lease.Sub(now).Seconds()
+	if unthrottled <= target {
+		return 1
+	}
+	return target / unthrottled
+}
+
+// Ledger keeps track of the budget the bidder may still spend per line item.
+// It is fed by workloads, every round of a source brings new allowances and resets the committed spend.
+// The budget is reserved at bid time, and the reservation is committed on a win or released on a loss.
+// Reservations which are neither committed nor released expire after the TTL and give the budget back.
+// The committed and reserved budget never exceeds the allowance of the round.
+// ShouldBid throttles the bids, so the allowance is spent evenly over its lease instead of its first seconds.
+type Ledger struct {
+	mu           sync.Mutex
+	now          func() time.Time
+	random       func() float64
+	ttl          time.Duration
+	items        map[uuid.UUID]*ledgerItem
+	reservations map[ReservationID]reservation
+	queue        []ReservationID
+	next         ReservationID
+	draining     bool
+	// commits is called with every committed amount and the source of the allowance, outside the lock.
+	commits func(source string, lineItem uuid.UUID, amount int64)
+}
+
+// NewLedger creates an empty Ledger, the reservations expire after given TTL or DefaultReservationTTL if not positive.
+func NewLedger(ttl time.Duration) *Ledger {
+	if ttl <= 0 {
+		ttl = DefaultReservationTTL
+	}
+	return &Ledger{
+		now:          time.Now,
+		random:       rand.Float64,
+		ttl:          ttl,
+		items:        map[uuid.UUID]*ledgerItem{},
+		reservations: map[ReservationID]reservation{},
+	}
+}
+
+// Update sets the allowances of the workload source. The committed spend is reset when the workload starts a new round,
+// outstanding reservations are kept and count against the new allowances. The workload of the same round
+// adjusts the allowances, e.g. after they are returned or topped up.
+// The line items of the source missing in the workload get no allowance.
+func (l *Ledger) Update(w dispatcher.Workload) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, it := range l.items {
+		if _, ok := w.Allowances[id]; !ok && it.source == w.Source {
+			it.allowance = 0
+		}
+	}
+	now := l.now()
+	for id, allowance := range w.Allowances {
+		it, ok := l.items[id]
+		if !ok {
+			it = &ledgerItem{}
+			l.items[id] = it
+		}
+		if !ok || it.source != w.Source || it.round != w.Round {
+			it.committed, it.received, it.initial = 0, now, allowance
+		}
+		it.source, it.round, it.lease, it.allowance = w.Source, w.Round, w.Lease, allowance
+	}
+}
+
+// Reserve holds the amount of the line item's budget, it fails if the remaining allowance is not sufficient.
+func (l *Ledger) Reserve(lineItem uuid.UUID, amount int64) (ReservationID, error) {
+	if amount <= 0 {
+		return 0, ErrInvalidAmount
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.draining {
+		return 0, ErrDraining
+	}
+	now := l.now()
+	l.expire(now)
+	it, ok := l.items[lineItem]
+	if !ok || it.remaining(now) < amount {
+		return 0, ErrInsufficientBudget
+	}
+	it.reserved += amount
+	it.cost = it.cost.add(float64(amount), now, throttleHalfLife)
+	l.next++
+	l.reservations[l.next] = reservation{lineItem: lineItem, amount: amount, expires: now.Add(l.ttl)}
+	l.queue = append(l.queue, l.next)
+	return l.next, nil
+}
+
+// Commit spends the amount of the reservation, e.g. the clearing price from the win notice.
+// The amount may differ from the reserved one, but the excess must fit in the remaining allowance.
+func (l *Ledger) Commit(id ReservationID, amount int64) error {
+	if amount <= 0 {
+		return ErrInvalidAmount
+	}
+	l.mu.Lock()
+	now := l.now()
+	l.expire(now)
+	res, ok := l.reservations[id]
+	if !ok {
+		l.mu.Unlock()
+		return ErrUnknownReservation
+	}
+	it := l.items[res.lineItem]
+	if amount > res.amount && it.remaining(now) < amount-res.amount {
+		l.mu.Unlock()
+		return ErrInsufficientBudget
+	}
+	delete(l.reservations, id)
+	source := it.source
+	it.reserved -= res.amount
+	it.committed += amount
+	it.cost = it.cost.add(float64(amount-res.amount), now, throttleHalfLife)
+	l.mu.Unlock()
+	if l.commits != nil {
+		l.commits(source, res.lineItem, amount)
+	}
+	return nil
+}
+
+// Release gives the budget of the reservation back, e.g. on the loss notice or the bid timeout.
+func (l *Ledger) Release(id ReservationID) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.expire(now)
+	res, ok := l.reservations[id]
+	if !ok {
+		return ErrUnknownReservation
+	}
+	l.release(id, res, now)
+	return nil
+}
+
+// Reserved returns the amount of the reservation, it returns false if the reservation does not exist.
+func (l *Ledger) Reserved(id ReservationID) (int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(l.now())
+	res, ok := l.reservations[id]
+	return res.amount, ok
+}
+
+// ShouldBid tells whether to bid on the request for the line item. The bid is throttled with the probability
+// adapted to the recent spend, so the remaining allowance is spent evenly until the lease lapses.
+// Every call is counted as a request for the line item.
+func (l *Ledger) ShouldBid(lineItem uuid.UUID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.expire(now)
+	it, ok := l.items[lineItem]
+	if !ok || l.draining {
+		return false
+	}
+	if it.since.IsZero() {
+		it.since = now
+	}
+	it.requests = it.requests.add(1, now, throttleHalfLife)
+	remaining := it.remaining(now)
+	if remaining <= 0 || l.random() >= it.probability(remaining, now) {
+		return false
+	}
+	it.allowed = it.allowed.add(1, now, throttleHalfLife)
+	return true
+}
+
+// Drain stops new reservations, the outstanding ones may still be committed or released.
+func (l *Ledger) Drain() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.draining = true
+}
+
+// Outstanding returns the number of reservations neither committed, released nor expired.
+func (l *Ledger) Outstanding() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(l.now())
+	return len(l.reservations)
+}
+
+// Remaining returns the budget of the line item which may be reserved.
+func (l *Ledger) Remaining(lineItem uuid.UUID) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.expire(now)
+	it, ok := l.items[lineItem]
+	if !ok {
+		return 0
+	}
+	return it.remaining(now)
+}
+
+// Available returns the budget which may be reserved of all line items having some.
+func (l *Ledger) Available() map[uuid.UUID]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.expire(now)
+	res := make(map[uuid.UUID]int64, len(l.items))
+	for id, it := range l.items {
+		if remaining := it.remaining(now); remaining > 0 {
+			res[id] = remaining
+		}
+	}
+	return res
+}
+
+// imbalances returns the budget of line items the bidder is not expected to spend and the top-ups of those
+// it is expected to run out of, see WithRebalancing. The line item is expected to spend at its recent pace
+// until the lease lapses, it is left alone until its round has been held for given time, the fallback allowances
+// are not adjustable at all. The budget exceeding
+// the expected spend by more than the surplus fraction of the round's allowance is returned. The top-up is due
+// when the remaining budget falls below the watermark fraction of the round's allowance and the expected spend exceeds it.
+func (l *Ledger) imbalances(surplus, watermark float64, held time.Duration) (returns, topUps map[uuid.UUID]int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.expire(now)
+	returns, topUps = map[uuid.UUID]int64{}, map[uuid.UUID]int64{}
+	if l.draining {
+		return returns, topUps
+	}
+	for id, it := range l.items {
+		if it.source == fallbackSource || !it.lease.After(now) || now.Sub(it.received) < held {
+			continue
+		}
+		remaining := float64(it.remaining(now))
+		expected := it.unthrottledRate(now) * it.lease.Sub(now).Seconds()
+		if excess := remaining - expected - surplus*float64(it.initial); excess >= 1 {
+			returns[id] = int64(excess)
+		} else if remaining < watermark*float64(it.initial) && expected-remaining >= 1 {
+			topUps[id] = int64(expected - remaining)
+		}
+	}
+	return returns, topUps
+}
+
+// each calls given function with the allowance and the remaining budget of every line item having some budget.
+// The function is called with the lock held, it must not call the ledger.
+func (l *Ledger) each(fn func(lineItem uuid.UUID, allowance int64, remaining int64)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.expire(now)
+	for id, it := range l.items {
+		if remaining := it.remaining(now); remaining > 0 {
+			fn(id, it.allowance, remaining)
+		}
+	}
+}
+
+// Committed returns the budget of the line item spent in the current round.
+func (l *Ledger) Committed(lineItem uuid.UUID) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if it, ok := l.items[lineItem]; ok {
+		return it.committed
+	}
+	return 0
+}
+
+// ledgerSnapshot is the encoded state of Ledger, the throttling statistics are not kept.
+type ledgerSnapshot struct {
+	Items        map[uuid.UUID]itemSnapshot            `json:"items"`
+	Reservations map[ReservationID]reservationSnapshot `json:"reservations,omitempty"`
+	Next         ReservationID                         `json:"next"`
+}
+
+type itemSnapshot struct {
+	Source    string    `json:"source,omitempty"`
+	Round     uint64    `json:"round"`
+	Lease     time.Time `json:"lease"`
+	Allowance int64     `json:"allowance"`
+	Committed int64     `json:"committed"`
+}
+
+type reservationSnapshot struct {
+	LineItem uuid.UUID `json:"line_item"`
+	Amount   int64     `json:"amount"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Snapshot encodes the budgets and the outstanding reservations, so they survive the restart of the bidder.
+func (l *Ledger) Snapshot() ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(l.now())
+	snapshot := ledgerSnapshot{
+		Items:        make(map[uuid.UUID]itemSnapshot, len(l.items)),
+		Reservations: make(map[ReservationID]reservationSnapshot, len(l.reservations)),
+		Next:         l.next,
+	}
+	for id, it := range l.items {
+		snapshot.Items[id] = itemSnapshot{Source: it.source, Round: it.round, Lease: it.lease, Allowance: it.allowance, Committed: it.committed}
+	}
+	for id, res := range l.reservations {
+		snapshot.Reservations[id] = reservationSnapshot{LineItem: res.lineItem, Amount: res.amount, Expires: res.expires}
+	}
+	return json.Marshal(snapshot)
+}
+
+// Restore replaces the budgets and reservations with the encoded ones.
+// The line items with lapsed leases and the expired reservations are dropped.
+func (l *Ledger) Restore(data []byte) error {
+	var restored ledgerSnapshot
+	if err := json.Unmarshal(data, &restored); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	items := make(map[uuid.UUID]*ledgerItem, len(restored.Items))
+	for id, it := range restored.Items {
+		if it.Lease.After(now) {
+			items[id] = &ledgerItem{source: it.Source, round: it.Round, lease: it.Lease, allowance: it.Allowance, committed: it.Committed,
+				received: now, initial: it.Allowance}
+		}
+	}
+	reservations := make(map[ReservationID]reservation, len(restored.Reservations))
+	queue := make([]ReservationID, 0, len(restored.Reservations))
+	for id, res := range restored.Reservations {
+		it, ok := items[res.LineItem]
+		if !ok || !res.Expires.After(now) {
+			continue
+		}
+		it.reserved += res.Amount
+		reservations[id] = reservation{lineItem: res.LineItem, amount: res.Amount, expires: res.Expires}
+		queue = append(queue, id)
+	}
+	sort.Slice(queue, func(i, j int) bool { return reservations[queue[i]].expires.Before(reservations[queue[j]].expires) })
+	l.items, l.reservations, l.queue = items, reservations, queue
+	if restored.Next > l.next {
+		l.next = restored.Next
+	}
+	return nil
+}
+
+// release gives the budget of the reservation back, the bid is not expected to spend anymore.
+// It must be called with the lock held.
+func (l *Ledger) release(id ReservationID, res reservation, now time.Time) {
+	delete(l.reservations, id)
+	it := l.items[res.lineItem]
+	it.reserved -= res.amount
+	it.cost = it.cost.add(-float64(res.amount), now, throttleHalfLife)
+}
+
+// expire releases the reservations expired by now, it must be called with the lock held.
+// All reservations live for the same TTL, so the queue is ordered by expiration.
+func (l *Ledger) expire(now time.Time) {
+	n := 0
+	for _, id := range l.queue {
+		res, ok := l.reservations[id]
+		if !ok {
+			n++
+			continue
+		}
+		if res.expires.After(now) {
+			break
+		}
+		l.release(id, res, now)
+		n++
+	}
+	l.queue = l.queue[n:]
+}
@@ -0,0 +1,315 @@
+package pacing
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"pacing.go/dispatcher"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLedger(now *time.Time, allowance int64) (*Ledger, uuid.UUID) {
+	id := uuid.New()
+	l := NewLedger(time.Second)
+	l.now = func() time.Time { return *now }
+	l.Update(dispatcher.Workload{Lease: now.Add(time.Minute), Round: 1, Allowances: dispatcher.Allowances{id: allowance}})
+	return l, id
+}
+
+func TestLedger(t *testing.T) {
+	tests := []struct {
+		name          string
+		reserve       []int64
+		commit        []int64
+		release       []int
+		wantRemaining int64
+		wantCommitted int64
+	}{
+		{"reserved", []int64{30, 40}, nil, nil, 30, 0},
+		{"committed", []int64{30, 40}, []int64{30}, nil, 30, 30},
+		{"committed less", []int64{30, 40}, []int64{10}, nil, 50, 10},
+		{"committed more", []int64{30, 40}, []int64{50}, nil, 10, 50},
+		{"released", []int64{30, 40}, nil, []int{1}, 70, 0},
+		{"committed and released", []int64{30, 40}, []int64{30}, []int{1}, 70, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+			l, id := newTestLedger(&now, 100)
+			var reservations []ReservationID
+			for _, amount := range tt.reserve {
+				res, err := l.Reserve(id, amount)
+				require.NoError(t, err)
+				reservations = append(reservations, res)
+			}
+			for i, amount := range tt.commit {
+				assert.NoError(t, l.Commit(reservations[i], amount))
+			}
+			for _, i := range tt.release {
+				assert.NoError(t, l.Release(reservations[i]))
+			}
+			assert.Equal(t, tt.wantRemaining, l.Remaining(id))
+			assert.Equal(t, tt.wantCommitted, l.Committed(id))
+		})
+	}
+}
+
+func TestLedgerNeverExceedsAllowance(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+	l, id := newTestLedger(&now, 100)
+
+	_, err := l.Reserve(uuid.New(), 1)
+	assert.ErrorIs(t, err, ErrInsufficientBudget)
+	_, err = l.Reserve(id, 0)
+	assert.ErrorIs(t, err, ErrInvalidAmount)
+	_, err = l.Reserve(id, 101)
+	assert.ErrorIs(t, err, ErrInsufficientBudget)
+
+	first, err := l.Reserve(id, 60)
+	require.NoError(t, err)
+	second, err := l.Reserve(id, 40)
+	require.NoError(t, err)
+	_, err = l.Reserve(id, 1)
+	assert.ErrorIs(t, err, ErrInsufficientBudget)
+
+	// The excess over the reservation must fit in the remaining allowance.
+	assert.ErrorIs(t, l.Commit(first, 61), ErrInsufficientBudget)
+	assert.NoError(t, l.Commit(first, 60))
+	assert.ErrorIs(t, l.Commit(first, 60), ErrUnknownReservation)
+	assert.ErrorIs(t, l.Release(first), ErrUnknownReservation)
+	assert.NoError(t, l.Release(second))
+	assert.Equal(t, int64(40), l.Remaining(id))
+
+	// Nothing can be spent when the lease lapses.
+	now = now.Add(time.Minute)
+	assert.Equal(t, int64(0), l.Remaining(id))
+	_, err = l.Reserve(id, 1)
+	assert.ErrorIs(t, err, ErrInsufficientBudget)
+}
+
+func TestLedgerExpiresReservations(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+	l, id := newTestLedger(&now, 100)
+
+	first, err := l.Reserve(id, 60)
+	require.NoError(t, err)
+	now = now.Add(time.Second / 2)
+	second, err := l.Reserve(id, 40)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), l.Remaining(id))
+
+	now = now.Add(time.Second / 2)
+	assert.Equal(t, int64(60), l.Remaining(id))
+	assert.ErrorIs(t, l.Commit(first, 60), ErrUnknownReservation)
+	assert.NoError(t, l.Commit(second, 40))
+	assert.Equal(t, int64(60), l.Remaining(id))
+}
+
+func TestLedgerUpdate(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+	l, id := newTestLedger(&now, 100)
+	other := uuid.New()
+
+	committed, err := l.Reserve(id, 30)
+	require.NoError(t, err)
+	require.NoError(t, l.Commit(committed, 30))
+	_, err = l.Reserve(id, 20)
+	require.NoError(t, err)
+
+	// Adjustments within the round keep the committed spend.
+	l.Update(dispatcher.Workload{Lease: now.Add(time.Minute), Round: 1, Allowances: dispatcher.Allowances{id: 80, other: 10}})
+	assert.Equal(t, int64(30), l.Remaining(id))
+	assert.Equal(t, int64(10), l.Remaining(other))
+
+	// The new round resets the committed spend, but the outstanding reservations hold the budget.
+	l.Update(dispatcher.Workload{Lease: now.Add(time.Minute), Round: 2, Allowances: dispatcher.Allowances{id: 100}})
+	assert.Equal(t, int64(80), l.Remaining(id))
+	assert.Equal(t, int64(0), l.Committed(id))
+	assert.Equal(t, int64(0), l.Remaining(other))
+}
+
+func TestLedgerIsConcurrencySafe(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+	l, id := newTestLedger(&now, 1000)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				res, err := l.Reserve(id, 1)
+				if err != nil {
+					continue
+				}
+				if j%2 == 0 {
+					_ = l.Commit(res, 1)
+				} else {
+					_ = l.Release(res)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1000), l.Committed(id))
+	assert.Equal(t, int64(0), l.Remaining(id))
+}
+
+func TestLedgerShouldBid(t *testing.T) {
+	tests := []struct {
+		name      string
+		lease     time.Duration
+		allowance int64
+		every     int
+		random    float64
+		want      bool
+	}{
+		// After 10 seconds of spending 10 per second, the rest of the lease is expected to spend 500.
+		{"enough budget", time.Minute, 1100, 1, 0.99, true},
+		{"throttled", time.Minute, 300, 1, 0.39, true},
+		{"throttled out", time.Minute, 300, 1, 0.41, false},
+		// The lease lapsing before the end of the slot is expected to spend 100 only.
+		{"short lease", 20 * time.Second, 300, 1, 0.99, true},
+		// The requests not bid on do not spend, the rest of the lease is expected to spend 250.
+		{"requests without bids", time.Minute, 320, 2, 0.99, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+			id := uuid.New()
+			l := NewLedger(time.Second)
+			l.now = func() time.Time { return now }
+			l.Update(dispatcher.Workload{Lease: now.Add(tt.lease), Round: 1, Allowances: dispatcher.Allowances{id: tt.allowance}})
+			l.random = func() float64 { return 0 }
+			for i := 0; i < 100; i++ {
+				now = now.Add(100 * time.Millisecond)
+				require.True(t, l.ShouldBid(id))
+				if i%tt.every != 0 {
+					continue
+				}
+				res, err := l.Reserve(id, 2)
+				require.NoError(t, err)
+				// Half of the bids win.
+				if i/tt.every%2 == 0 {
+					require.NoError(t, l.Commit(res, 2))
+				} else {
+					require.NoError(t, l.Release(res))
+				}
+			}
+			l.random = func() float64 { return tt.random }
+			assert.Equal(t, tt.want, l.ShouldBid(id))
+		})
+	}
+	t.Run("no budget", func(t *testing.T) {
+		now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+		l, id := newTestLedger(&now, 100)
+		l.random = func() float64 { return 0 }
+		assert.False(t, l.ShouldBid(uuid.New()))
+		_, err := l.Reserve(id, 100)
+		require.NoError(t, err)
+		assert.False(t, l.ShouldBid(id))
+	})
+}
+
+func TestLedgerImbalances(t *testing.T) {
+	tests := []struct {
+		name       string
+		spend      int64
+		held       time.Duration
+		wantReturn int64
+		wantTopUp  int64
+	}{
+		// After 10 seconds, the rest of the lease is expected to spend 50 times the spend per second.
+		{"no traffic", 0, time.Second, 900, 0},
+		{"surplus", 1, time.Second, 300, 0},
+		{"balanced", 2, time.Second, 0, 0},
+		{"running out", 9, time.Second, 0, 4400},
+		{"not held long enough", 0, time.Minute, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+			l, id := newTestLedger(&now, 1000)
+			l.random = func() float64 { return 0 }
+			for i := 0; i < 100; i++ {
+				now = now.Add(100 * time.Millisecond)
+				if tt.spend == 0 {
+					continue
+				}
+				require.True(t, l.ShouldBid(id))
+				res, err := l.Reserve(id, tt.spend)
+				require.NoError(t, err)
+				require.NoError(t, l.Commit(res, tt.spend))
+			}
+			returns, topUps := l.imbalances(0.1, 0.2, tt.held)
+			assert.InDelta(t, tt.wantReturn, returns[id], 10)
+			assert.InDelta(t, tt.wantTopUp, topUps[id], 50)
+		})
+	}
+}
+
+func TestLedgerSnapshot(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+	l, id := newTestLedger(&now, 100)
+	committed, err := l.Reserve(id, 30)
+	require.NoError(t, err)
+	require.NoError(t, l.Commit(committed, 30))
+	reserved, err := l.Reserve(id, 20)
+	require.NoError(t, err)
+	snapshot, err := l.Snapshot()
+	require.NoError(t, err)
+
+	t.Run("restored", func(t *testing.T) {
+		restored := NewLedger(time.Second)
+		restored.now = func() time.Time { return now }
+		require.NoError(t, restored.Restore(snapshot))
+		assert.Equal(t, int64(50), restored.Remaining(id))
+		assert.Equal(t, int64(30), restored.Committed(id))
+		// The reservation made before the restart can be committed, the new ones get new IDs.
+		assert.NoError(t, restored.Commit(reserved, 20))
+		res, err := restored.Reserve(id, 10)
+		require.NoError(t, err)
+		assert.Greater(t, res, reserved)
+	})
+
+	t.Run("expired reservation", func(t *testing.T) {
+		restored := NewLedger(time.Second)
+		later := now.Add(time.Second)
+		restored.now = func() time.Time { return later }
+		require.NoError(t, restored.Restore(snapshot))
+		assert.Equal(t, int64(70), restored.Remaining(id))
+		assert.ErrorIs(t, restored.Commit(reserved, 20), ErrUnknownReservation)
+	})
+
+	t.Run("lapsed lease", func(t *testing.T) {
+		restored := NewLedger(time.Second)
+		later := now.Add(time.Minute)
+		restored.now = func() time.Time { return later }
+		require.NoError(t, restored.Restore(snapshot))
+		assert.Empty(t, restored.Available())
+		assert.Equal(t, int64(0), restored.Committed(id))
+	})
+}
+
+func TestLedgerDrain(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+	l, id := newTestLedger(&now, 100)
+	first, err := l.Reserve(id, 10)
+	require.NoError(t, err)
+	second, err := l.Reserve(id, 20)
+	require.NoError(t, err)
+
+	l.Drain()
+	_, err = l.Reserve(id, 10)
+	assert.ErrorIs(t, err, ErrDraining)
+	assert.False(t, l.ShouldBid(id))
+	assert.Equal(t, 2, l.Outstanding())
+
+	// The in-flight reservations are finished.
+	assert.NoError(t, l.Commit(first, 10))
+	assert.NoError(t, l.Release(second))
+	assert.Equal(t, 0, l.Outstanding())
+	assert.Equal(t, int64(90), l.Remaining(id))
+}
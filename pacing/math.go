@@ -1,5 +1,11 @@
 package pacing
 
+import (
+	"math"
+	"sort"
+	"time"
+)
+
 func Sum(a []int64) int64 {
 	var s int64
 	for _, v := range a {
@@ -7,3 +13,85 @@ func Sum(a []int64) int64 {
 	}
 	return s
 }
+
+// Apportion splits the total into integer shares proportional to the weights, the shares sum up exactly to the total.
+// It uses the largest remainder method: every share gets the integer part of its quota first
+// and the units left are given to the shares with the largest fractional parts (ties go to the lower index).
+// Non-positive weights get no share. If no weight is positive or the total is not positive all shares are zero.
+func Apportion(total int64, weights []float64) []int64 {
+	shares := make([]int64, len(weights))
+	var sum float64
+	for _, w := range weights {
+		if w > 0 {
+			sum += w
+		}
+	}
+	if total <= 0 || sum <= 0 {
+		return shares
+	}
+	remainders := make([]float64, len(weights))
+	left := total
+	for i, w := range weights {
+		if w <= 0 {
+			continue
+		}
+		quota := float64(total) * w / sum
+		shares[i] = int64(math.Floor(quota))
+		remainders[i] = quota - float64(shares[i])
+		left -= shares[i]
+	}
+	order := make([]int, 0, len(weights))
+	for i, w := range weights {
+		if w > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	// Floating point errors may leave more units than shares, so the loop wraps around.
+	for i := 0; left > 0; i = (i + 1) % len(order) {
+		shares[order[i]]++
+		left--
+	}
+	// Floating point errors may also give away too much, it is taken back from the largest shares.
+	for left < 0 {
+		largest := 0
+		for i := range shares {
+			if shares[i] > shares[largest] {
+				largest = i
+			}
+		}
+		shares[largest]--
+		left++
+	}
+	return shares
+}
+
+// decayingSum is the exponentially decaying sum of values observed at given time.
+type decayingSum struct {
+	value float64
+	at    time.Time
+}
+
+// decayed returns the sum decayed until given time.
+func (s decayingSum) decayed(now time.Time, halfLife time.Duration) decayingSum {
+	if !s.at.IsZero() && now.After(s.at) {
+		s.value *= math.Exp2(-now.Sub(s.at).Seconds() / halfLife.Seconds())
+	}
+	s.at = now
+	return s
+}
+
+// add returns the sum decayed until given time with the value added.
+func (s decayingSum) add(value float64, now time.Time, halfLife time.Duration) decayingSum {
+	s = s.decayed(now, halfLife)
+	s.value += value
+	return s
+}
+
+// rate returns the per second rate of the values added to the sum.
+func (s decayingSum) rate(now time.Time, halfLife time.Duration) float64 {
+	// The decaying sum converges to rate * halfLife / ln(2) for a constant rate.
+	return s.decayed(now, halfLife).value * math.Ln2 / halfLife.Seconds()
+}
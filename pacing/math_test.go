@@ -2,6 +2,7 @@ package pacing
 
 import (
 	"github.com/stretchr/testify/assert"
+	"math"
 	"testing"
 )
 
@@ -25,3 +26,39 @@ func TestSum(t *testing.T) {
 		})
 	}
 }
+
+func TestApportion(t *testing.T) {
+	type args struct {
+		total   int64
+		weights []float64
+	}
+	tests := []struct {
+		name string
+		args args
+		want []int64
+	}{
+		{"no weights", args{10, []float64{}}, []int64{}},
+		{"equal without remainder", args{9, []float64{1, 1, 1}}, []int64{3, 3, 3}},
+		{"equal with remainder", args{10, []float64{1, 1, 1}}, []int64{4, 3, 3}},
+		{"total smaller than number of weights", args{2, []float64{1, 1, 1}}, []int64{1, 1, 0}},
+		{"proportional", args{100, []float64{1, 3}}, []int64{25, 75}},
+		{"largest remainder wins", args{10, []float64{1, 2, 4}}, []int64{1, 3, 6}},
+		{"zero and negative weights", args{10, []float64{0, -1, 2}}, []int64{0, 0, 10}},
+		{"all weights zero", args{10, []float64{0, 0}}, []int64{0, 0}},
+		{"zero total", args{0, []float64{1, 1}}, []int64{0, 0}},
+		{"negative total", args{-5, []float64{1, 1}}, []int64{0, 0}},
+		{"large total", args{math.MaxInt64 / 2, []float64{1, 1, 1}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Apportion(tt.args.total, tt.args.weights)
+			assert.Len(t, got, len(tt.args.weights))
+			if tt.want != nil {
+				assert.Equalf(t, tt.want, got, "Apportion(%v, %v)", tt.args.total, tt.args.weights)
+			}
+			if tt.args.total > 0 && Sum(got) > 0 {
+				assert.Equal(t, tt.args.total, Sum(got), "Apportion(%v, %v) sum", tt.args.total, tt.args.weights)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package pacing
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"hash/fnv"
+	"sync"
+)
+
+// MetadataSubject is the NATS subject the controller publishes the line items' metadata on when it changes.
+// Bidders request the current metadata on the subject with ".get" suffix.
+const MetadataSubject = "metadata"
+
+// metadataRequestSubject is the NATS subject the current metadata is requested on.
+const metadataRequestSubject = MetadataSubject + ".get"
+
+// LineItemMetadata is the bidding metadata of a line item, the controller passes it to bidders as is.
+type LineItemMetadata struct {
+	// BidPrice is the CPM to bid with, the bidder's default is used if not set.
+	BidPrice float64 `json:"bid_price,omitempty"`
+	// Targeting are the key-values the requests must match, any of the values of every key.
+	Targeting map[string][]string `json:"targeting,omitempty"`
+	// Priority orders the line items, the higher the sooner the line item is selected.
+	Priority int `json:"priority,omitempty"`
+}
+
+// MetadataUpdate is the metadata of all line items with its version, the version changes with the content.
+// The line items without metadata are listed with null, so the bidder knows the version covers them.
+type MetadataUpdate struct {
+	Version   string                        `json:"version"`
+	LineItems map[uuid.UUID]json.RawMessage `json:"line_items"`
+}
+
+// NewMetadataUpdate creates the update of given metadata, the version is the hash of the content,
+// so it is the same in all controllers loading the same snapshot.
+func NewMetadataUpdate(lineItems map[uuid.UUID]json.RawMessage) (MetadataUpdate, error) {
+	// The map is encoded with sorted keys
+	enc, err := json.Marshal(lineItems)
+	if err != nil {
+		return MetadataUpdate{}, err
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(enc)
+	return MetadataUpdate{Version: fmt.Sprintf("%016x", h.Sum64()), LineItems: lineItems}, nil
+}
+
+// DecodeMetadataUpdate decodes and validates the metadata update.
+func DecodeMetadataUpdate(data []byte) (MetadataUpdate, error) {
+	var u MetadataUpdate
+	if err := json.Unmarshal(data, &u); err != nil {
+		return MetadataUpdate{}, err
+	}
+	if u.Version == "" {
+		return MetadataUpdate{}, fmt.Errorf("metadata update has no version")
+	}
+	if u.LineItems == nil {
+		u.LineItems = map[uuid.UUID]json.RawMessage{}
+	}
+	return u, nil
+}
+
+// metadataOf returns the metadata of the records, it is nil for the records which have none.
+func metadataOf(records []*Record) map[uuid.UUID]json.RawMessage {
+	res := make(map[uuid.UUID]json.RawMessage, len(records))
+	for _, rec := range records {
+		res[rec.LineItemID] = rec.Metadata
+	}
+	return res
+}
+
+// MetadataCache keeps the line items' metadata of the latest version received by the bidder.
+type MetadataCache struct {
+	mu        sync.RWMutex
+	version   string
+	lineItems map[uuid.UUID]LineItemMetadata
+	covered   map[uuid.UUID]bool
+}
+
+func NewMetadataCache() *MetadataCache {
+	return &MetadataCache{lineItems: map[uuid.UUID]LineItemMetadata{}, covered: map[uuid.UUID]bool{}}
+}
+
+// Update replaces the cached metadata, it returns false if the update has the cached version.
+// The metadata which cannot be decoded is skipped, the line item is bid with defaults.
+func (c *MetadataCache) Update(u MetadataUpdate) bool {
+	c.mu.RLock()
+	cached := c.version == u.Version
+	c.mu.RUnlock()
+	if cached {
+		return false
+	}
+	lineItems := make(map[uuid.UUID]LineItemMetadata, len(u.LineItems))
+	covered := make(map[uuid.UUID]bool, len(u.LineItems))
+	for id, raw := range u.LineItems {
+		covered[id] = true
+		var m LineItemMetadata
+		if len(raw) == 0 || string(raw) == "null" || json.Unmarshal(raw, &m) != nil {
+			continue
+		}
+		lineItems[id] = m
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version, c.lineItems, c.covered = u.Version, lineItems, covered
+	return true
+}
+
+// Covers tells whether the cached version lists the line item, with or without metadata.
+// The line item which is not covered has been added after the version, so a newer one should be fetched.
+func (c *MetadataCache) Covers(id uuid.UUID) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.covered[id]
+}
+
+// Version returns the version of the cached metadata, it is empty until the first update.
+func (c *MetadataCache) Version() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.version
+}
+
+// lineItemsMetadata returns the metadata of all line items, the map must not be modified.
+// It is replaced as a whole on update, so it can be read without the lock.
+func (c *MetadataCache) lineItemsMetadata() map[uuid.UUID]LineItemMetadata {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lineItems
+}
+
+// Get returns the metadata of the line item, it returns false if the line item has none.
+func (c *MetadataCache) Get(id uuid.UUID) (LineItemMetadata, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	m, ok := c.lineItems[id]
+	return m, ok
+}
@@ -0,0 +1,150 @@
+package pacing
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"pacing.go/dispatcher"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewMetadataUpdate(t *testing.T) {
+	first, second := uuid.New(), uuid.New()
+	u, err := NewMetadataUpdate(map[uuid.UUID]json.RawMessage{first: json.RawMessage(`{"priority":1}`), second: json.RawMessage(`{}`)})
+	require.NoError(t, err)
+	same, err := NewMetadataUpdate(map[uuid.UUID]json.RawMessage{second: json.RawMessage(`{}`), first: json.RawMessage(`{"priority":1}`)})
+	require.NoError(t, err)
+	changed, err := NewMetadataUpdate(map[uuid.UUID]json.RawMessage{first: json.RawMessage(`{"priority":2}`), second: json.RawMessage(`{}`)})
+	require.NoError(t, err)
+
+	assert.NotEmpty(t, u.Version)
+	assert.Equal(t, u.Version, same.Version)
+	assert.NotEqual(t, u.Version, changed.Version)
+
+	enc, err := json.Marshal(u)
+	require.NoError(t, err)
+	decoded, err := DecodeMetadataUpdate(enc)
+	require.NoError(t, err)
+	assert.Equal(t, u.Version, decoded.Version)
+	_, err = DecodeMetadataUpdate([]byte(`{"line_items":{}}`))
+	assert.Error(t, err)
+}
+
+func TestMetadataCache(t *testing.T) {
+	id, invalid, none := uuid.New(), uuid.New(), uuid.New()
+	c := NewMetadataCache()
+	u, err := NewMetadataUpdate(map[uuid.UUID]json.RawMessage{
+		id:      json.RawMessage(`{"bid_price":2.5,"targeting":{"country":["PL"]},"priority":3}`),
+		invalid: json.RawMessage(`"invalid"`),
+		none:    nil,
+	})
+	require.NoError(t, err)
+
+	assert.True(t, c.Update(u))
+	assert.False(t, c.Update(u))
+	assert.Equal(t, u.Version, c.Version())
+	m, ok := c.Get(id)
+	assert.True(t, ok)
+	assert.Equal(t, LineItemMetadata{BidPrice: 2.5, Targeting: map[string][]string{"country": {"PL"}}, Priority: 3}, m)
+	_, ok = c.Get(invalid)
+	assert.False(t, ok)
+	_, ok = c.Get(none)
+	assert.False(t, ok)
+
+	// The line items without metadata are covered by the version, unlike the ones added later.
+	assert.True(t, c.Covers(id))
+	assert.True(t, c.Covers(none))
+	assert.False(t, c.Covers(uuid.New()))
+}
+
+// writeSnapshot writes the records to the snapshot file at given path.
+func writeSnapshot(t *testing.T, path string, records ...*Record) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, f.Close()) }()
+	enc := json.NewEncoder(f)
+	for _, rec := range records {
+		require.NoError(t, enc.Encode(rec))
+	}
+}
+
+func TestBidderReceivesMetadata(t *testing.T) {
+	srv := natsserver.RunRandClientPortServer()
+	defer srv.Shutdown()
+	id := uuid.New()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	writeSnapshot(t, path, &Record{LineItemID: id, DailyBudget: 1000, Metadata: json.RawMessage(`{"bid_price":2}`)})
+
+	controller, err := NewController(path, WithDispatcherOptions(dispatcher.WithURL(srv.ClientURL())))
+	require.NoError(t, err)
+	require.NoError(t, controller.Run())
+	defer controller.Shutdown()
+
+	// The bidder started after the controller requests the metadata.
+	bidder, err := NewBidder(WithReceiverOptions(dispatcher.WithURL(srv.ClientURL())))
+	require.NoError(t, err)
+	require.NoError(t, bidder.Run())
+	defer func() { assert.NoError(t, bidder.Shutdown()) }()
+	m, ok := bidder.Metadata().Get(id)
+	assert.True(t, ok)
+	assert.Equal(t, 2.0, m.BidPrice)
+	version := bidder.Metadata().Version()
+
+	// The changed metadata is published to running bidders.
+	writeSnapshot(t, path, &Record{LineItemID: id, DailyBudget: 1000, Metadata: json.RawMessage(`{"bid_price":3}`)})
+	require.NoError(t, controller.Reload())
+	assert.Eventually(t, func() bool {
+		m, _ := bidder.Metadata().Get(id)
+		return m.BidPrice == 3
+	}, time.Second, 10*time.Millisecond)
+	assert.NotEqual(t, version, bidder.Metadata().Version())
+}
+
+func TestBidderFetchesMissedMetadata(t *testing.T) {
+	srv := natsserver.RunRandClientPortServer()
+	defer srv.Shutdown()
+	id, plain, added := uuid.New(), uuid.New(), uuid.New()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	writeSnapshot(t, path,
+		&Record{LineItemID: id, DailyBudget: 1000, Metadata: json.RawMessage(`{"bid_price":2}`)},
+		&Record{LineItemID: plain, DailyBudget: 1000},
+	)
+
+	controller, err := NewController(path, WithDispatcherOptions(dispatcher.WithURL(srv.ClientURL())))
+	require.NoError(t, err)
+	require.NoError(t, controller.Run())
+	defer controller.Shutdown()
+
+	bidder, err := NewBidder(WithReceiverOptions(dispatcher.WithURL(srv.ClientURL())))
+	require.NoError(t, err)
+	require.NoError(t, bidder.Run())
+	defer func() { assert.NoError(t, bidder.Shutdown()) }()
+	assert.True(t, bidder.Metadata().Covers(plain))
+
+	// The bidder misses the update adding the line item, it fetches the metadata when the line item is dispatched.
+	require.NoError(t, bidder.msub.Unsubscribe())
+	writeSnapshot(t, path,
+		&Record{LineItemID: id, DailyBudget: 1000, Metadata: json.RawMessage(`{"bid_price":2}`)},
+		&Record{LineItemID: plain, DailyBudget: 1000},
+		&Record{LineItemID: added, DailyBudget: 1000, Metadata: json.RawMessage(`{"bid_price":3}`)},
+	)
+	require.NoError(t, controller.Reload())
+	assert.False(t, bidder.Metadata().Covers(added))
+
+	nc, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	workload, err := json.Marshal(dispatcher.Workload{Source: "other", Lease: time.Now().Add(time.Minute), Round: 1, Allowances: dispatcher.Allowances{added: 100}})
+	require.NoError(t, err)
+	require.NoError(t, nc.Publish(bidder.receiver.Address(), workload))
+	assert.Eventually(t, func() bool {
+		m, ok := bidder.Metadata().Get(added)
+		return ok && m.BidPrice == 3
+	}, 2*time.Second, 10*time.Millisecond)
+}
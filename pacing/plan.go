@@ -0,0 +1,86 @@
+package pacing
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"hash/fnv"
+	"math"
+)
+
+// PlanSubject is the NATS subject the controller publishes the day plan on when it changes.
+// Bidders request the current plan on the subject with ".get" suffix.
+const PlanSubject = "plan"
+
+// planRequestSubject is the NATS subject the current day plan is requested on.
+const planRequestSubject = PlanSubject + ".get"
+
+// DayPlan is the planned spend of all line items for the whole day, the bidders pace on their own with it
+// when the controller is unreachable. The version changes with the content.
+type DayPlan struct {
+	Version string `json:"version"`
+	// Shares is the curve of the daily budget, the share of it planned in every time slot.
+	Shares []float64 `json:"shares"`
+	// Budgets are the daily budgets keyed by line item.
+	Budgets map[uuid.UUID]int64 `json:"budgets"`
+}
+
+// NewDayPlan creates the plan of given daily budgets spent along the curve of shares, the version is the hash
+// of the content, so it is the same in all controllers loading the same snapshot.
+func NewDayPlan(budgets map[uuid.UUID]int64, shares []float64) (DayPlan, error) {
+	if len(shares) != TimeSlots {
+		return DayPlan{}, fmt.Errorf("day plan has %d shares, %d expected", len(shares), TimeSlots)
+	}
+	// The map is encoded with sorted keys
+	enc, err := json.Marshal(DayPlan{Shares: shares, Budgets: budgets})
+	if err != nil {
+		return DayPlan{}, err
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(enc)
+	return DayPlan{Version: fmt.Sprintf("%016x", h.Sum64()), Shares: shares, Budgets: budgets}, nil
+}
+
+// DecodeDayPlan decodes and validates the day plan.
+func DecodeDayPlan(data []byte) (DayPlan, error) {
+	var p DayPlan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return DayPlan{}, err
+	}
+	if p.Version == "" {
+		return DayPlan{}, fmt.Errorf("day plan has no version")
+	}
+	if len(p.Shares) != TimeSlots {
+		return DayPlan{}, fmt.Errorf("day plan has %d shares, %d expected", len(p.Shares), TimeSlots)
+	}
+	if p.Budgets == nil {
+		p.Budgets = map[uuid.UUID]int64{}
+	}
+	return p, nil
+}
+
+// Planned returns the spend of the line item planned in given time slot.
+func (p DayPlan) Planned(slot int, id uuid.UUID) int64 {
+	if slot < 0 || slot >= len(p.Shares) {
+		return 0
+	}
+	return int64(math.Floor(float64(p.Budgets[id]) * p.Shares[slot]))
+}
+
+// EvenShares returns the curve spending the daily budget evenly, see EvenDistribution.
+func EvenShares() []float64 {
+	shares := make([]float64, TimeSlots)
+	for i := range shares {
+		shares[i] = 1.0 / TimeSlots
+	}
+	return shares
+}
+
+// dayPlanOf returns the plan of the records' daily budgets, they are distributed evenly.
+func dayPlanOf(records []*Record) (DayPlan, error) {
+	budgets := make(map[uuid.UUID]int64, len(records))
+	for _, rec := range records {
+		budgets[rec.LineItemID] = rec.DailyBudget
+	}
+	return NewDayPlan(budgets, EvenShares())
+}
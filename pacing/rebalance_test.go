@@ -0,0 +1,66 @@
+package pacing
+
+import (
+	"github.com/google/uuid"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"pacing.go/dispatcher"
+	"testing"
+	"time"
+)
+
+func TestBidderRebalancing(t *testing.T) {
+	srv := natsserver.RunRandClientPortServer()
+	defer srv.Shutdown()
+	id := uuid.New()
+
+	// Every bidder gets the same allowance and nothing is reserved, the test takes less than a round.
+	d, err := dispatcher.NewDispatcher(func(consumers []dispatcher.Announcement) map[string]dispatcher.Allowances {
+		res := make(map[string]dispatcher.Allowances, len(consumers))
+		for _, c := range consumers {
+			res[c.Address] = dispatcher.Allowances{id: 1000}
+		}
+		return res
+	},
+		dispatcher.WithURL(srv.ClientURL()),
+		dispatcher.WithDispatchPeriod(3*time.Second),
+		dispatcher.WithLease(time.Minute),
+		dispatcher.WithJoinReserve(0),
+	)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	defer d.Shutdown()
+	newBidder := func() *Bidder {
+		b, err := NewBidder(WithRebalancing(100*time.Millisecond, 0.1, 0.2), WithReceiverOptions(
+			dispatcher.WithURL(srv.ClientURL()),
+			dispatcher.WithAnnouncementsPeriod(50*time.Millisecond),
+		))
+		require.NoError(t, err)
+		require.NoError(t, b.Run())
+		return b
+	}
+	idle, busy := newBidder(), newBidder()
+	defer func() { assert.NoError(t, idle.Shutdown()) }()
+	defer func() { assert.NoError(t, busy.Shutdown()) }()
+	require.Eventually(t, func() bool {
+		return idle.Ledger().Remaining(id) == 1000 && busy.Ledger().Remaining(id) == 1000
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// The busy bidder spends most of its allowance right away.
+	busy.Ledger().random = func() float64 { return 0 }
+	for i := 0; i < 9; i++ {
+		require.True(t, busy.Ledger().ShouldBid(id))
+		res, err := busy.Ledger().Reserve(id, 100)
+		require.NoError(t, err)
+		require.NoError(t, busy.Ledger().Commit(res, 100))
+	}
+
+	// The idle bidder returns its allowance and the busy one gets it, the ledgers follow the adjusted allowances.
+	assert.Eventually(t, func() bool {
+		return idle.receiver.Available(id) < 1000 && idle.Ledger().Remaining(id) < 1000
+	}, time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return busy.receiver.Available(id) > 1000 && busy.Ledger().Remaining(id) > 100
+	}, time.Second, 5*time.Millisecond)
+}
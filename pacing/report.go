@@ -0,0 +1,245 @@
+package pacing
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"pacing.go/dispatcher"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSpendSubject is the NATS subject bidders report their spend to.
+	DefaultSpendSubject = "spend"
+	// DefaultReportInterval is how often the bidder flushes the spend committed since the last report.
+	DefaultReportInterval = time.Second
+	// DefaultReportSize is the number of line items after which the report is flushed before the interval elapses.
+	DefaultReportSize = 1000
+)
+
+// maxPendingReports limits the reports waiting for the controller acknowledgement, the oldest ones are dropped.
+const maxPendingReports = 1024
+
+// reportHorizon is the number of time slots an unacknowledged report is retried for, the older ones are dropped.
+// The controller keeps the keys of the recorded reports as long, so a retried report is not recorded twice.
+const reportHorizon = 60
+
+// SpendReport is the spend committed by a bidder in a time slot, sent to the controller.
+type SpendReport struct {
+	// Key is the idempotency key, the controller records the report with the same key only once.
+	Key string `json:"key"`
+	// Consumer is the ID the bidder announces itself with.
+	Consumer string `json:"consumer,omitempty"`
+	// Slot is the time slot the spend was committed in, see TimeToSlot.
+	Slot int `json:"slot"`
+	// Spend is the committed spend keyed by line item.
+	Spend map[uuid.UUID]int64 `json:"spend"`
+	// Fallback tells the spend was committed on the allowances of the fallback pacing, not dispatched by the controller.
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// Total returns the spend of all line items in the report.
+func (r SpendReport) Total() int64 {
+	var total int64
+	for _, amount := range r.Spend {
+		total += amount
+	}
+	return total
+}
+
+// DecodeSpendReport decodes and validates the spend report.
+func DecodeSpendReport(data []byte) (SpendReport, error) {
+	var r SpendReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		return SpendReport{}, err
+	}
+	if r.Key == "" {
+		return SpendReport{}, fmt.Errorf("spend report has no key")
+	}
+	if r.Spend == nil {
+		r.Spend = map[uuid.UUID]int64{}
+	}
+	return r, nil
+}
+
+// spendReporter aggregates the committed spend per line item and flushes it to the controller periodically,
+// or sooner when the report grows over the size limit, the time slot changes or the bidder switches the fallback pacing.
+// Reports are sent until the controller acknowledges them within the reportHorizon, a retried report keeps its key.
+type spendReporter struct {
+	mu       sync.Mutex
+	subject  string
+	interval time.Duration
+	size     int
+	consumer func() string
+	request  func(subject string, data []byte, timeout time.Duration) (*nats.Msg, error)
+	now      func() time.Time
+	current  *SpendReport
+	pending  []SpendReport
+	kick     chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newSpendReporter(subject string, interval time.Duration, size int, consumer func() string) *spendReporter {
+	return &spendReporter{
+		subject:  subject,
+		interval: interval,
+		size:     size,
+		consumer: consumer,
+		now:      time.Now,
+		kick:     make(chan struct{}, 1),
+	}
+}
+
+// add aggregates the amount committed on the line item, the fallback spend is reported separately.
+func (r *spendReporter) add(lineItem uuid.UUID, amount int64, fallback bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	slot := TimeToSlot(r.now())
+	if r.current != nil && (r.current.Slot != slot || r.current.Fallback != fallback) {
+		r.seal()
+	}
+	if r.current == nil {
+		r.current = &SpendReport{Key: uuid.NewString(), Consumer: r.consumer(), Slot: slot, Spend: map[uuid.UUID]int64{}, Fallback: fallback}
+	}
+	r.current.Spend[lineItem] += amount
+	if len(r.current.Spend) >= r.size {
+		r.seal()
+	}
+}
+
+// seal moves the current report to the pending ones and wakes up the reporter routine.
+// It must be called with the lock held.
+func (r *spendReporter) seal() {
+	if r.current == nil {
+		return
+	}
+	r.pending = append(r.pending, *r.current)
+	r.current = nil
+	if len(r.pending) > maxPendingReports {
+		log.Warn().Msg(fmt.Sprintf("(bidder) dropped unacknowledged spend report %s", r.pending[0].Key))
+		r.pending = r.pending[1:]
+	}
+	r.wake()
+}
+
+// wake makes the reporter routine send the pending reports without waiting for the interval.
+func (r *spendReporter) wake() {
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// start runs the reporter routine sending reports with given request function.
+func (r *spendReporter) start(request func(subject string, data []byte, timeout time.Duration) (*nats.Msg, error)) {
+	r.request = request
+	r.done = make(chan struct{})
+	r.wg.Add(1)
+	go r.loop()
+}
+
+// stop flushes the aggregated spend and stops the reporter routine.
+func (r *spendReporter) stop() {
+	if r.done == nil {
+		return
+	}
+	close(r.done)
+	r.wg.Wait()
+	r.done = nil
+}
+
+func (r *spendReporter) loop() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.flush()
+		case <-r.kick:
+			r.send()
+		case <-r.done:
+			r.flush()
+			return
+		}
+	}
+}
+
+// flush seals the current report and sends all pending ones.
+func (r *spendReporter) flush() {
+	r.mu.Lock()
+	r.seal()
+	r.mu.Unlock()
+	r.send()
+}
+
+// send sends the pending reports in order, it stops at the first one not acknowledged, so it is retried later.
+func (r *spendReporter) send() {
+	r.mu.Lock()
+	r.expire()
+	reports := append([]SpendReport(nil), r.pending...)
+	r.mu.Unlock()
+	for _, report := range reports {
+		enc, err := json.Marshal(report)
+		if err == nil {
+			_, err = r.request(r.subject, enc, dispatcher.DefaultRequestTimeout)
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("(bidder) cannot send spend report %s", report.Key))
+			return
+		}
+		r.acknowledged(report.Key)
+	}
+}
+
+// expire drops the pending reports older than the reportHorizon, it must be called with the lock held.
+func (r *spendReporter) expire() {
+	slot := TimeToSlot(r.now())
+	pending := r.pending[:0]
+	for _, report := range r.pending {
+		// The slots start over every day
+		if (slot-report.Slot+TimeSlots)%TimeSlots >= reportHorizon {
+			log.Warn().Msg(fmt.Sprintf("(bidder) dropped expired spend report %s", report.Key))
+			continue
+		}
+		pending = append(pending, report)
+	}
+	r.pending = pending
+}
+
+// unacknowledged returns the pending reports and the current one.
+func (r *spendReporter) unacknowledged() []SpendReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reports := append([]SpendReport(nil), r.pending...)
+	if r.current != nil {
+		reports = append(reports, *r.current)
+	}
+	return reports
+}
+
+// restore adds the reports not acknowledged before the restart to the pending ones, they keep their keys.
+func (r *spendReporter) restore(reports []SpendReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = append(append([]SpendReport(nil), reports...), r.pending...)
+	if len(r.pending) > maxPendingReports {
+		r.pending = r.pending[len(r.pending)-maxPendingReports:]
+	}
+}
+
+// acknowledged removes the report with given key from the pending ones.
+func (r *spendReporter) acknowledged(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, report := range r.pending {
+		if report.Key == key {
+			r.pending = append(r.pending[:i], r.pending[i+1:]...)
+			return
+		}
+	}
+}
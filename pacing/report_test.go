@@ -0,0 +1,149 @@
+package pacing
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"pacing.go/dispatcher"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingRequester records the reports sent by the reporter, it fails the requests while failing is set.
+type recordingRequester struct {
+	mu      sync.Mutex
+	failing bool
+	reports []SpendReport
+}
+
+func (r *recordingRequester) request(_ string, data []byte, _ time.Duration) (*nats.Msg, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failing {
+		return nil, errors.New("disconnected")
+	}
+	report, err := DecodeSpendReport(data)
+	if err != nil {
+		return nil, err
+	}
+	r.reports = append(r.reports, report)
+	return &nats.Msg{}, nil
+}
+
+func (r *recordingRequester) setFailing(failing bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failing = failing
+}
+
+func (r *recordingRequester) sent() []SpendReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SpendReport(nil), r.reports...)
+}
+
+func TestSpendReporter(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 30, 0, time.Local)
+	first, second := uuid.New(), uuid.New()
+	r := newSpendReporter(DefaultSpendSubject, time.Hour, 2, func() string { return "bidder" })
+	r.now = func() time.Time { return now }
+	requester := &recordingRequester{}
+	r.start(requester.request)
+	defer r.stop()
+
+	// The report is flushed when it reaches the size limit.
+	r.add(first, 10, false)
+	r.add(first, 5, false)
+	r.add(second, 1, false)
+	assert.Eventually(t, func() bool { return len(requester.sent()) == 1 }, time.Second, 10*time.Millisecond)
+	report := requester.sent()[0]
+	assert.NotEmpty(t, report.Key)
+	assert.Equal(t, "bidder", report.Consumer)
+	assert.Equal(t, 0, report.Slot)
+	assert.Equal(t, map[uuid.UUID]int64{first: 15, second: 1}, report.Spend)
+
+	// The report is flushed when the slot changes, it is retried with the same key until acknowledged.
+	requester.setFailing(true)
+	r.add(first, 3, false)
+	now = now.Add(time.Minute)
+	r.add(first, 4, false)
+	time.Sleep(50 * time.Millisecond)
+	requester.setFailing(false)
+	r.flush()
+	sent := requester.sent()
+	require.Len(t, sent, 3)
+	assert.Equal(t, SpendReport{Key: sent[1].Key, Consumer: "bidder", Slot: 0, Spend: map[uuid.UUID]int64{first: 3}}, sent[1])
+	assert.Equal(t, SpendReport{Key: sent[2].Key, Consumer: "bidder", Slot: 1, Spend: map[uuid.UUID]int64{first: 4}}, sent[2])
+	assert.NotEqual(t, sent[1].Key, sent[2].Key)
+	r.flush()
+	assert.Len(t, requester.sent(), 3)
+
+	// The fallback spend is reported separately.
+	r.add(first, 2, false)
+	r.add(first, 1, true)
+	r.flush()
+	sent = requester.sent()
+	require.Len(t, sent, 5)
+	assert.Equal(t, SpendReport{Key: sent[3].Key, Consumer: "bidder", Slot: 1, Spend: map[uuid.UUID]int64{first: 2}}, sent[3])
+	assert.Equal(t, SpendReport{Key: sent[4].Key, Consumer: "bidder", Slot: 1, Spend: map[uuid.UUID]int64{first: 1}, Fallback: true}, sent[4])
+}
+
+func TestBidderReportsSpend(t *testing.T) {
+	srv := natsserver.RunRandClientPortServer()
+	defer srv.Shutdown()
+	path, recs, err := CreateSnapshot(1)
+	require.NoError(t, err)
+	id := recs[0].LineItemID
+
+	controller, err := NewController(path, WithDispatcherOptions(dispatcher.WithURL(srv.ClientURL())))
+	require.NoError(t, err)
+	require.NoError(t, controller.Run())
+	defer controller.Shutdown()
+	bidder, err := NewBidder(WithReceiverOptions(dispatcher.WithURL(srv.ClientURL())), WithReportInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, bidder.Run())
+	defer func() { assert.NoError(t, bidder.Shutdown()) }()
+
+	bidder.Ledger().Update(dispatcher.Workload{Lease: time.Now().Add(time.Minute), Round: 1, Allowances: dispatcher.Allowances{id: 100}})
+	res, err := bidder.Ledger().Reserve(id, 30)
+	require.NoError(t, err)
+	slot := TimeToSlot(time.Now())
+	require.NoError(t, bidder.Ledger().Commit(res, 25))
+	assert.Eventually(t, func() bool {
+		return controller.spend.At(slot, id) == 25 || controller.spend.At(slot+1, id) == 25
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSpendReporterExpires(t *testing.T) {
+	now := time.Date(2023, 2, 17, 23, 59, 30, 0, time.Local)
+	id := uuid.New()
+	r := newSpendReporter(DefaultSpendSubject, time.Hour, DefaultReportSize, func() string { return "bidder" })
+	r.now = func() time.Time { return now }
+	requester := &recordingRequester{failing: true}
+	r.start(requester.request)
+	defer r.stop()
+
+	// The reports are retried across the midnight, until they get older than the horizon.
+	r.add(id, 1, false)
+	now = now.Add(time.Minute)
+	r.add(id, 2, false)
+	r.flush()
+	now = now.Add((reportHorizon - 2) * time.Minute)
+	r.flush()
+	assert.Len(t, r.unacknowledged(), 2)
+	now = now.Add(time.Minute)
+	r.flush()
+	reports := r.unacknowledged()
+	require.Len(t, reports, 1)
+	assert.Equal(t, 0, reports[0].Slot)
+
+	requester.setFailing(false)
+	r.flush()
+	sent := requester.sent()
+	require.Len(t, sent, 1)
+	assert.Equal(t, map[uuid.UUID]int64{id: 2}, sent[0].Spend)
+}
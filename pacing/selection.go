@@ -0,0 +1,121 @@
+package pacing
+
+import (
+	"github.com/google/uuid"
+	"sync"
+)
+
+// Attributes are the key-values of the request the line items' targeting is matched against.
+type Attributes map[string]string
+
+// Matches tells whether the attributes match the targeting, the value of every targeted key must be among its values.
+// The line item without targeting matches all requests.
+func (a Attributes) Matches(targeting map[string][]string) bool {
+	for key, values := range targeting {
+		value, ok := a[key]
+		if !ok || !contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Selection is the line item selected to bid with.
+type Selection struct {
+	LineItem uuid.UUID
+	// Price is the CPM to bid with.
+	Price float64
+	// Amount is the budget the bid reserves, the price of a single impression in CurrencyUnit.
+	Amount int64
+}
+
+// candidate is the line item eligible for the request.
+type candidate struct {
+	Selection
+	priority int
+	ratio    float64
+}
+
+// Selector picks the line item to bid with for the request.
+// The line items must match the request's attributes, have the budget for the bid and their price must reach the floor.
+// The eligible ones are ranked by priority, then by the ratio of their remaining budget to the allowance,
+// so the line items behind their pace are preferred. The throttled line items are skipped, see Ledger.ShouldBid.
+type Selector struct {
+	ledger   *Ledger
+	metadata *MetadataCache
+	price    float64
+}
+
+// NewSelector creates the selector of line items, the line items without the bid price in metadata are bid with given price.
+func NewSelector(ledger *Ledger, metadata *MetadataCache, price float64) *Selector {
+	return &Selector{ledger: ledger, metadata: metadata, price: price}
+}
+
+// Select returns the best line item to bid with on the request with given attributes and floor CPM.
+// It returns false if there is none.
+func (s *Selector) Select(attrs Attributes, floor float64) (Selection, bool) {
+	buf := candidatesPool.Get().(*[]candidate)
+	defer candidatesPool.Put(buf)
+	candidates := s.candidates((*buf)[:0], attrs, floor)
+	*buf = candidates
+	// The best candidate is usually not throttled, so it is searched for instead of sorting all of them
+	for len(candidates) > 0 {
+		best := 0
+		for i := range candidates {
+			if candidates[i].better(candidates[best]) {
+				best = i
+			}
+		}
+		if s.ledger.ShouldBid(candidates[best].LineItem) {
+			return candidates[best].Selection, true
+		}
+		candidates[best] = candidates[len(candidates)-1]
+		candidates = candidates[:len(candidates)-1]
+	}
+	return Selection{}, false
+}
+
+// candidatesPool reuses the buffers of candidates between requests.
+var candidatesPool = sync.Pool{New: func() any { return new([]candidate) }}
+
+// better tells whether the candidate is preferred over the other one.
+func (c candidate) better(other candidate) bool {
+	if c.priority != other.priority {
+		return c.priority > other.priority
+	}
+	return c.ratio > other.ratio
+}
+
+// candidates appends the line items eligible for the request to given buffer.
+func (s *Selector) candidates(candidates []candidate, attrs Attributes, floor float64) []candidate {
+	metadata := s.metadata.lineItemsMetadata()
+	s.ledger.each(func(id uuid.UUID, allowance int64, remaining int64) {
+		m := metadata[id]
+		price := m.BidPrice
+		if price <= 0 {
+			price = s.price
+		}
+		if price < floor || !attrs.Matches(m.Targeting) {
+			return
+		}
+		amount := cpmToAmount(price)
+		if remaining < amount {
+			return
+		}
+		candidates = append(candidates, candidate{
+			Selection: Selection{LineItem: id, Price: price, Amount: amount},
+			priority:  m.Priority,
+			ratio:     float64(remaining) / float64(allowance),
+		})
+	})
+	return candidates
+}
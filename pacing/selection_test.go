@@ -0,0 +1,154 @@
+package pacing
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"pacing.go/dispatcher"
+	"testing"
+	"time"
+)
+
+func TestAttributesMatches(t *testing.T) {
+	attrs := Attributes{"country": "PL", "device": "mobile"}
+	tests := []struct {
+		name      string
+		targeting map[string][]string
+		want      bool
+	}{
+		{"no targeting", nil, true},
+		{"matching value", map[string][]string{"country": {"DE", "PL"}}, true},
+		{"all keys matching", map[string][]string{"country": {"PL"}, "device": {"mobile"}}, true},
+		{"other value", map[string][]string{"country": {"DE"}}, false},
+		{"missing key", map[string][]string{"os": {"android"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, attrs.Matches(tt.targeting))
+		})
+	}
+}
+
+// makeTestSelector creates the selector of line items with given allowances, remaining budgets and metadata.
+func makeTestSelector(t testing.TB, allowances dispatcher.Allowances, spent map[uuid.UUID]int64, metadata map[uuid.UUID]LineItemMetadata) *Selector {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+	ledger := NewLedger(time.Minute)
+	ledger.now = func() time.Time { return now }
+	ledger.random = func() float64 { return 0 }
+	ledger.Update(dispatcher.Workload{Lease: now.Add(time.Minute), Round: 1, Allowances: allowances})
+	for id, amount := range spent {
+		res, err := ledger.Reserve(id, amount)
+		require.NoError(t, err)
+		require.NoError(t, ledger.Commit(res, amount))
+	}
+	raw := make(map[uuid.UUID]json.RawMessage, len(metadata))
+	for id, m := range metadata {
+		enc, err := json.Marshal(m)
+		require.NoError(t, err)
+		raw[id] = enc
+	}
+	u, err := NewMetadataUpdate(raw)
+	require.NoError(t, err)
+	cache := NewMetadataCache()
+	cache.Update(u)
+	return NewSelector(ledger, cache, 1)
+}
+
+func TestSelectorSelect(t *testing.T) {
+	low, high, behind, ahead := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	allowances := dispatcher.Allowances{low: 10_000, high: 10_000, behind: 10_000, ahead: 10_000}
+	tests := []struct {
+		name     string
+		spent    map[uuid.UUID]int64
+		metadata map[uuid.UUID]LineItemMetadata
+		attrs    Attributes
+		floor    float64
+		want     uuid.UUID
+		wantOK   bool
+	}{
+		{
+			name:     "highest priority",
+			metadata: map[uuid.UUID]LineItemMetadata{low: {Priority: 1}, high: {Priority: 2}},
+			want:     high, wantOK: true,
+		},
+		{
+			name:     "highest remaining ratio",
+			spent:    map[uuid.UUID]int64{low: 5000, high: 5000, ahead: 6000, behind: 1000},
+			metadata: map[uuid.UUID]LineItemMetadata{},
+			want:     behind, wantOK: true,
+		},
+		{
+			name:     "targeting",
+			metadata: map[uuid.UUID]LineItemMetadata{low: {Targeting: map[string][]string{"country": {"PL"}}}, high: {Priority: 2, Targeting: map[string][]string{"country": {"DE"}}}, behind: {Targeting: map[string][]string{"country": {"DE"}}}, ahead: {Targeting: map[string][]string{"country": {"DE"}}}},
+			attrs:    Attributes{"country": "PL"},
+			want:     low, wantOK: true,
+		},
+		{
+			name:     "floor",
+			metadata: map[uuid.UUID]LineItemMetadata{low: {BidPrice: 3}, high: {Priority: 2}},
+			floor:    2,
+			want:     low, wantOK: true,
+		},
+		{
+			name:     "exhausted",
+			spent:    map[uuid.UUID]int64{high: 9999},
+			metadata: map[uuid.UUID]LineItemMetadata{low: {Priority: 1}, high: {Priority: 2}},
+			want:     low, wantOK: true,
+		},
+		{
+			name:     "none eligible",
+			metadata: map[uuid.UUID]LineItemMetadata{},
+			floor:    10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := makeTestSelector(t, allowances, tt.spent, tt.metadata)
+			sel, ok := s.Select(tt.attrs, tt.floor)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, sel.LineItem)
+		})
+	}
+}
+
+func TestSelectorSkipsThrottled(t *testing.T) {
+	id := uuid.New()
+	s := makeTestSelector(t, dispatcher.Allowances{id: 1000}, nil, nil)
+	sel, ok := s.Select(nil, 0)
+	assert.True(t, ok)
+	assert.Equal(t, Selection{LineItem: id, Price: 1, Amount: cpmToAmount(1)}, sel)
+
+	s.ledger.random = func() float64 { return 1 }
+	_, ok = s.Select(nil, 0)
+	assert.False(t, ok)
+}
+
+func BenchmarkSelect(b *testing.B) {
+	countries := []string{"DE", "FR", "PL", "US"}
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("line items=%d", n), func(b *testing.B) {
+			allowances := make(dispatcher.Allowances, n)
+			metadata := make(map[uuid.UUID]LineItemMetadata, n)
+			for i := 0; i < n; i++ {
+				id := uuid.New()
+				allowances[id] = 1_000_000 * CurrencyUnit
+				metadata[id] = LineItemMetadata{
+					BidPrice:  float64(1 + i%5),
+					Targeting: map[string][]string{"country": {countries[i%len(countries)]}},
+					Priority:  i % 3,
+				}
+			}
+			s := makeTestSelector(b, allowances, nil, metadata)
+			attrs := Attributes{"country": "PL"}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok := s.Select(attrs, 2); !ok {
+					b.Fatal("no line item selected")
+				}
+			}
+		})
+	}
+}
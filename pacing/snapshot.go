@@ -10,6 +10,8 @@ import (
 type Record struct {
 	LineItemID  uuid.UUID `json:"line_item_id"`
 	DailyBudget int64     `json:"daily_budget"`
+	// Metadata is the optional bidding metadata passed to bidders as is, see LineItemMetadata.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
 }
 
 const CurrencyUnit int64 = 1_000_000
@@ -0,0 +1,75 @@
+package pacing
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"pacing.go/dispatcher"
+	"path/filepath"
+	"time"
+)
+
+// DefaultStateInterval is how often the bidder persists its state to the state file.
+const DefaultStateInterval = time.Second
+
+// bidderState is the state the bidder persists, so it can resume bidding right after a restart
+// instead of waiting for the next workload from the controller.
+type bidderState struct {
+	// ID and Address are the ones the bidder announced itself with, the restarted bidder reuses them,
+	// so the dispatchers accept the adjustments of the restored workloads.
+	ID      string `json:"id,omitempty"`
+	Address string `json:"address,omitempty"`
+	// Workloads are the last full workloads with their leases.
+	Workloads []dispatcher.Workload `json:"workloads"`
+	// Ledger is the ledger snapshot, see Ledger.Snapshot.
+	Ledger json.RawMessage `json:"ledger"`
+	// Reports are the spend reports not acknowledged by the controller yet.
+	Reports []SpendReport `json:"reports,omitempty"`
+	// Plan is the day plan for the fallback pacing, if enabled.
+	Plan *DayPlan `json:"plan,omitempty"`
+}
+
+// loadState reads the state from given file, it returns nil if there is none.
+func loadState(path string) (*bidderState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state bidderState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// saveState writes the state to given file, the file is replaced atomically,
+// so a crash in the middle of the write leaves the previous state.
+func saveState(path string, state bidderState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,133 @@
+package pacing
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"pacing.go/dispatcher"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBidderRestoresState(t *testing.T) {
+	srv := natsserver.RunRandClientPortServer()
+	defer srv.Shutdown()
+	path := filepath.Join(t.TempDir(), "bidder.json")
+	id := uuid.New()
+
+	bidder, err := NewBidder(WithReceiverOptions(dispatcher.WithURL(srv.ClientURL())), WithStateFile(path))
+	require.NoError(t, err)
+	require.NoError(t, bidder.Run())
+	nc, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	workload, err := json.Marshal(dispatcher.Workload{Source: "controller", Lease: time.Now().Add(time.Minute), Round: 1, Allowances: dispatcher.Allowances{id: 100}})
+	require.NoError(t, err)
+	require.NoError(t, nc.Publish(bidder.receiver.Address(), workload))
+	require.Eventually(t, func() bool {
+		return bidder.Ledger().Remaining(id) == 100
+	}, time.Second, 10*time.Millisecond)
+	res, err := bidder.Ledger().Reserve(id, 30)
+	require.NoError(t, err)
+	require.NoError(t, bidder.Ledger().Commit(res, 25))
+	// The state is saved on shutdown, the spend report is not acknowledged without the controller.
+	require.NoError(t, bidder.Shutdown())
+
+	restarted, err := NewBidder(WithReceiverOptions(dispatcher.WithURL(srv.ClientURL())), WithStateFile(path))
+	require.NoError(t, err)
+	assert.Equal(t, int64(75), restarted.Ledger().Remaining(id))
+	assert.Equal(t, int64(25), restarted.Ledger().Committed(id))
+	assert.False(t, restarted.receiver.FailSafe())
+	reports := restarted.reporter.unacknowledged()
+	require.Len(t, reports, 1)
+	assert.Equal(t, int64(25), reports[0].Spend[id])
+	require.NoError(t, restarted.Run())
+
+	// The next workload of the same round keeps the committed spend, a new round resets it.
+	require.NoError(t, nc.Publish(restarted.receiver.Address(), workload))
+	workload, err = json.Marshal(dispatcher.Workload{Source: "controller", Lease: time.Now().Add(time.Minute), Round: 2, Allowances: dispatcher.Allowances{id: 50}})
+	require.NoError(t, err)
+	require.NoError(t, nc.Publish(restarted.receiver.Address(), workload))
+	assert.Eventually(t, func() bool {
+		return restarted.Ledger().Remaining(id) == 50
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, restarted.Shutdown())
+}
+
+func TestBidderSkipsLapsedState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bidder.json")
+	id := uuid.New()
+	lease := time.Now().Add(-time.Second)
+	ledger := NewLedger(time.Second)
+	ledger.now = func() time.Time { return lease.Add(-time.Minute) }
+	ledger.Update(dispatcher.Workload{Lease: lease, Round: 1, Allowances: dispatcher.Allowances{id: 100}})
+	snapshot, err := ledger.Snapshot()
+	require.NoError(t, err)
+	require.NoError(t, saveState(path, bidderState{
+		Workloads: []dispatcher.Workload{{Lease: lease, Round: 1, Allowances: dispatcher.Allowances{id: 100}}},
+		Ledger:    snapshot,
+	}))
+
+	bidder, err := NewBidder(WithStateFile(path))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), bidder.Ledger().Remaining(id))
+	assert.True(t, bidder.receiver.FailSafe())
+}
+
+func TestBidderIgnoresCorruptState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bidder.json")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	bidder, err := NewBidder(WithStateFile(path))
+	require.NoError(t, err)
+	assert.Empty(t, bidder.Ledger().Available())
+}
+
+func TestBidderRestoresIdentity(t *testing.T) {
+	srv := natsserver.RunRandClientPortServer()
+	defer srv.Shutdown()
+	path := filepath.Join(t.TempDir(), "bidder.json")
+	id := uuid.New()
+	d, err := dispatcher.NewDispatcher(func(consumers []dispatcher.Announcement) map[string]dispatcher.Allowances {
+		res := make(map[string]dispatcher.Allowances, len(consumers))
+		for _, c := range consumers {
+			res[c.Address] = dispatcher.Allowances{id: 100}
+		}
+		return res
+	},
+		dispatcher.WithURL(srv.ClientURL()),
+		dispatcher.WithDispatchPeriod(3*time.Second),
+		dispatcher.WithLease(time.Minute),
+		dispatcher.WithJoinReserve(0),
+	)
+	require.NoError(t, err)
+	require.NoError(t, d.Run())
+	defer d.Shutdown()
+	receiverOpts := WithReceiverOptions(dispatcher.WithURL(srv.ClientURL()), dispatcher.WithAnnouncementsPeriod(50*time.Millisecond))
+
+	bidder, err := NewBidder(receiverOpts, WithStateFile(path))
+	require.NoError(t, err)
+	require.NoError(t, bidder.Run())
+	require.Eventually(t, func() bool {
+		return bidder.Ledger().Remaining(id) == 100
+	}, 5*time.Second, 10*time.Millisecond)
+	announced, address := bidder.receiver.ID(), bidder.receiver.Address()
+	require.NoError(t, bidder.Shutdown())
+
+	// The restarted bidder is the same consumer to the dispatcher, so it can return the restored allowance.
+	restarted, err := NewBidder(receiverOpts, WithStateFile(path))
+	require.NoError(t, err)
+	require.NoError(t, restarted.Run())
+	defer func() { assert.NoError(t, restarted.Shutdown()) }()
+	assert.Equal(t, announced, restarted.receiver.ID())
+	assert.Equal(t, address, restarted.receiver.Address())
+	assert.Eventually(t, func() bool {
+		returned, err := restarted.receiver.Return(id, 40)
+		return err == nil && returned == 40
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(60), restarted.Ledger().Remaining(id))
+}
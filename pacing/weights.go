@@ -0,0 +1,99 @@
+package pacing
+
+import (
+	"pacing.go/dispatcher"
+	"sync"
+	"time"
+)
+
+// Weigher assigns each consumer its weight in the split of line items' allowances.
+// The returned weights are in the same order as the consumers.
+type Weigher func(consumers []dispatcher.Announcement) []float64
+
+// EqualWeights gives all consumers the same weight.
+func EqualWeights(consumers []dispatcher.Announcement) []float64 {
+	weights := make([]float64, len(consumers))
+	for i := range weights {
+		weights[i] = 1
+	}
+	return weights
+}
+
+// CapacityWeights weighs consumers by their announced capacity (QPS).
+// Consumers which have not declared the capacity get the mean capacity of others.
+func CapacityWeights(consumers []dispatcher.Announcement) []float64 {
+	weights := make([]float64, len(consumers))
+	for i, c := range consumers {
+		weights[i] = float64(c.Capacity)
+	}
+	return fillMissing(weights)
+}
+
+// fillMissing replaces non-positive weights with the mean of positive ones, or all weights with 1 if there are none.
+func fillMissing(weights []float64) []float64 {
+	var sum float64
+	var n int
+	for _, w := range weights {
+		if w > 0 {
+			sum += w
+			n++
+		}
+	}
+	mean := 1.0
+	if n > 0 {
+		mean = sum / float64(n)
+	}
+	for i, w := range weights {
+		if w <= 0 {
+			weights[i] = mean
+		}
+	}
+	return weights
+}
+
+// DefaultSpendRateHalfLife is the time after which the observed spend loses half of its weight.
+const DefaultSpendRateHalfLife = 5 * time.Minute
+
+// SpendRates keeps track of the recent spend rate of consumers, the older spend the lower weight it has.
+type SpendRates struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	halfLife time.Duration
+	rates    map[string]decayingSum
+}
+
+// NewSpendRates creates empty SpendRates, if the half-life is not positive DefaultSpendRateHalfLife is used.
+func NewSpendRates(halfLife time.Duration) *SpendRates {
+	if halfLife <= 0 {
+		halfLife = DefaultSpendRateHalfLife
+	}
+	return &SpendRates{
+		now:      time.Now,
+		halfLife: halfLife,
+		rates:    map[string]decayingSum{},
+	}
+}
+
+// Observe records the amount spent by the consumer with given ID.
+func (r *SpendRates) Observe(consumer string, amount int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rates[consumer] = r.rates[consumer].add(float64(amount), r.now(), r.halfLife)
+}
+
+// Rate returns the recent spend rate (per second) of the consumer with given ID.
+func (r *SpendRates) Rate(consumer string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rates[consumer].rate(r.now(), r.halfLife)
+}
+
+// Weights weighs consumers by their recent spend rate, it implements Weigher.
+// Consumers which have not spent recently get the mean rate of others, so new consumers get their share.
+func (r *SpendRates) Weights(consumers []dispatcher.Announcement) []float64 {
+	weights := make([]float64, len(consumers))
+	for i, c := range consumers {
+		weights[i] = r.Rate(c.ID)
+	}
+	return fillMissing(weights)
+}
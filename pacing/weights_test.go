@@ -0,0 +1,55 @@
+package pacing
+
+import (
+	"github.com/stretchr/testify/assert"
+	"pacing.go/dispatcher"
+	"testing"
+	"time"
+)
+
+func TestEqualWeights(t *testing.T) {
+	assert.Equal(t, []float64{}, EqualWeights(announcements()))
+	assert.Equal(t, []float64{1, 1}, EqualWeights(announcements("alice", "bob")))
+}
+
+func TestCapacityWeights(t *testing.T) {
+	tests := []struct {
+		name string
+		args []int64
+		want []float64
+	}{
+		{"declared", []int64{100, 300}, []float64{100, 300}},
+		{"partially declared", []int64{100, 0, 300}, []float64{100, 200, 300}},
+		{"none declared", []int64{0, 0}, []float64{1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumers := make([]dispatcher.Announcement, len(tt.args))
+			for i, capacity := range tt.args {
+				consumers[i] = dispatcher.Announcement{Capacity: capacity}
+			}
+			assert.Equal(t, tt.want, CapacityWeights(consumers))
+		})
+	}
+}
+
+func TestSpendRates(t *testing.T) {
+	now := time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local)
+	r := NewSpendRates(time.Minute)
+	r.now = func() time.Time { return now }
+
+	assert.Equal(t, 0.0, r.Rate("alice"))
+	r.Observe("alice", 600)
+	r.Observe("bob", 200)
+	rate := r.Rate("alice")
+	assert.Equal(t, 3*r.Rate("bob"), rate)
+
+	// The observed spend decays with time.
+	now = now.Add(time.Minute)
+	assert.InDelta(t, rate/2, r.Rate("alice"), 1e-9)
+
+	// Consumers without recent spend get the mean rate of others.
+	weights := r.Weights(announcements("alice", "bob", "charlie"))
+	assert.InDelta(t, 3*weights[1], weights[0], 1e-9)
+	assert.InDelta(t, (weights[0]+weights[1])/2, weights[2], 1e-9)
+}
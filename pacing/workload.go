@@ -1,8 +1,12 @@
 package pacing
 
 import (
+	"encoding/json"
 	"github.com/google/uuid"
 	"math"
+	"pacing.go/dispatcher"
+	"pacing.go/internal/hashring"
+	"sort"
 	"sync"
 	"time"
 )
@@ -24,12 +28,19 @@ func (s *PlannedSpend) Load(path string) error {
 	if err != nil {
 		return err
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.Set(snapshot)
+	return nil
+}
+
+// Set distributes the daily budgets of the records, the line items missing in the snapshot are not planned anymore.
+func (s *PlannedSpend) Set(snapshot []*Record) {
+	ps := make(map[uuid.UUID][]int64, len(snapshot))
 	for _, rec := range snapshot {
-		s.ps[rec.LineItemID] = EvenDistribution(rec.DailyBudget)
+		ps[rec.LineItemID] = EvenDistribution(rec.DailyBudget)
 	}
-	return nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ps = ps
 }
 
 func (s *PlannedSpend) Get(t int) map[uuid.UUID]int64 {
@@ -42,15 +53,23 @@ func (s *PlannedSpend) Get(t int) map[uuid.UUID]int64 {
 	return res
 }
 
+// Spend is the budget of line items spent in the latest time slot reported by bidders.
+// The late spend of past slots was within the allowances dispatched in those slots, so it is ignored,
+// except for the fallback spend the controller has not dispatched. It is charged to the latest slot,
+// so the following allowances make up for it, the part exceeding the plan of the slot is dropped.
 type Spend struct {
-	mu sync.RWMutex
-	s  map[uuid.UUID]int64
+	mu   sync.RWMutex
+	slot int
+	s    map[uuid.UUID]int64
+	// keys maps the keys of recorded reports to their slots
+	keys map[string]int
 }
 
 func NewSpend() *Spend {
 	return &Spend{
-		mu: sync.RWMutex{},
-		s:  map[uuid.UUID]int64{},
+		mu:   sync.RWMutex{},
+		s:    map[uuid.UUID]int64{},
+		keys: map[string]int{},
 	}
 }
 
@@ -64,6 +83,103 @@ func (s *Spend) Get(id uuid.UUID) int64 {
 	return res
 }
 
+// At returns the spend of the line item in given slot, it is zero if nothing has been reported in the slot yet.
+func (s *Spend) At(slot int, id uuid.UUID) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if slot != s.slot {
+		return 0
+	}
+	return s.s[id]
+}
+
+// Add records the amount spent on the line item in given slot. The spend of a newer slot replaces the older one,
+// the spend of an older slot is ignored, since its allowances are not dispatched anymore.
+func (s *Spend) Add(slot int, id uuid.UUID, amount int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(slot, id, amount)
+}
+
+// Report records the spend report, it returns false if the report is ignored,
+// i.e. the report with the same key has already been recorded or it is the late spend of a past slot.
+func (s *Spend) Report(r SpendReport) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot := r.Slot
+	if slot < s.slot {
+		if !r.Fallback {
+			return false
+		}
+		slot = s.slot
+	}
+	s.advance(slot)
+	if _, ok := s.keys[r.Key]; ok {
+		return false
+	}
+	for id, amount := range r.Spend {
+		s.add(slot, id, amount)
+	}
+	s.keys[r.Key] = r.Slot
+	return true
+}
+
+// add records the amount, it must be called with the lock held.
+func (s *Spend) add(slot int, id uuid.UUID, amount int64) {
+	if slot < s.slot {
+		return
+	}
+	s.advance(slot)
+	s.s[id] += amount
+}
+
+// advance moves to the newer slot, it must be called with the lock held.
+// The keys of reports are kept for the reportHorizon slots the bidders retry the reports for,
+// so a fallback report retried after the slot has changed is not charged again.
+func (s *Spend) advance(slot int) {
+	if slot > s.slot {
+		s.slot = slot
+		s.s = map[uuid.UUID]int64{}
+		for key, at := range s.keys {
+			if slot-at >= reportHorizon {
+				delete(s.keys, key)
+			}
+		}
+	}
+}
+
+// spendSnapshot is the encoded state of Spend.
+type spendSnapshot struct {
+	Slot  int                 `json:"slot"`
+	Spend map[uuid.UUID]int64 `json:"spend"`
+	Keys  map[string]int      `json:"keys,omitempty"`
+}
+
+// Snapshot encodes the spend, so it can be handed over to another controller.
+func (s *Spend) Snapshot() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return json.Marshal(spendSnapshot{Slot: s.slot, Spend: s.s, Keys: s.keys})
+}
+
+// Restore replaces the spend with the encoded one.
+func (s *Spend) Restore(data []byte) error {
+	var restored spendSnapshot
+	if err := json.Unmarshal(data, &restored); err != nil {
+		return err
+	}
+	if restored.Spend == nil {
+		restored.Spend = map[uuid.UUID]int64{}
+	}
+	if restored.Keys == nil {
+		restored.Keys = map[string]int{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slot, s.s, s.keys = restored.Slot, restored.Spend, restored.Keys
+	return nil
+}
+
 func TimeToSlot(t time.Time) int {
 	y, m, d := t.Date()
 	a := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
@@ -71,26 +187,114 @@ func TimeToSlot(t time.Time) int {
 	return int(math.Floor(secs / 60))
 }
 
-func MakeWorkloadSplitter(planned *PlannedSpend, spend *Spend, now func() time.Time) func(consumers []string) map[string]interface{} {
-	return func(consumers []string) map[string]interface{} {
+// SubsetSize decides among how many consumers the line item allowance is split.
+type SubsetSize func(allowance int64, consumers int) int
+
+// AllConsumers splits the allowance among all consumers.
+func AllConsumers(_ int64, consumers int) int {
+	return consumers
+}
+
+// MinShareSubsetSize splits the allowance among as many consumers as possible,
+// so that each of them gets at least minShare on average, but at least one consumer gets it.
+func MinShareSubsetSize(minShare int64) SubsetSize {
+	return func(allowance int64, consumers int) int {
+		if minShare <= 0 {
+			return consumers
+		}
+		size := allowance / minShare
+		if size < 1 {
+			return 1
+		}
+		if size > int64(consumers) {
+			return consumers
+		}
+		return int(size)
+	}
+}
+
+// MakeWorkloadSplitter creates the workload callback splitting line items' allowances equally among consumers.
+func MakeWorkloadSplitter(planned *PlannedSpend, spend *Spend, now func() time.Time) dispatcher.WorkloadCallback {
+	return MakeWeightedWorkloadSplitter(planned, spend, now, EqualWeights)
+}
+
+// MakeWeightedWorkloadSplitter creates the workload callback splitting line items' allowances among consumers
+// proportionally to their weights. The consumers' shares of a line item sum up exactly to its allowance,
+// consumers with zero share do not get the line item at all.
+func MakeWeightedWorkloadSplitter(planned *PlannedSpend, spend *Spend, now func() time.Time, weigher Weigher) dispatcher.WorkloadCallback {
+	return MakeSubsetWorkloadSplitter(planned, spend, now, weigher, AllConsumers)
+}
+
+// MakeSubsetWorkloadSplitter creates the workload callback splitting every line item's allowance among a subset
+// of consumers, proportionally to their weights. The subset size is decided by the size function
+// and the consumers are selected with weighted rendezvous hashing of the line item and the consumers' IDs,
+// so a line item stays with the same consumers unless one of them leaves or a better one joins.
+func MakeSubsetWorkloadSplitter(planned *PlannedSpend, spend *Spend, now func() time.Time, weigher Weigher, size SubsetSize) dispatcher.WorkloadCallback {
+	return func(consumers []dispatcher.Announcement) map[string]dispatcher.Allowances {
+		wrk := make(map[string]dispatcher.Allowances, len(consumers))
 		if len(consumers) == 0 {
-			return map[string]interface{}{}
+			return wrk
+		}
+		// The order of consumers decides who gets the remainder units, it is kept stable between rounds.
+		consumers = append([]dispatcher.Announcement(nil), consumers...)
+		sort.Slice(consumers, func(i, j int) bool { return consumers[i].Address < consumers[j].Address })
+		weights := weigher(consumers)
+		ids := make([]string, len(consumers))
+		for i, c := range consumers {
+			ids[i] = c.ID
+			wrk[c.Address] = dispatcher.Allowances{}
 		}
 		slot := TimeToSlot(now())
-		consWrk := map[uuid.UUID]int64{}
+		subsetWeights := make([]float64, 0, len(consumers))
 		for id, planned := range planned.Get(slot) {
-			diff := planned - spend.Get(id)
-			// skip line item if the available budget will be 0 or less per consumer
-			if diff < int64(len(consumers)) {
+			diff := planned - spend.At(slot, id)
+			// skip line item if there is no budget available
+			if diff <= 0 {
 				continue
 			}
-			fragment := diff / int64(len(consumers))
-			consWrk[id] = fragment
-		}
-		wrk := map[string]interface{}{}
-		for _, c := range consumers {
-			wrk[c] = consWrk
+			k := size(diff, len(consumers))
+			if k >= len(consumers) {
+				for i, share := range Apportion(diff, weights) {
+					if share > 0 {
+						wrk[consumers[i].Address][id] = share
+					}
+				}
+				continue
+			}
+			subset := hashring.Rendezvous(id[:], ids, weights, k)
+			subsetWeights = subsetWeights[:0]
+			for _, i := range subset {
+				subsetWeights = append(subsetWeights, weights[i])
+			}
+			for j, share := range Apportion(diff, subsetWeights) {
+				if share > 0 {
+					wrk[consumers[subset[j]].Address][id] = share
+				}
+			}
 		}
 		return wrk
 	}
 }
+
+// MakeSharesSplitter creates the shares callback for the broadcast mode of the dispatcher.
+// It sends the allowances of line items once for all consumers together with the consumers' weights,
+// every consumer computes its own share of every line item. Line items are not split among subsets of consumers.
+func MakeSharesSplitter(planned *PlannedSpend, spend *Spend, now func() time.Time, weigher Weigher) dispatcher.SharesCallback {
+	return func(consumers []dispatcher.Announcement) dispatcher.Shares {
+		shares := dispatcher.Shares{Allowances: dispatcher.Allowances{}, Weights: make(map[string]float64, len(consumers))}
+		if len(consumers) == 0 {
+			return shares
+		}
+		for i, w := range weigher(consumers) {
+			shares.Weights[consumers[i].Address] = w
+		}
+		slot := TimeToSlot(now())
+		for id, planned := range planned.Get(slot) {
+			// skip line item if there is no budget available
+			if diff := planned - spend.At(slot, id); diff > 0 {
+				shares.Allowances[id] = diff
+			}
+		}
+		return shares
+	}
+}
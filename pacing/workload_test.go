@@ -3,10 +3,21 @@ package pacing
 import (
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"pacing.go/dispatcher"
+	"sort"
 	"testing"
 	"time"
 )
 
+// announcements creates minimal announcements of consumers with given addresses.
+func announcements(addresses ...string) []dispatcher.Announcement {
+	res := make([]dispatcher.Announcement, len(addresses))
+	for i, address := range addresses {
+		res[i] = dispatcher.Announcement{ID: address, Address: address}
+	}
+	return res
+}
+
 func TestPlannedSpendLoad(t *testing.T) {
 	path, recs, err := CreateSnapshot(3)
 	assert.NoError(t, err)
@@ -22,6 +33,16 @@ func TestPlannedSpendLoad(t *testing.T) {
 	}
 }
 
+func TestPlannedSpendSet(t *testing.T) {
+	kept, removed := uuid.New(), uuid.New()
+	s := NewPlannedSpend()
+	s.Set([]*Record{{LineItemID: kept, DailyBudget: TimeSlots}, {LineItemID: removed, DailyBudget: TimeSlots}})
+	assert.Equal(t, map[uuid.UUID]int64{kept: 1, removed: 1}, s.Get(0))
+
+	s.Set([]*Record{{LineItemID: kept, DailyBudget: 2 * TimeSlots}})
+	assert.Equal(t, map[uuid.UUID]int64{kept: 2}, s.Get(0))
+}
+
 func TestCurrentSlot(t *testing.T) {
 	type args struct {
 		t time.Time
@@ -59,7 +80,7 @@ func TestMakeWorkloadSplitterReturnsValidNumberOfWorkloads(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			split := splitter(tt.args)
+			split := splitter(announcements(tt.args...))
 			assert.Len(t, split, tt.want)
 		})
 	}
@@ -77,20 +98,22 @@ func TestMakeWorkloadSplitterDividesWorkEqually(t *testing.T) {
 	tests := []struct {
 		name string
 		args []string
-		want int64
+		want map[string]int64
 	}{
-		{"zero consumers", []string{}, 0},
-		{"one consumers", []string{"alice"}, 9},
-		{"two consumers", []string{"alice", "bob"}, 4},
-		{"three consumers", []string{"alice", "bob", "charlie"}, 3},
+		{"zero consumers", []string{}, map[string]int64{}},
+		{"one consumers", []string{"alice"}, map[string]int64{"alice": 9}},
+		{"two consumers", []string{"alice", "bob"}, map[string]int64{"alice": 5, "bob": 4}},
+		{"three consumers", []string{"alice", "bob", "charlie"}, map[string]int64{"alice": 3, "bob": 3, "charlie": 3}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			split := splitter(tt.args)
+			split := splitter(announcements(tt.args...))
+			got := map[string]int64{}
 			for k, v := range split {
 				assert.Contains(t, tt.args, k)
-				assert.Equal(t, v.(map[uuid.UUID]int64)[lineItemId], tt.want)
+				got[k] = v[lineItemId]
 			}
+			assert.Equal(t, tt.want, got)
 		})
 	}
 }
@@ -103,38 +126,86 @@ func TestMakeWorkloadSplitterTakesIntoAccountSpend(t *testing.T) {
 	}
 	spend := NewSpend()
 	now := func() time.Time { return time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local) }
-	consumers := []string{"alice", "bob", "charlie"}
+	consumers := announcements("alice", "bob", "charlie")
 	splitter := MakeWorkloadSplitter(planned, spend, now)
 	tests := []struct {
 		name string
 		args int64
-		want int64
+		want map[string]int64
 	}{
-		{"no spend", 0, 3},
-		{"partial spend", 6, 1},
-		{"partial spend not enough for all", 7, 0},
-		{"full spend", 9, 0},
-		{"overspend", 10, 0},
+		{"no spend", 0, map[string]int64{"alice": 3, "bob": 3, "charlie": 3}},
+		{"partial spend", 6, map[string]int64{"alice": 1, "bob": 1, "charlie": 1}},
+		{"partial spend not enough for all", 7, map[string]int64{"alice": 1, "bob": 1}},
+		{"full spend", 9, map[string]int64{}},
+		{"overspend", 10, map[string]int64{}},
 	}
 	for _, tt := range tests {
 		spend.s[lineItemId] = tt.args
 		t.Run(tt.name, func(t *testing.T) {
 			split := splitter(consumers)
 			assert.Len(t, split, 3)
-			for _, v := range split {
-				vv, ok := v.(map[uuid.UUID]int64)[lineItemId]
+			got := map[string]int64{}
+			for k, v := range split {
 				// Expect that items without budget are not distributed
-				if tt.want > 0 {
-					assert.True(t, ok)
-					assert.Equal(t, vv, tt.want)
-				} else {
-					assert.False(t, ok)
+				if vv, ok := v[lineItemId]; ok {
+					assert.Positive(t, vv)
+					got[k] = vv
 				}
 			}
+			assert.Equal(t, tt.want, got)
 		})
 	}
 }
 
+func TestMakeWeightedWorkloadSplitter(t *testing.T) {
+	planned := NewPlannedSpend()
+	lineItemId := uuid.New()
+	planned.ps = map[uuid.UUID][]int64{
+		lineItemId: {1001},
+	}
+	now := func() time.Time { return time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local) }
+	consumers := []dispatcher.Announcement{
+		{ID: "alice", Address: "alice", Capacity: 100},
+		{ID: "bob", Address: "bob", Capacity: 300},
+		{ID: "charlie", Address: "charlie", Capacity: 600},
+	}
+	splitter := MakeWeightedWorkloadSplitter(planned, NewSpend(), now, CapacityWeights)
+	split := splitter(consumers)
+	assert.Equal(t, int64(100), split["alice"][lineItemId])
+	assert.Equal(t, int64(300), split["bob"][lineItemId])
+	assert.Equal(t, int64(601), split["charlie"][lineItemId])
+}
+
+func TestMakeSharesSplitter(t *testing.T) {
+	planned := NewPlannedSpend()
+	lineItemId, spentId := uuid.New(), uuid.New()
+	planned.ps = map[uuid.UUID][]int64{
+		lineItemId: {1001},
+		spentId:    {10},
+	}
+	spend := NewSpend()
+	spend.s[spentId] = 10
+	now := func() time.Time { return time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local) }
+	consumers := []dispatcher.Announcement{
+		{ID: "alice", Address: "alice", Capacity: 100},
+		{ID: "bob", Address: "bob", Capacity: 300},
+		{ID: "charlie", Address: "charlie", Capacity: 600},
+	}
+	splitter := MakeSharesSplitter(planned, spend, now, CapacityWeights)
+	shares := splitter(consumers)
+	assert.Equal(t, dispatcher.Allowances{lineItemId: 1001}, shares.Allowances)
+	assert.Equal(t, map[string]float64{"alice": 100, "bob": 300, "charlie": 600}, shares.Weights)
+	var sum int64
+	for _, c := range consumers {
+		a, ok := shares.Share(c.Address)
+		assert.True(t, ok)
+		sum += a[lineItemId]
+	}
+	assert.Equal(t, int64(1001), sum)
+
+	assert.Empty(t, splitter(nil).Weights)
+}
+
 func TestMakeWorkloadSplitterComputesForSpecificSlot(t *testing.T) {
 	planned := NewPlannedSpend()
 	lineItemId := uuid.New()
@@ -142,7 +213,7 @@ func TestMakeWorkloadSplitterComputesForSpecificSlot(t *testing.T) {
 		lineItemId: {9, 18, 27},
 	}
 	spend := NewSpend()
-	consumers := []string{"alice", "bob", "charlie"}
+	consumers := announcements("alice", "bob", "charlie")
 	tests := []struct {
 		name string
 		args int
@@ -159,10 +230,137 @@ func TestMakeWorkloadSplitterComputesForSpecificSlot(t *testing.T) {
 			split := splitter(consumers)
 			assert.Len(t, split, 3)
 			for _, v := range split {
-				vv, ok := v.(map[uuid.UUID]int64)[lineItemId]
+				vv, ok := v[lineItemId]
 				assert.True(t, ok)
 				assert.Equal(t, vv, tt.want)
 			}
 		})
 	}
 }
+
+func TestSpendSnapshotRestore(t *testing.T) {
+	lineItemId := uuid.New()
+	spend := NewSpend()
+	spend.s[lineItemId] = 42
+
+	snapshot, err := spend.Snapshot()
+	assert.NoError(t, err)
+
+	restored := NewSpend()
+	restored.s[uuid.New()] = 1
+	assert.NoError(t, restored.Restore(snapshot))
+	assert.Equal(t, spend.s, restored.s)
+
+	assert.Error(t, restored.Restore([]byte("invalid")))
+	assert.Equal(t, int64(42), restored.Get(lineItemId))
+}
+
+func TestMinShareSubsetSize(t *testing.T) {
+	type args struct {
+		allowance int64
+		consumers int
+	}
+	tests := []struct {
+		name     string
+		minShare int64
+		args     args
+		want     int
+	}{
+		{"enough for all", 10, args{100, 5}, 5},
+		{"enough for some", 10, args{25, 5}, 2},
+		{"not enough for any", 10, args{5, 5}, 1},
+		{"no minimum", 0, args{5, 5}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, MinShareSubsetSize(tt.minShare)(tt.args.allowance, tt.args.consumers))
+		})
+	}
+}
+
+func TestMakeSubsetWorkloadSplitter(t *testing.T) {
+	planned := NewPlannedSpend()
+	small, large := uuid.New(), uuid.New()
+	planned.ps = map[uuid.UUID][]int64{
+		small: {10},
+		large: {1000},
+	}
+	now := func() time.Time { return time.Date(2023, 2, 17, 0, 0, 0, 0, time.Local) }
+	splitter := MakeSubsetWorkloadSplitter(planned, NewSpend(), now, EqualWeights, MinShareSubsetSize(5))
+
+	// holders returns consumers which got the line item and checks the shares sum up to the allowance.
+	holders := func(split map[string]dispatcher.Allowances, id uuid.UUID) []string {
+		var res []string
+		var sum int64
+		for c, a := range split {
+			if v, ok := a[id]; ok {
+				res = append(res, c)
+				sum += v
+			}
+		}
+		assert.Equal(t, planned.ps[id][0], sum)
+		sort.Strings(res)
+		return res
+	}
+
+	consumers := []string{"alice", "bob", "charlie", "dave", "eve", "frank"}
+	split := splitter(announcements(consumers...))
+	assert.Len(t, split, len(consumers))
+	smallHolders := holders(split, small)
+	assert.Len(t, smallHolders, 2)
+	assert.Len(t, holders(split, large), len(consumers))
+
+	// The subset is stable when a consumer outside of it leaves.
+	var remaining []string
+	left := false
+	for _, c := range consumers {
+		if !left && c != smallHolders[0] && c != smallHolders[1] {
+			left = true
+			continue
+		}
+		remaining = append(remaining, c)
+	}
+	assert.Equal(t, smallHolders, holders(splitter(announcements(remaining...)), small))
+}
+
+func TestSpendReport(t *testing.T) {
+	id := uuid.New()
+	spend := NewSpend()
+
+	assert.True(t, spend.Report(SpendReport{Key: "a", Slot: 1, Spend: map[uuid.UUID]int64{id: 10}}))
+	assert.True(t, spend.Report(SpendReport{Key: "b", Slot: 1, Spend: map[uuid.UUID]int64{id: 5}}))
+	// The retried report is recorded only once.
+	assert.False(t, spend.Report(SpendReport{Key: "a", Slot: 1, Spend: map[uuid.UUID]int64{id: 10}}))
+	assert.Equal(t, int64(15), spend.At(1, id))
+	assert.Equal(t, int64(0), spend.At(2, id))
+
+	// The spend of the newer slot replaces the older one, the late reports of the older slot are ignored.
+	spend.Add(2, id, 7)
+	assert.False(t, spend.Report(SpendReport{Key: "c", Slot: 1, Spend: map[uuid.UUID]int64{id: 10}}))
+	assert.Equal(t, int64(7), spend.At(2, id))
+	assert.Equal(t, int64(0), spend.At(1, id))
+
+	// The late fallback spend was not dispatched by the controller, it is charged to the newer slot once.
+	assert.True(t, spend.Report(SpendReport{Key: "e", Slot: 1, Spend: map[uuid.UUID]int64{id: 3}, Fallback: true}))
+	assert.False(t, spend.Report(SpendReport{Key: "e", Slot: 1, Spend: map[uuid.UUID]int64{id: 3}, Fallback: true}))
+	assert.Equal(t, int64(10), spend.At(2, id))
+
+	// The keys are handed over together with the spend.
+	assert.True(t, spend.Report(SpendReport{Key: "d", Slot: 2, Spend: map[uuid.UUID]int64{id: 1}}))
+	snapshot, err := spend.Snapshot()
+	assert.NoError(t, err)
+	restored := NewSpend()
+	assert.NoError(t, restored.Restore(snapshot))
+	assert.False(t, restored.Report(SpendReport{Key: "d", Slot: 2, Spend: map[uuid.UUID]int64{id: 1}}))
+	assert.Equal(t, int64(11), restored.At(2, id))
+
+	// The fallback report retried after the slot has changed is not charged again.
+	restored.Add(3, id, 2)
+	assert.False(t, restored.Report(SpendReport{Key: "e", Slot: 1, Spend: map[uuid.UUID]int64{id: 3}, Fallback: true}))
+	assert.Equal(t, int64(2), restored.At(3, id))
+
+	// The keys are dropped once the reports are not retried anymore.
+	restored.Add(1+reportHorizon, id, 4)
+	assert.NotContains(t, restored.keys, "e")
+	assert.Contains(t, restored.keys, "d")
+}
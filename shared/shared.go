@@ -13,11 +13,20 @@ func PanicIf(err error) {
 }
 
 func WaitForSignal(callback func(sig os.Signal)) {
+	WaitForSignalOr(nil, callback)
+}
+
+// WaitForSignalOr waits for SIGINT or SIGTERM like WaitForSignal, or until something is received on the stop channel,
+// e.g. the drain requested by the admin endpoint. The callback gets nil signal then.
+func WaitForSignalOr(stop <-chan struct{}, callback func(sig os.Signal)) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
 	select {
 	case sig := <-sigs:
 		callback(sig)
+	case <-stop:
+		callback(nil)
 	}
 }
 